@@ -3,24 +3,87 @@ package backend
 import (
 	"log"
 	"net"
+	"time"
 
 	"github.com/iampigeon/pigeon"
+	"github.com/iampigeon/pigeon/connpool"
 	"github.com/iampigeon/pigeon/proto"
+	"github.com/iampigeon/pigeon/tlsutil"
 	"golang.org/x/net/context"
 	"google.golang.org/grpc"
 )
 
+// Codes of the errors returned by backends.
+const (
+	// CodeUnknown is a permanent failure.
+	CodeUnknown = 0
+	// CodeTemporary is a failure that can be retried, see
+	// pigeon.TemporaryError.
+	CodeTemporary = 1
+)
+
+// Config configures the grpc server of a backend.
+type Config struct {
+	// Addr is the network address to listen on.
+	Addr pigeon.NetAddr
+
+	// TLS enables TLS, or mutual TLS when it requires client certificates.
+	// Plain text is used when nil.
+	TLS *tlsutil.Credentials
+
+	// Channel is the name of the channel served by the backend. When it
+	// and SchedulerAddr are set the backend registers itself in the
+	// scheduler and keeps the registration alive with heartbeats.
+	Channel string
+
+	// Channels are more channels served by the backend, registered like
+	// Channel.
+	Channels []string
+
+	// SchedulerAddr is the network address of the scheduler service.
+	SchedulerAddr pigeon.NetAddr
+
+	// SchedulerTLS secures the connection to the scheduler.
+	SchedulerTLS *tlsutil.Credentials
+
+	// AdvertiseAddr is the address registered in the scheduler, Addr is
+	// used when empty. The scheduler rejects addresses without a host or
+	// with an unspecified one, such as ":9010" or "0.0.0.0:9010".
+	AdvertiseAddr pigeon.NetAddr
+}
+
 // ListenAndServe ...
 func ListenAndServe(addr pigeon.NetAddr, backend pigeon.Backend) error {
-	lis, err := net.Listen("tcp", string(addr))
+	return Serve(Config{Addr: addr}, backend)
+}
+
+// Serve listens on config.Addr and serves backend until an error occurs.
+func Serve(config Config, backend pigeon.Backend) error {
+	lis, err := net.Listen("tcp", string(config.Addr))
 	if err != nil {
 		log.Fatal(err)
 	}
 
-	s := grpc.NewServer()
+	return ServeListener(lis, config, backend)
+}
+
+// ServeListener serves backend on lis until an error occurs. config.Addr is
+// not listened on, it is only registered in the scheduler when AdvertiseAddr
+// is empty.
+func ServeListener(lis net.Listener, config Config, backend pigeon.Backend) error {
+	opts := append(config.TLS.ServerOptions(), connpool.ServerOption())
+	s := grpc.NewServer(opts...)
 
 	proto.RegisterBackendServiceServer(s, &service{backend})
 
+	if config.SchedulerAddr != "" {
+		for _, channel := range append([]string{config.Channel}, config.Channels...) {
+			if channel != "" {
+				go register(config, channel)
+			}
+		}
+	}
+
 	return s.Serve(lis)
 }
 
@@ -36,8 +99,7 @@ func (s *service) Approve(ctx context.Context, r *proto.ApproveRequest) (*proto.
 	resp.Valid, err = s.backend.Approve(r.Content)
 	if err != nil {
 		resp.Error = &proto.Error{
-			// TODO(ja): define error codes.
-			Code:    0,
+			Code:    CodeUnknown,
 			Message: err.Error(),
 		}
 	}
@@ -46,12 +108,36 @@ func (s *service) Approve(ctx context.Context, r *proto.ApproveRequest) (*proto.
 
 func (s *service) Deliver(ctx context.Context, r *proto.DeliverRequest) (*proto.DeliverResponse, error) {
 	var resp proto.DeliverResponse
-	if err := s.backend.Deliver(r.Content); err != nil {
+
+	var err error
+	if b, ok := s.backend.(pigeon.DeliveryBackend); ok && r.DeliveryId != "" {
+		err = b.DeliverOnce(r.DeliveryId, r.MessageId, r.Content)
+	} else if b, ok := s.backend.(pigeon.MessageBackend); ok && r.MessageId != "" {
+		err = b.DeliverMessage(r.MessageId, r.Content)
+	} else {
+		err = s.backend.Deliver(r.Content)
+	}
+	if e, ok := err.(*pigeon.InvalidRecipientsError); ok {
+		resp.InvalidRecipients = e.Recipients
+		switch {
+		case e.Err != nil:
+			// the message failed for the valid recipients it did not reach.
+			err = e.Err
+		case e.Delivered > 0:
+			// the message reached all the valid recipients.
+			err = nil
+		}
+	}
+	if err != nil {
 		resp.Error = &proto.Error{
-			// TODO(ja): define error codes.
-			Code:    0,
+			Code:    CodeUnknown,
 			Message: err.Error(),
 		}
+
+		if e, ok := err.(*pigeon.TemporaryError); ok {
+			resp.Error.Code = CodeTemporary
+			resp.Error.RetryAfter = int64(e.RetryAfter / time.Second)
+		}
 	}
 	return &resp, nil
 }
@@ -0,0 +1,123 @@
+/*
+Package chat implements a pigeon.Backend that delivers pigeon.Chat
+messages to Telegram chats and Slack channels.
+
+Rate limits of the providers are returned as *pigeon.TemporaryError with
+the retry after hint of the provider, so the scheduler retries the message
+instead of failing it.
+*/
+package chat
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/iampigeon/pigeon"
+	"github.com/pkg/errors"
+)
+
+const (
+	// FormatMarkdown ...
+	FormatMarkdown = "markdown"
+	// FormatHTML ...
+	FormatHTML = "html"
+
+	// DefaultTimeout bounds the requests to the providers when they have
+	// no client.
+	DefaultTimeout = 10 * time.Second
+)
+
+var defaultClient = &http.Client{Timeout: DefaultTimeout}
+
+// Provider sends messages through a chat service.
+type Provider interface {
+	// Validate reports whether c can be sent by the provider.
+	Validate(c *pigeon.Chat) error
+
+	// Send delivers c.
+	Send(c *pigeon.Chat) error
+}
+
+// Backend delivers chat messages.
+type Backend struct {
+	providers map[string]Provider
+}
+
+var _ pigeon.Backend = (*Backend)(nil)
+
+// New returns a chat backend that sends through the given providers, keyed
+// by provider name.
+func New(providers map[string]Provider) *Backend {
+	return &Backend{providers: providers}
+}
+
+// Approve validates that content is a deliverable pigeon.Chat.
+func (b *Backend) Approve(content []byte) (bool, error) {
+	if _, _, err := b.decode(content); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// Deliver sends the message encoded in content.
+func (b *Backend) Deliver(content []byte) error {
+	c, p, err := b.decode(content)
+	if err != nil {
+		return err
+	}
+
+	return p.Send(c)
+}
+
+func (b *Backend) decode(content []byte) (*pigeon.Chat, Provider, error) {
+	c := new(pigeon.Chat)
+	if err := json.Unmarshal(content, c); err != nil {
+		return nil, nil, errors.Wrap(err, "invalid chat content")
+	}
+
+	p, ok := b.providers[c.Provider]
+	if !ok {
+		return nil, nil, errors.Errorf("unsupported chat provider %q", c.Provider)
+	}
+
+	if c.Text == "" {
+		return nil, nil, errors.New("missing text")
+	}
+	switch c.Format {
+	case "", FormatMarkdown, FormatHTML:
+	default:
+		return nil, nil, errors.Errorf("unsupported format %q", c.Format)
+	}
+
+	if err := p.Validate(c); err != nil {
+		return nil, nil, err
+	}
+
+	return c, p, nil
+}
+
+// statusError returns the error of a failed response, temporary for rate
+// limits and server errors.
+func statusError(provider string, resp *http.Response, description string, retryAfter time.Duration) error {
+	err := errors.Errorf("%s responded %s: %s", provider, resp.Status, description)
+
+	if resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode >= 500 {
+		if retryAfter == 0 {
+			retryAfter = parseRetryAfter(resp.Header.Get("Retry-After"))
+		}
+		return &pigeon.TemporaryError{Err: err, RetryAfter: retryAfter}
+	}
+
+	return err
+}
+
+// parseRetryAfter parses a Retry-After header given in seconds.
+func parseRetryAfter(v string) time.Duration {
+	n, err := strconv.Atoi(v)
+	if err != nil || n < 0 {
+		return 0
+	}
+	return time.Duration(n) * time.Second
+}
@@ -0,0 +1,194 @@
+package chat
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/iampigeon/pigeon"
+)
+
+// request is a request received by a fake API.
+type request struct {
+	path string
+	body map[string]interface{}
+}
+
+// newAPI returns a fake API that answers with status, header and body, and
+// sends the requests it receives on the returned channel.
+func newAPI(t *testing.T, status int, header http.Header, body string) (*httptest.Server, chan request) {
+	requests := make(chan request, 10)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var b map[string]interface{}
+		if err := json.NewDecoder(r.Body).Decode(&b); err != nil {
+			t.Error(err)
+		}
+		requests <- request{r.URL.Path, b}
+
+		for k, v := range header {
+			w.Header()[k] = v
+		}
+		w.WriteHeader(status)
+		w.Write([]byte(body))
+	}))
+	return srv, requests
+}
+
+func content(t *testing.T, c pigeon.Chat) []byte {
+	b, err := json.Marshal(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+func TestTelegram(t *testing.T) {
+	srv, requests := newAPI(t, http.StatusOK, nil, `{"ok": true}`)
+	defer srv.Close()
+
+	b := New(map[string]Provider{"telegram": &Telegram{BotToken: "default", BaseURL: srv.URL}})
+
+	tests := []struct {
+		c         pigeon.Chat
+		path      string
+		parseMode interface{}
+	}{
+		{pigeon.Chat{ChatID: "42", Text: "*Order* shipped."}, "/botdefault/sendMessage", nil},
+		{pigeon.Chat{ChatID: "42", Text: "*Order* shipped.", Format: FormatMarkdown, BotToken: "own"}, "/botown/sendMessage", "Markdown"},
+		{pigeon.Chat{ChatID: "42", Text: "<b>Order</b> shipped.", Format: FormatHTML}, "/botdefault/sendMessage", "HTML"},
+	}
+	for _, tt := range tests {
+		tt.c.Provider = "telegram"
+		if err := b.Deliver(content(t, tt.c)); err != nil {
+			t.Fatalf("%q: %v", tt.c.Format, err)
+		}
+
+		r := <-requests
+		if r.path != tt.path {
+			t.Errorf("%q: path %s, want %s", tt.c.Format, r.path, tt.path)
+		}
+		if r.body["chat_id"] != "42" || r.body["text"] != tt.c.Text || r.body["parse_mode"] != tt.parseMode {
+			t.Errorf("%q: body %v", tt.c.Format, r.body)
+		}
+	}
+}
+
+func TestTelegramErrors(t *testing.T) {
+	tests := []struct {
+		status     int
+		body       string
+		temporary  bool
+		retryAfter time.Duration
+	}{
+		{http.StatusTooManyRequests, `{"ok": false, "description": "Too Many Requests", "parameters": {"retry_after": 7}}`, true, 7 * time.Second},
+		{http.StatusBadGateway, `{"ok": false, "description": "Bad Gateway"}`, true, 0},
+		{http.StatusBadRequest, `{"ok": false, "description": "Bad Request: chat not found"}`, false, 0},
+		{http.StatusForbidden, `{"ok": false, "description": "Forbidden: bot was blocked by the user"}`, false, 0},
+	}
+
+	for _, tt := range tests {
+		srv, _ := newAPI(t, tt.status, nil, tt.body)
+
+		tg := &Telegram{BotToken: "secret-token", BaseURL: srv.URL}
+		err := tg.Send(&pigeon.Chat{ChatID: "42", Text: "hi"})
+		if err == nil {
+			t.Fatalf("%d: delivered", tt.status)
+		}
+		if strings.Contains(err.Error(), "secret-token") {
+			t.Errorf("%d: error leaks the bot token: %v", tt.status, err)
+		}
+
+		e, ok := err.(*pigeon.TemporaryError)
+		if ok != tt.temporary {
+			t.Errorf("%d: temporary %v, want %v", tt.status, ok, tt.temporary)
+		}
+		if ok && e.RetryAfter != tt.retryAfter {
+			t.Errorf("%d: retry after %s, want %s", tt.status, e.RetryAfter, tt.retryAfter)
+		}
+
+		srv.Close()
+	}
+}
+
+func TestSlack(t *testing.T) {
+	srv, requests := newAPI(t, http.StatusOK, nil, "ok")
+	defer srv.Close()
+
+	b := New(map[string]Provider{"slack": &Slack{}})
+	err := b.Deliver(content(t, pigeon.Chat{Provider: "slack", WebhookURL: srv.URL + "/services/T/B/X", Text: "*hi*", Format: FormatMarkdown}))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r := <-requests
+	if r.path != "/services/T/B/X" || r.body["text"] != "*hi*" || r.body["mrkdwn"] != true {
+		t.Errorf("request %+v", r)
+	}
+}
+
+func TestSlackErrors(t *testing.T) {
+	tests := []struct {
+		status     int
+		header     http.Header
+		temporary  bool
+		retryAfter time.Duration
+	}{
+		{http.StatusTooManyRequests, http.Header{"Retry-After": {"12"}}, true, 12 * time.Second},
+		{http.StatusServiceUnavailable, nil, true, 0},
+		{http.StatusNotFound, nil, false, 0},
+	}
+
+	for _, tt := range tests {
+		srv, _ := newAPI(t, tt.status, tt.header, "invalid_token")
+
+		err := (&Slack{}).Send(&pigeon.Chat{WebhookURL: srv.URL, Text: "hi"})
+		if err == nil {
+			t.Fatalf("%d: delivered", tt.status)
+		}
+		if !strings.Contains(err.Error(), "invalid_token") {
+			t.Errorf("%d: error without the description: %v", tt.status, err)
+		}
+
+		e, ok := err.(*pigeon.TemporaryError)
+		if ok != tt.temporary {
+			t.Errorf("%d: temporary %v, want %v", tt.status, ok, tt.temporary)
+		}
+		if ok && e.RetryAfter != tt.retryAfter {
+			t.Errorf("%d: retry after %s, want %s", tt.status, e.RetryAfter, tt.retryAfter)
+		}
+
+		srv.Close()
+	}
+}
+
+func TestApprove(t *testing.T) {
+	b := New(map[string]Provider{"telegram": &Telegram{}, "slack": &Slack{}})
+
+	tests := []struct {
+		name string
+		c    pigeon.Chat
+	}{
+		{"provider", pigeon.Chat{Provider: "irc", Text: "hi"}},
+		{"missing text", pigeon.Chat{Provider: "telegram", ChatID: "42", BotToken: "t"}},
+		{"format", pigeon.Chat{Provider: "telegram", ChatID: "42", BotToken: "t", Text: "hi", Format: "rst"}},
+		{"missing chat id", pigeon.Chat{Provider: "telegram", BotToken: "t", Text: "hi"}},
+		{"missing bot token", pigeon.Chat{Provider: "telegram", ChatID: "42", Text: "hi"}},
+		{"long text", pigeon.Chat{Provider: "telegram", ChatID: "42", BotToken: "t", Text: strings.Repeat("a", TelegramMaxLength+1)}},
+		{"webhook url", pigeon.Chat{Provider: "slack", WebhookURL: "ftp://hooks.slack.com", Text: "hi"}},
+		{"slack html", pigeon.Chat{Provider: "slack", WebhookURL: "https://hooks.slack.com/x", Text: "hi", Format: FormatHTML}},
+	}
+	for _, tt := range tests {
+		if ok, err := b.Approve(content(t, tt.c)); ok || err == nil {
+			t.Errorf("invalid %s approved", tt.name)
+		}
+	}
+}
+
+func TestDefaultClientTimeout(t *testing.T) {
+	if defaultClient.Timeout == 0 {
+		t.Fatal("default client without timeout")
+	}
+}
@@ -0,0 +1,74 @@
+package chat
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/iampigeon/pigeon"
+	"github.com/pkg/errors"
+)
+
+// Slack is a Provider for Slack incoming webhooks.
+type Slack struct {
+	// Client sends the requests, a client with DefaultTimeout when nil.
+	Client *http.Client
+}
+
+var _ Provider = (*Slack)(nil)
+
+type slackRequest struct {
+	Text   string `json:"text"`
+	Mrkdwn bool   `json:"mrkdwn"`
+}
+
+// Validate ...
+func (s *Slack) Validate(c *pigeon.Chat) error {
+	if c.WebhookURL == "" {
+		return errors.New("missing slack webhook_url")
+	}
+	u, err := url.Parse(c.WebhookURL)
+	if err != nil || (u.Scheme != "https" && u.Scheme != "http") || u.Host == "" {
+		return errors.New("invalid slack webhook_url")
+	}
+	if c.Format == FormatHTML {
+		return errors.New("slack does not support html format")
+	}
+	return nil
+}
+
+// Send posts c to its incoming webhook.
+func (s *Slack) Send(c *pigeon.Chat) error {
+	body, err := json.Marshal(slackRequest{
+		Text:   c.Text,
+		Mrkdwn: c.Format == FormatMarkdown,
+	})
+	if err != nil {
+		return err
+	}
+
+	client := s.Client
+	if client == nil {
+		client = defaultClient
+	}
+
+	resp, err := client.Post(c.WebhookURL, "application/json", bytes.NewReader(body))
+	if err != nil {
+		// the webhook url is a secret, do not leak it in the error.
+		return &pigeon.TemporaryError{Err: errors.New("could not reach slack")}
+	}
+	defer resp.Body.Close()
+
+	// slack answers errors in plain text, such as "invalid_payload".
+	description, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 1024))
+
+	if resp.StatusCode != http.StatusOK {
+		return statusError("slack", resp, strings.TrimSpace(string(description)), 0)
+	}
+
+	return nil
+}
@@ -0,0 +1,112 @@
+package chat
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"time"
+	"unicode/utf8"
+
+	"github.com/iampigeon/pigeon"
+	"github.com/pkg/errors"
+)
+
+// TelegramURL is the base URL of the Telegram Bot API.
+const TelegramURL = "https://api.telegram.org"
+
+// TelegramMaxLength is the maximum number of characters of a message.
+const TelegramMaxLength = 4096
+
+// Telegram is a Provider for the Telegram Bot API.
+type Telegram struct {
+	// BotToken is used for messages without their own bot token.
+	BotToken string
+
+	// BaseURL is the API base URL, TelegramURL when empty.
+	BaseURL string
+
+	// Client sends the requests, a client with DefaultTimeout when nil.
+	Client *http.Client
+}
+
+var _ Provider = (*Telegram)(nil)
+
+type telegramRequest struct {
+	ChatID    string `json:"chat_id"`
+	Text      string `json:"text"`
+	ParseMode string `json:"parse_mode,omitempty"`
+}
+
+type telegramResponse struct {
+	OK          bool   `json:"ok"`
+	Description string `json:"description"`
+	Parameters  struct {
+		RetryAfter int `json:"retry_after"`
+	} `json:"parameters"`
+}
+
+// Validate ...
+func (t *Telegram) Validate(c *pigeon.Chat) error {
+	if c.ChatID == "" {
+		return errors.New("missing telegram chat_id")
+	}
+	if c.BotToken == "" && t.BotToken == "" {
+		return errors.New("missing telegram bot_token")
+	}
+	if utf8.RuneCountInString(c.Text) > TelegramMaxLength {
+		return errors.Errorf("text longer than %d characters", TelegramMaxLength)
+	}
+	return nil
+}
+
+// Send calls the sendMessage method of the bot.
+func (t *Telegram) Send(c *pigeon.Chat) error {
+	token := c.BotToken
+	if token == "" {
+		token = t.BotToken
+	}
+
+	r := telegramRequest{ChatID: c.ChatID, Text: c.Text}
+	switch c.Format {
+	case FormatMarkdown:
+		// the legacy markdown, MarkdownV2 rejects the texts with reserved
+		// characters that are not escaped, such as a period.
+		r.ParseMode = "Markdown"
+	case FormatHTML:
+		r.ParseMode = "HTML"
+	}
+
+	body, err := json.Marshal(r)
+	if err != nil {
+		return err
+	}
+
+	baseURL := t.BaseURL
+	if baseURL == "" {
+		baseURL = TelegramURL
+	}
+
+	client := t.Client
+	if client == nil {
+		client = defaultClient
+	}
+
+	resp, err := client.Post(baseURL+"/bot"+token+"/sendMessage", "application/json", bytes.NewReader(body))
+	if err != nil {
+		// the url holds the bot token, do not leak it in the error.
+		return &pigeon.TemporaryError{Err: errors.New("could not reach telegram")}
+	}
+	defer resp.Body.Close()
+
+	var tr telegramResponse
+	if err := json.NewDecoder(resp.Body).Decode(&tr); err != nil && resp.StatusCode == http.StatusOK {
+		return errors.Wrap(err, "invalid telegram response")
+	}
+
+	if resp.StatusCode != http.StatusOK || !tr.OK {
+		retryAfter := time.Duration(tr.Parameters.RetryAfter) * time.Second
+		return statusError("telegram", resp, tr.Description, retryAfter)
+	}
+
+	return nil
+}
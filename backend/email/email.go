@@ -0,0 +1,241 @@
+/*
+Package email implements a pigeon.Backend that delivers pigeon.Email
+contents through SMTP.
+
+The SMTP server comes from the content when the subject channel defines
+one, otherwise the default server of the Config is used.
+*/
+package email
+
+import (
+	"crypto/tls"
+	"encoding/json"
+	"net"
+	"net/mail"
+	"net/smtp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/iampigeon/pigeon"
+	"github.com/pkg/errors"
+)
+
+const (
+	// StartTLSOpportunistic upgrades the connection when the server
+	// supports it.
+	StartTLSOpportunistic = "opportunistic"
+	// StartTLSRequired fails the delivery when the server does not
+	// support STARTTLS.
+	StartTLSRequired = "required"
+	// StartTLSDisabled never upgrades the connection.
+	StartTLSDisabled = "disabled"
+
+	// DefaultPort is the SMTP submission port.
+	DefaultPort = 587
+	// DefaultTimeout bounds a whole SMTP session.
+	DefaultTimeout = 30 * time.Second
+	// MaxAttachmentsSize is the maximum size of all attachments together.
+	MaxAttachmentsSize = 10 << 20
+)
+
+// Config configures the email backend.
+type Config struct {
+	// SMTP is the default server, used when the content has none.
+	SMTP pigeon.SMTPOptions
+
+	// TLSConfig is used for STARTTLS. When its ServerName is empty the
+	// SMTP host is used.
+	TLSConfig *tls.Config
+
+	// Hostname is sent in the HELO/EHLO command, "localhost" when empty.
+	Hostname string
+
+	// Timeout bounds a whole SMTP session.
+	Timeout time.Duration
+}
+
+// Backend delivers emails through SMTP.
+type Backend struct {
+	config Config
+}
+
+var _ pigeon.Backend = (*Backend)(nil)
+
+// New returns an email backend.
+func New(config Config) *Backend {
+	if config.Timeout == 0 {
+		config.Timeout = DefaultTimeout
+	}
+	return &Backend{config: config}
+}
+
+// Approve validates that content is a deliverable pigeon.Email.
+func (b *Backend) Approve(content []byte) (bool, error) {
+	if _, err := b.decode(content); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// Deliver sends the email encoded in content.
+func (b *Backend) Deliver(content []byte) error {
+	e, err := b.decode(content)
+	if err != nil {
+		return err
+	}
+
+	msg, err := buildMessage(e, time.Now())
+	if err != nil {
+		return err
+	}
+
+	return b.send(e, msg)
+}
+
+func (b *Backend) decode(content []byte) (*pigeon.Email, error) {
+	e := new(pigeon.Email)
+	if err := json.Unmarshal(content, e); err != nil {
+		return nil, errors.Wrap(err, "invalid email content")
+	}
+
+	if _, err := mail.ParseAddress(e.From); err != nil {
+		return nil, errors.Wrap(err, "invalid from address")
+	}
+	if len(e.To) == 0 {
+		return nil, errors.New("missing to addresses")
+	}
+	for _, to := range e.To {
+		if _, err := mail.ParseAddress(to); err != nil {
+			return nil, errors.Wrapf(err, "invalid to address %q", to)
+		}
+	}
+	if strings.TrimSpace(e.Subject) == "" {
+		return nil, errors.New("missing subject")
+	}
+	if strings.ContainsAny(e.Subject+e.FromName, "\r\n") {
+		return nil, errors.New("subject and from name must be a single line")
+	}
+	if e.HTML == "" && e.Text == "" {
+		return nil, errors.New("missing html or text body")
+	}
+
+	var size int
+	for _, a := range e.Attachments {
+		if a == nil || a.Filename == "" {
+			return nil, errors.New("attachment without filename")
+		}
+		if strings.ContainsAny(a.Filename+a.ContentType, "\r\n") {
+			return nil, errors.Errorf("invalid attachment %q", a.Filename)
+		}
+		size += len(a.Content)
+	}
+	if size > MaxAttachmentsSize {
+		return nil, errors.Errorf("attachments exceed %d bytes", MaxAttachmentsSize)
+	}
+
+	opts := b.smtpOptions(e)
+	if opts.Host == "" {
+		return nil, errors.New("missing smtp host")
+	}
+	switch opts.StartTLS {
+	case "", StartTLSOpportunistic, StartTLSRequired, StartTLSDisabled:
+	default:
+		return nil, errors.Errorf("invalid starttls mode %q", opts.StartTLS)
+	}
+
+	return e, nil
+}
+
+// smtpOptions returns the server used to deliver e.
+func (b *Backend) smtpOptions(e *pigeon.Email) pigeon.SMTPOptions {
+	opts := b.config.SMTP
+	if e.SMTP != nil && e.SMTP.Host != "" {
+		opts = *e.SMTP
+	}
+	if opts.Port == 0 {
+		opts.Port = DefaultPort
+	}
+	if opts.StartTLS == "" {
+		opts.StartTLS = StartTLSOpportunistic
+	}
+	return opts
+}
+
+func (b *Backend) send(e *pigeon.Email, msg []byte) error {
+	opts := b.smtpOptions(e)
+	addr := net.JoinHostPort(opts.Host, strconv.Itoa(opts.Port))
+
+	conn, err := net.DialTimeout("tcp", addr, b.config.Timeout)
+	if err != nil {
+		return err
+	}
+	conn.SetDeadline(time.Now().Add(b.config.Timeout))
+
+	c, err := smtp.NewClient(conn, opts.Host)
+	if err != nil {
+		conn.Close()
+		return err
+	}
+	defer c.Close()
+
+	if b.config.Hostname != "" {
+		if err := c.Hello(b.config.Hostname); err != nil {
+			return err
+		}
+	}
+
+	if opts.StartTLS != StartTLSDisabled {
+		if ok, _ := c.Extension("STARTTLS"); ok {
+			if err := c.StartTLS(b.tlsConfig(opts.Host)); err != nil {
+				return errors.Wrap(err, "starttls failed")
+			}
+		} else if opts.StartTLS == StartTLSRequired {
+			return errors.Errorf("%s does not support STARTTLS", addr)
+		}
+	}
+
+	if opts.Username != "" {
+		if ok, _ := c.Extension("AUTH"); !ok {
+			return errors.Errorf("%s does not support AUTH", addr)
+		}
+		if err := c.Auth(smtp.PlainAuth("", opts.Username, opts.Password, opts.Host)); err != nil {
+			return errors.Wrap(err, "smtp auth failed")
+		}
+	}
+
+	from, _ := mail.ParseAddress(e.From)
+	if err := c.Mail(from.Address); err != nil {
+		return err
+	}
+	for _, to := range e.To {
+		rcpt, _ := mail.ParseAddress(to)
+		if err := c.Rcpt(rcpt.Address); err != nil {
+			return err
+		}
+	}
+
+	w, err := c.Data()
+	if err != nil {
+		return err
+	}
+	if _, err := w.Write(msg); err != nil {
+		return err
+	}
+	if err := w.Close(); err != nil {
+		return err
+	}
+
+	return c.Quit()
+}
+
+func (b *Backend) tlsConfig(host string) *tls.Config {
+	config := &tls.Config{}
+	if b.config.TLSConfig != nil {
+		config = b.config.TLSConfig.Clone()
+	}
+	if config.ServerName == "" {
+		config.ServerName = host
+	}
+	return config
+}
@@ -0,0 +1,232 @@
+package email
+
+import (
+	"bufio"
+	"encoding/json"
+	"net"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/iampigeon/pigeon"
+)
+
+// smtpSession is what the SMTP stand-in received in a session.
+type smtpSession struct {
+	from string
+	rcpt []string
+	data string
+}
+
+// smtpServer is an in-process SMTP stand-in serving one session at a time.
+// It offers STARTTLS only when startTLS is set, and then rejects it.
+type smtpServer struct {
+	ln       net.Listener
+	startTLS bool
+	sessions chan smtpSession
+}
+
+func newSMTPServer(t *testing.T, startTLS bool) *smtpServer {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s := &smtpServer{
+		ln:       ln,
+		startTLS: startTLS,
+		sessions: make(chan smtpSession, 1),
+	}
+	go s.serve()
+	return s
+}
+
+func (s *smtpServer) options() *pigeon.SMTPOptions {
+	addr := s.ln.Addr().(*net.TCPAddr)
+	return &pigeon.SMTPOptions{Host: addr.IP.String(), Port: addr.Port}
+}
+
+func (s *smtpServer) serve() {
+	for {
+		conn, err := s.ln.Accept()
+		if err != nil {
+			return
+		}
+		s.handle(conn)
+	}
+}
+
+func (s *smtpServer) handle(conn net.Conn) {
+	defer conn.Close()
+
+	r := bufio.NewReader(conn)
+	reply := func(line string) {
+		conn.Write([]byte(line + "\r\n"))
+	}
+
+	var session smtpSession
+	reply("220 stand-in ready")
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return
+		}
+		line = strings.TrimRight(line, "\r\n")
+		cmd := strings.ToUpper(strings.SplitN(line, " ", 2)[0])
+
+		switch cmd {
+		case "EHLO", "HELO":
+			if s.startTLS {
+				reply("250-stand-in")
+				reply("250 STARTTLS")
+			} else {
+				reply("250 stand-in")
+			}
+		case "STARTTLS":
+			reply("454 TLS not available")
+		case "MAIL":
+			session.from = strings.TrimPrefix(line, "MAIL FROM:")
+			reply("250 ok")
+		case "RCPT":
+			session.rcpt = append(session.rcpt, strings.TrimPrefix(line, "RCPT TO:"))
+			reply("250 ok")
+		case "DATA":
+			reply("354 go ahead")
+			var data strings.Builder
+			for {
+				l, err := r.ReadString('\n')
+				if err != nil {
+					return
+				}
+				if l == ".\r\n" {
+					break
+				}
+				data.WriteString(l)
+			}
+			session.data = data.String()
+			reply("250 queued")
+		case "QUIT":
+			reply("221 bye")
+			s.sessions <- session
+			return
+		default:
+			reply("502 not implemented")
+		}
+	}
+}
+
+func content(t *testing.T, e *pigeon.Email) []byte {
+	b, err := json.Marshal(e)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+func TestDeliver(t *testing.T) {
+	s := newSMTPServer(t, false)
+	defer s.ln.Close()
+
+	b := New(Config{})
+	err := b.Deliver(content(t, &pigeon.Email{
+		From:    "pigeon@example.com",
+		To:      []string{"Ada <ada@example.com>", "bob@example.com"},
+		Subject: "Your order shipped",
+		Text:    "It is on its way.",
+		SMTP:    s.options(),
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	session := <-s.sessions
+	if session.from != "<pigeon@example.com>" {
+		t.Errorf("from = %q", session.from)
+	}
+	if strings.Join(session.rcpt, ",") != "<ada@example.com>,<bob@example.com>" {
+		t.Errorf("rcpt = %q", session.rcpt)
+	}
+	if !strings.Contains(session.data, "Subject: Your order shipped") {
+		t.Errorf("data without subject:\n%s", session.data)
+	}
+	if !strings.Contains(session.data, "It is on its way.") {
+		t.Errorf("data without body:\n%s", session.data)
+	}
+}
+
+func TestDeliverDefaultServer(t *testing.T) {
+	s := newSMTPServer(t, false)
+	defer s.ln.Close()
+
+	b := New(Config{SMTP: *s.options()})
+	err := b.Deliver(content(t, &pigeon.Email{
+		From:    "pigeon@example.com",
+		To:      []string{"ada@example.com"},
+		Subject: "Hi",
+		HTML:    "<p>Hi</p>",
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if session := <-s.sessions; len(session.rcpt) != 1 {
+		t.Errorf("rcpt = %q", session.rcpt)
+	}
+}
+
+func TestDeliverStartTLS(t *testing.T) {
+	tests := []struct {
+		mode     string
+		offered  bool
+		wantFail bool
+	}{
+		{StartTLSOpportunistic, false, false},
+		{StartTLSDisabled, true, false},
+		{StartTLSRequired, false, true},
+		{StartTLSRequired, true, true},
+	}
+
+	for _, tt := range tests {
+		s := newSMTPServer(t, tt.offered)
+
+		opts := s.options()
+		opts.StartTLS = tt.mode
+		err := New(Config{}).Deliver(content(t, &pigeon.Email{
+			From:    "pigeon@example.com",
+			To:      []string{"ada@example.com"},
+			Subject: "Hi",
+			Text:    "Hi",
+			SMTP:    opts,
+		}))
+		if (err != nil) != tt.wantFail {
+			t.Errorf("%s with STARTTLS offered %s: error %v", tt.mode, strconv.FormatBool(tt.offered), err)
+		}
+
+		s.ln.Close()
+	}
+}
+
+func TestApprove(t *testing.T) {
+	b := New(Config{SMTP: pigeon.SMTPOptions{Host: "smtp.example.com"}})
+
+	tests := []struct {
+		name  string
+		email pigeon.Email
+	}{
+		{"invalid from", pigeon.Email{From: "nope", To: []string{"a@example.com"}, Subject: "s", Text: "t"}},
+		{"missing to", pigeon.Email{From: "p@example.com", Subject: "s", Text: "t"}},
+		{"missing subject", pigeon.Email{From: "p@example.com", To: []string{"a@example.com"}, Text: "t"}},
+		{"header injection", pigeon.Email{From: "p@example.com", To: []string{"a@example.com"}, Subject: "s\r\nBcc: x@example.com", Text: "t"}},
+		{"missing body", pigeon.Email{From: "p@example.com", To: []string{"a@example.com"}, Subject: "s"}},
+	}
+	for _, tt := range tests {
+		if ok, err := b.Approve(content(t, &tt.email)); ok || err == nil {
+			t.Errorf("%s approved", tt.name)
+		}
+	}
+
+	ok, err := b.Approve(content(t, &pigeon.Email{From: "p@example.com", To: []string{"a@example.com"}, Subject: "s", Text: "t"}))
+	if !ok || err != nil {
+		t.Errorf("valid email not approved, %v", err)
+	}
+}
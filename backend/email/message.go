@@ -0,0 +1,193 @@
+package email
+
+import (
+	"bytes"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"math/rand"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net/mail"
+	"net/textproto"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/iampigeon/pigeon"
+)
+
+// partWriter creates a MIME part with the given header and returns the
+// writer of its body.
+type partWriter func(textproto.MIMEHeader) (io.Writer, error)
+
+// buildMessage encodes e as an RFC 5322 message.
+func buildMessage(e *pigeon.Email, date time.Time) ([]byte, error) {
+	from, err := mail.ParseAddress(e.From)
+	if err != nil {
+		return nil, err
+	}
+	if e.FromName != "" {
+		from.Name = e.FromName
+	}
+
+	to := make([]string, 0, len(e.To))
+	for _, addr := range e.To {
+		a, err := mail.ParseAddress(addr)
+		if err != nil {
+			return nil, err
+		}
+		to = append(to, a.String())
+	}
+
+	var buf bytes.Buffer
+	writeHeader(&buf, "From", from.String())
+	writeHeader(&buf, "To", strings.Join(to, ", "))
+	writeHeader(&buf, "Subject", mime.QEncoding.Encode("utf-8", e.Subject))
+	writeHeader(&buf, "Date", date.Format(time.RFC1123Z))
+	writeHeader(&buf, "Message-ID", messageID(from.Address, date))
+	writeHeader(&buf, "MIME-Version", "1.0")
+
+	top := func(h textproto.MIMEHeader) (io.Writer, error) {
+		keys := make([]string, 0, len(h))
+		for k := range h {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			writeHeader(&buf, k, h.Get(k))
+		}
+		buf.WriteString("\r\n")
+		return &buf, nil
+	}
+
+	if err := writeBody(top, e); err != nil {
+		return nil, err
+	}
+
+	return buf.Bytes(), nil
+}
+
+// writeBody writes the text and html bodies of e followed by its
+// attachments.
+func writeBody(create partWriter, e *pigeon.Email) error {
+	if len(e.Attachments) == 0 {
+		return writeAlternative(create, e)
+	}
+
+	var body bytes.Buffer
+	mw := multipart.NewWriter(&body)
+
+	if err := writeAlternative(mw.CreatePart, e); err != nil {
+		return err
+	}
+
+	for _, a := range e.Attachments {
+		contentType := a.ContentType
+		if contentType == "" {
+			contentType = mime.TypeByExtension(filepath.Ext(a.Filename))
+		}
+		if contentType == "" {
+			contentType = "application/octet-stream"
+		}
+
+		h := make(textproto.MIMEHeader)
+		h.Set("Content-Type", contentType)
+		h.Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": a.Filename}))
+		h.Set("Content-Transfer-Encoding", "base64")
+
+		w, err := mw.CreatePart(h)
+		if err != nil {
+			return err
+		}
+		if err := writeBase64(w, a.Content); err != nil {
+			return err
+		}
+	}
+
+	if err := mw.Close(); err != nil {
+		return err
+	}
+
+	return writeMultipart(create, "multipart/mixed", mw.Boundary(), body.Bytes())
+}
+
+// writeAlternative writes the bodies of e, as multipart/alternative when it
+// has both text and html.
+func writeAlternative(create partWriter, e *pigeon.Email) error {
+	switch {
+	case e.Text != "" && e.HTML != "":
+		var body bytes.Buffer
+		mw := multipart.NewWriter(&body)
+		if err := writeText(mw.CreatePart, "text/plain", e.Text); err != nil {
+			return err
+		}
+		if err := writeText(mw.CreatePart, "text/html", e.HTML); err != nil {
+			return err
+		}
+		if err := mw.Close(); err != nil {
+			return err
+		}
+		return writeMultipart(create, "multipart/alternative", mw.Boundary(), body.Bytes())
+	case e.HTML != "":
+		return writeText(create, "text/html", e.HTML)
+	default:
+		return writeText(create, "text/plain", e.Text)
+	}
+}
+
+func writeText(create partWriter, mediaType, text string) error {
+	h := make(textproto.MIMEHeader)
+	h.Set("Content-Type", mediaType+"; charset=utf-8")
+	h.Set("Content-Transfer-Encoding", "quoted-printable")
+
+	w, err := create(h)
+	if err != nil {
+		return err
+	}
+
+	qp := quotedprintable.NewWriter(w)
+	if _, err := io.WriteString(qp, text); err != nil {
+		return err
+	}
+	return qp.Close()
+}
+
+func writeMultipart(create partWriter, mediaType, boundary string, body []byte) error {
+	h := make(textproto.MIMEHeader)
+	h.Set("Content-Type", mime.FormatMediaType(mediaType, map[string]string{"boundary": boundary}))
+
+	w, err := create(h)
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(body)
+	return err
+}
+
+// writeBase64 writes data base64 encoded in lines of 76 characters.
+func writeBase64(w io.Writer, data []byte) error {
+	encoded := base64.StdEncoding.EncodeToString(data)
+	for len(encoded) > 76 {
+		if _, err := io.WriteString(w, encoded[:76]+"\r\n"); err != nil {
+			return err
+		}
+		encoded = encoded[76:]
+	}
+	_, err := io.WriteString(w, encoded+"\r\n")
+	return err
+}
+
+func writeHeader(buf *bytes.Buffer, key, value string) {
+	fmt.Fprintf(buf, "%s: %s\r\n", key, value)
+}
+
+func messageID(from string, date time.Time) string {
+	domain := "localhost"
+	if i := strings.LastIndex(from, "@"); i >= 0 {
+		domain = from[i+1:]
+	}
+	return fmt.Sprintf("<%d.%d@%s>", date.UnixNano(), rand.Int63(), domain)
+}
@@ -0,0 +1,83 @@
+package backend
+
+import (
+	"errors"
+	"sync"
+
+	"github.com/iampigeon/pigeon"
+)
+
+var _ pigeon.DeliveryBackend = (*Fake)(nil)
+
+// Delivery is a message delivered to a Fake backend.
+type Delivery struct {
+	DeliveryID string
+	MessageID  string
+	Content    []byte
+}
+
+// Fake is a backend recording its deliveries instead of sending them, used
+// to run a scheduler without real channels. Served with Serve it receives
+// the deliveries of the scheduler like any backend.
+type Fake struct {
+	// Err returns the error of the delivery d, such as a
+	// *pigeon.TemporaryError to have it retried. Every delivery succeeds
+	// when nil.
+	Err func(d Delivery) error
+
+	// Delivered receives each successful delivery when not nil, it must be
+	// drained.
+	Delivered chan Delivery
+
+	mu         sync.Mutex
+	deliveries []Delivery
+}
+
+// Approve approves any content but nil.
+func (f *Fake) Approve(content []byte) (bool, error) {
+	if content == nil {
+		return false, errors.New("Invalid message content")
+	}
+	return true, nil
+}
+
+// Deliver records a delivery without ids.
+func (f *Fake) Deliver(content []byte) error {
+	return f.deliver(Delivery{Content: content})
+}
+
+// DeliverMessage records a delivery of the message id.
+func (f *Fake) DeliverMessage(id string, content []byte) error {
+	return f.deliver(Delivery{MessageID: id, Content: content})
+}
+
+// DeliverOnce records a delivery of the message id, repeated delivery ids
+// are recorded too so tests can check them.
+func (f *Fake) DeliverOnce(deliveryID, id string, content []byte) error {
+	return f.deliver(Delivery{DeliveryID: deliveryID, MessageID: id, Content: content})
+}
+
+// Deliveries returns the successful deliveries in the order they were made.
+func (f *Fake) Deliveries() []Delivery {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	return append([]Delivery(nil), f.deliveries...)
+}
+
+func (f *Fake) deliver(d Delivery) error {
+	if f.Err != nil {
+		if err := f.Err(d); err != nil {
+			return err
+		}
+	}
+
+	f.mu.Lock()
+	f.deliveries = append(f.deliveries, d)
+	f.mu.Unlock()
+
+	if f.Delivered != nil {
+		f.Delivered <- d
+	}
+	return nil
+}
@@ -0,0 +1,57 @@
+package backend
+
+import (
+	"flag"
+	"fmt"
+
+	"github.com/iampigeon/pigeon"
+	"github.com/iampigeon/pigeon/tlsutil"
+)
+
+// ConfigFromFlags defines on fs the flags shared by the backend commands,
+// listening on port by default. With a single channel a -channel flag
+// defaults to it, with more the backend registers all of them. The returned
+// function builds the Config once fs is parsed.
+func ConfigFromFlags(fs *flag.FlagSet, port int, channels ...string) func() (Config, error) {
+	host := fs.String("host", "", "host of the service")
+	p := fs.Int("port", port, "port of the service")
+	tlsCert := fs.String("tls_cert", "", "PEM certificate of the service, enables TLS")
+	tlsKey := fs.String("tls_key", "", "PEM private key of the service certificate")
+	tlsCA := fs.String("tls_ca", "", "PEM bundle to verify the scheduler, enables mutual TLS")
+	scheduler := fs.String("scheduler", "", "scheduler address to register the backend in")
+	advertise := fs.String("advertise_addr", "", "address registered in the scheduler, it must be reachable from it, -host and -port when empty")
+
+	var channel *string
+	if len(channels) <= 1 {
+		channel = fs.String("channel", append(channels, "")[0], "channel name registered in the scheduler")
+	}
+
+	return func() (Config, error) {
+		config := Config{
+			Addr:          pigeon.NetAddr(fmt.Sprintf("%s:%d", *host, *p)),
+			SchedulerAddr: pigeon.NetAddr(*scheduler),
+			AdvertiseAddr: pigeon.NetAddr(*advertise),
+		}
+		if channel != nil {
+			config.Channel = *channel
+		} else {
+			config.Channels = channels
+		}
+
+		if *tlsCert != "" {
+			creds, err := tlsutil.Load(tlsutil.Config{
+				CertFile:   *tlsCert,
+				KeyFile:    *tlsKey,
+				CAFile:     *tlsCA,
+				ClientAuth: *tlsCA != "",
+			})
+			if err != nil {
+				return Config{}, err
+			}
+			config.TLS = creds
+			config.SchedulerTLS = creds
+		}
+
+		return config, nil
+	}
+}
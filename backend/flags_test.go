@@ -0,0 +1,56 @@
+package backend
+
+import (
+	"flag"
+	"reflect"
+	"testing"
+
+	"github.com/iampigeon/pigeon"
+)
+
+func TestConfigFromFlags(t *testing.T) {
+	fs := flag.NewFlagSet("sms", flag.ContinueOnError)
+	load := ConfigFromFlags(fs, 9040, pigeon.ServicePigeonSMS)
+	if err := fs.Parse([]string{"-host", "10.0.0.7", "-scheduler", "scheduler:9001", "-advertise_addr", "sms-1.internal:9040"}); err != nil {
+		t.Fatal(err)
+	}
+
+	config, err := load()
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := Config{Addr: "10.0.0.7:9040", Channel: pigeon.ServicePigeonSMS, SchedulerAddr: "scheduler:9001", AdvertiseAddr: "sms-1.internal:9040"}
+	if !reflect.DeepEqual(config, want) {
+		t.Errorf("config %+v, want %+v", config, want)
+	}
+}
+
+func TestConfigFromFlagsChannels(t *testing.T) {
+	fs := flag.NewFlagSet("chat", flag.ContinueOnError)
+	load := ConfigFromFlags(fs, 9060, pigeon.ServicePigeonTelegram, pigeon.ServicePigeonSlack)
+	if fs.Lookup("channel") != nil {
+		t.Error("-channel defined for a backend of several channels")
+	}
+	if err := fs.Parse(nil); err != nil {
+		t.Fatal(err)
+	}
+
+	config, err := load()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{pigeon.ServicePigeonTelegram, pigeon.ServicePigeonSlack}; !reflect.DeepEqual(config.Channels, want) {
+		t.Errorf("channels %v, want %v", config.Channels, want)
+	}
+}
+
+func TestConfigFromFlagsTLS(t *testing.T) {
+	fs := flag.NewFlagSet("email", flag.ContinueOnError)
+	load := ConfigFromFlags(fs, 9030, pigeon.ServicePigeonEmail)
+	if err := fs.Parse([]string{"-tls_cert", "missing.pem", "-tls_key", "missing.key"}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := load(); err == nil {
+		t.Error("loaded missing TLS credentials")
+	}
+}
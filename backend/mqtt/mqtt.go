@@ -0,0 +1,237 @@
+/*
+Package mqtt implements a pigeon.Backend that publishes pigeon.MQTT contents
+to an MQTT broker.
+
+Clients are kept open and reused for each broker, client ID and
+credentials.
+They connect without clean session so the broker keeps their session, and
+QoS 1 and 2 messages in flight, across reconnections.
+*/
+package mqtt
+
+import (
+	"encoding/json"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	paho "github.com/eclipse/paho.mqtt.golang"
+	"github.com/iampigeon/pigeon"
+	"github.com/pkg/errors"
+)
+
+const (
+	// DefaultTimeout bounds connecting and publishing.
+	DefaultTimeout = 10 * time.Second
+
+	// maxTopicLength is the maximum length in bytes of an MQTT topic.
+	maxTopicLength = 65535
+)
+
+// Config configures the MQTT backend.
+type Config struct {
+	// Broker is the default broker URL, used when the content has none.
+	Broker   string
+	Username string
+	Password string
+
+	// ClientID is the default client ID, "pigeon-<hostname>" when empty.
+	ClientID string
+
+	// Timeout bounds connecting and publishing.
+	Timeout time.Duration
+}
+
+// Backend publishes messages to MQTT brokers.
+type Backend struct {
+	config Config
+
+	mu      sync.Mutex
+	clients map[clientKey]*client
+}
+
+type clientKey struct {
+	broker, clientID, username, password string
+}
+
+// client is the connection of a clientKey. Its mutex is held while
+// connecting, so only the deliveries to the same broker wait for it.
+type client struct {
+	mu sync.Mutex
+	c  paho.Client
+}
+
+var _ pigeon.Backend = (*Backend)(nil)
+
+// New returns an MQTT backend.
+func New(config Config) *Backend {
+	if config.Timeout == 0 {
+		config.Timeout = DefaultTimeout
+	}
+	if config.ClientID == "" {
+		hostname, _ := os.Hostname()
+		config.ClientID = "pigeon-" + hostname
+	}
+
+	return &Backend{
+		config:  config,
+		clients: make(map[clientKey]*client),
+	}
+}
+
+// Approve validates that content is a publishable pigeon.MQTT.
+func (b *Backend) Approve(content []byte) (bool, error) {
+	if _, err := b.decode(content); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// Deliver publishes the message encoded in content.
+func (b *Backend) Deliver(content []byte) error {
+	m, err := b.decode(content)
+	if err != nil {
+		return err
+	}
+
+	payload, err := json.Marshal(m.Payload)
+	if err != nil {
+		return err
+	}
+
+	c, err := b.client(m)
+	if err != nil {
+		return err
+	}
+
+	token := c.Publish(m.Topic, m.QoS, m.Retain, payload)
+	if !token.WaitTimeout(b.config.Timeout) {
+		return errors.Errorf("publish to %s timed out", m.Topic)
+	}
+	return token.Error()
+}
+
+// Close disconnects every client.
+func (b *Backend) Close() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	for k, cl := range b.clients {
+		cl.mu.Lock()
+		if cl.c != nil {
+			cl.c.Disconnect(250)
+			cl.c = nil
+		}
+		cl.mu.Unlock()
+		delete(b.clients, k)
+	}
+}
+
+// decode validates content and fills the defaults of the backend.
+func (b *Backend) decode(content []byte) (*pigeon.MQTT, error) {
+	m := new(pigeon.MQTT)
+	if err := json.Unmarshal(content, m); err != nil {
+		return nil, errors.Wrap(err, "invalid mqtt content")
+	}
+
+	if err := validateTopic(m.Topic); err != nil {
+		return nil, err
+	}
+	if m.QoS > 2 {
+		return nil, errors.Errorf("invalid qos %d", m.QoS)
+	}
+
+	if m.Broker == "" {
+		m.Broker = b.config.Broker
+		if m.Username == "" {
+			m.Username = b.config.Username
+			m.Password = b.config.Password
+		}
+	}
+	if m.ClientID == "" {
+		m.ClientID = b.config.ClientID
+	}
+
+	if m.Broker == "" {
+		return nil, errors.New("missing mqtt broker")
+	}
+	u, err := url.Parse(m.Broker)
+	if err != nil {
+		return nil, errors.Wrap(err, "invalid mqtt broker")
+	}
+	switch u.Scheme {
+	case "tcp", "ssl", "tls", "ws", "wss":
+	default:
+		return nil, errors.Errorf("invalid mqtt broker scheme %q", u.Scheme)
+	}
+	if u.Host == "" {
+		return nil, errors.New("missing mqtt broker host")
+	}
+
+	return m, nil
+}
+
+// validateTopic checks that topic is a valid topic name to publish to.
+func validateTopic(topic string) error {
+	switch {
+	case topic == "":
+		return errors.New("missing mqtt topic")
+	case len(topic) > maxTopicLength:
+		return errors.Errorf("mqtt topic exceeds %d bytes", maxTopicLength)
+	case !utf8.ValidString(topic):
+		return errors.New("mqtt topic must be valid utf-8")
+	case strings.ContainsAny(topic, "+#"):
+		return errors.Errorf("mqtt topic %q must not contain wildcards", topic)
+	case strings.ContainsRune(topic, 0):
+		return errors.New("mqtt topic must not contain null characters")
+	}
+	return nil
+}
+
+// client returns the connected client for the broker of m.
+func (b *Backend) client(m *pigeon.MQTT) (paho.Client, error) {
+	key := clientKey{m.Broker, m.ClientID, m.Username, m.Password}
+
+	b.mu.Lock()
+	cl, ok := b.clients[key]
+	if !ok {
+		cl = new(client)
+		b.clients[key] = cl
+	}
+	b.mu.Unlock()
+
+	cl.mu.Lock()
+	defer cl.mu.Unlock()
+
+	if cl.c != nil {
+		if cl.c.IsConnected() {
+			return cl.c, nil
+		}
+		cl.c.Disconnect(0)
+		cl.c = nil
+	}
+
+	opts := paho.NewClientOptions().
+		AddBroker(m.Broker).
+		SetClientID(m.ClientID).
+		SetUsername(m.Username).
+		SetPassword(m.Password).
+		SetCleanSession(false).
+		SetAutoReconnect(true).
+		SetConnectTimeout(b.config.Timeout)
+
+	c := paho.NewClient(opts)
+	token := c.Connect()
+	if !token.WaitTimeout(b.config.Timeout) {
+		return nil, errors.Errorf("connect to %s timed out", m.Broker)
+	}
+	if err := token.Error(); err != nil {
+		return nil, errors.Wrapf(err, "could not connect to %s", m.Broker)
+	}
+
+	cl.c = c
+	return c, nil
+}
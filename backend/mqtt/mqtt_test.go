@@ -0,0 +1,240 @@
+package mqtt
+
+import (
+	"encoding/json"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/eclipse/paho.mqtt.golang/packets"
+	"github.com/iampigeon/pigeon"
+)
+
+// publication is a message published to the test broker.
+type publication struct {
+	topic   string
+	payload string
+	qos     byte
+	retain  bool
+}
+
+// broker is an embedded MQTT broker accepting publications. It refuses the
+// clients whose password does not match when password is set.
+type broker struct {
+	ln       net.Listener
+	password string
+
+	mu       sync.Mutex
+	connects int
+	received chan publication
+}
+
+func newBroker(t *testing.T, password string) *broker {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	b := &broker{
+		ln:       ln,
+		password: password,
+		received: make(chan publication, 10),
+	}
+	go b.serve()
+	return b
+}
+
+func (b *broker) url() string {
+	return "tcp://" + b.ln.Addr().String()
+}
+
+func (b *broker) serve() {
+	for {
+		conn, err := b.ln.Accept()
+		if err != nil {
+			return
+		}
+		go b.handle(conn)
+	}
+}
+
+func (b *broker) handle(conn net.Conn) {
+	defer conn.Close()
+
+	for {
+		cp, err := packets.ReadPacket(conn)
+		if err != nil {
+			return
+		}
+
+		switch p := cp.(type) {
+		case *packets.ConnectPacket:
+			ack := packets.NewControlPacket(packets.Connack).(*packets.ConnackPacket)
+			ack.ReturnCode = p.Validate()
+			if ack.ReturnCode == packets.Accepted && b.password != "" && string(p.Password) != b.password {
+				ack.ReturnCode = packets.ErrRefusedBadUsernameOrPassword
+			}
+			if err := ack.Write(conn); err != nil || ack.ReturnCode != packets.Accepted {
+				return
+			}
+
+			b.mu.Lock()
+			b.connects++
+			b.mu.Unlock()
+		case *packets.PublishPacket:
+			b.received <- publication{p.TopicName, string(p.Payload), p.Qos, p.Retain}
+
+			switch p.Qos {
+			case 1:
+				ack := packets.NewControlPacket(packets.Puback).(*packets.PubackPacket)
+				ack.MessageID = p.MessageID
+				ack.Write(conn)
+			case 2:
+				rec := packets.NewControlPacket(packets.Pubrec).(*packets.PubrecPacket)
+				rec.MessageID = p.MessageID
+				rec.Write(conn)
+			}
+		case *packets.PubrelPacket:
+			comp := packets.NewControlPacket(packets.Pubcomp).(*packets.PubcompPacket)
+			comp.MessageID = p.MessageID
+			comp.Write(conn)
+		case *packets.PingreqPacket:
+			packets.NewControlPacket(packets.Pingresp).Write(conn)
+		case *packets.DisconnectPacket:
+			return
+		}
+	}
+}
+
+func (b *broker) connections() int {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	return b.connects
+}
+
+func content(t *testing.T, m pigeon.MQTT) []byte {
+	b, err := json.Marshal(m)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+func TestDeliver(t *testing.T) {
+	br := newBroker(t, "")
+	defer br.ln.Close()
+
+	b := New(Config{Broker: br.url(), Timeout: 2 * time.Second})
+	defer b.Close()
+
+	for qos := byte(0); qos <= 2; qos++ {
+		err := b.Deliver(content(t, pigeon.MQTT{
+			Topic:   "devices/42/alerts",
+			Payload: map[string]interface{}{"level": "high"},
+			QoS:     qos,
+			Retain:  qos == 1,
+		}))
+		if err != nil {
+			t.Fatalf("qos %d: %v", qos, err)
+		}
+
+		p := <-br.received
+		if p.topic != "devices/42/alerts" || p.payload != `{"level":"high"}` {
+			t.Errorf("qos %d: published %+v", qos, p)
+		}
+		if p.qos != qos || p.retain != (qos == 1) {
+			t.Errorf("qos %d: published with qos %d retain %v", qos, p.qos, p.retain)
+		}
+	}
+
+	if n := br.connections(); n != 1 {
+		t.Errorf("%d connections, want the client reused", n)
+	}
+}
+
+func TestDeliverCredentials(t *testing.T) {
+	br := newBroker(t, "right")
+	defer br.ln.Close()
+
+	b := New(Config{Timeout: 2 * time.Second})
+	defer b.Close()
+
+	m := pigeon.MQTT{Topic: "t", Broker: br.url(), Username: "pigeon", Password: "right"}
+	if err := b.Deliver(content(t, m)); err != nil {
+		t.Fatal(err)
+	}
+	<-br.received
+
+	// a different password must not reuse the connected client.
+	m.Password = "wrong"
+	if err := b.Deliver(content(t, m)); err == nil {
+		t.Fatal("delivered with a wrong password")
+	}
+}
+
+func TestDeliverSlowBroker(t *testing.T) {
+	// the slow broker accepts connections and never answers them.
+	slow, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer slow.Close()
+	go func() {
+		for {
+			conn, err := slow.Accept()
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+		}
+	}()
+
+	br := newBroker(t, "")
+	defer br.ln.Close()
+
+	b := New(Config{Timeout: 2 * time.Second})
+	defer b.Close()
+
+	done := make(chan error, 1)
+	go func() {
+		done <- b.Deliver(content(t, pigeon.MQTT{Topic: "t", Broker: "tcp://" + slow.Addr().String()}))
+	}()
+	time.Sleep(100 * time.Millisecond)
+
+	start := time.Now()
+	if err := b.Deliver(content(t, pigeon.MQTT{Topic: "t", Broker: br.url()})); err != nil {
+		t.Fatal(err)
+	}
+	if d := time.Since(start); d > time.Second {
+		t.Errorf("delivery waited %s for the connection to another broker", d)
+	}
+
+	if err := <-done; err == nil {
+		t.Error("delivered to a broker that never answered")
+	}
+}
+
+func TestApprove(t *testing.T) {
+	b := New(Config{Broker: "tcp://localhost:1883"})
+
+	tests := []struct {
+		name string
+		m    pigeon.MQTT
+	}{
+		{"missing topic", pigeon.MQTT{}},
+		{"wildcard topic", pigeon.MQTT{Topic: "devices/+/alerts"}},
+		{"qos", pigeon.MQTT{Topic: "t", QoS: 3}},
+		{"broker scheme", pigeon.MQTT{Topic: "t", Broker: "http://localhost"}},
+	}
+	for _, tt := range tests {
+		if ok, err := b.Approve(content(t, tt.m)); ok || err == nil {
+			t.Errorf("%s approved", tt.name)
+		}
+	}
+
+	if ok, err := New(Config{}).Approve(content(t, pigeon.MQTT{Topic: "t"})); ok || err == nil {
+		t.Error("approved without a broker")
+	}
+}
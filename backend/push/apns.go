@@ -0,0 +1,156 @@
+package push
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+
+	"github.com/iampigeon/pigeon"
+	"github.com/pkg/errors"
+)
+
+// APNsURL is the base URL of the APNs production environment.
+const APNsURL = "https://api.push.apple.com"
+
+// apnsConcurrency is the number of requests sent at the same time.
+const apnsConcurrency = 16
+
+// apnsInvalid are the rejection reasons of tokens that must be pruned.
+var apnsInvalid = map[string]bool{
+	"BadDeviceToken":         true,
+	"Unregistered":           true,
+	"DeviceTokenNotForTopic": true,
+}
+
+// APNs is a Provider for the APNs HTTP/2 API.
+type APNs struct {
+	// Topic is the bundle ID of the app.
+	Topic string
+
+	// AuthToken is the provider token sent as bearer authorization. It can
+	// be empty when Client authenticates with a certificate.
+	AuthToken string
+
+	// BaseURL is the API base URL, APNsURL when empty.
+	BaseURL string
+
+	// Client sends the requests, a client with DefaultTimeout when nil.
+	Client *http.Client
+}
+
+var _ Provider = (*APNs)(nil)
+
+type apnsPayload map[string]interface{}
+
+// Send delivers n to each token concurrently. A notification without title
+// and body is sent as a background push carrying only its data.
+func (a *APNs) Send(tokens []string, n *pigeon.Push) ([]string, error) {
+	payload := apnsPayload{}
+	for k, v := range n.Data {
+		payload[k] = v
+	}
+
+	background := n.Title == "" && n.Body == ""
+	if background {
+		payload["aps"] = map[string]interface{}{"content-available": 1}
+	} else {
+		alert := map[string]string{}
+		if n.Title != "" {
+			alert["title"] = n.Title
+		}
+		if n.Body != "" {
+			alert["body"] = n.Body
+		}
+		payload["aps"] = map[string]interface{}{"alert": alert}
+	}
+
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return nil, err
+	}
+
+	var (
+		mu      sync.Mutex
+		invalid []string
+		failed  failures
+		wg      sync.WaitGroup
+	)
+
+	sem := make(chan struct{}, apnsConcurrency)
+	for _, t := range tokens {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(token string) {
+			defer wg.Done()
+			defer func() { <-sem }()
+
+			bad, err := a.send(token, body, background)
+
+			mu.Lock()
+			defer mu.Unlock()
+			switch {
+			case bad:
+				invalid = append(invalid, token)
+			case err != nil:
+				failed.add(err, token)
+			}
+		}(t)
+	}
+	wg.Wait()
+
+	return invalid, failed.err()
+}
+
+// send delivers body to token. It reports whether the token is invalid.
+func (a *APNs) send(token string, body []byte, background bool) (bool, error) {
+	base := a.BaseURL
+	if base == "" {
+		base = APNsURL
+	}
+	client := a.Client
+	if client == nil {
+		client = defaultClient
+	}
+
+	req, err := http.NewRequest(http.MethodPost, strings.TrimRight(base, "/")+"/3/device/"+url.PathEscape(token), bytes.NewReader(body))
+	if err != nil {
+		return false, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if a.Topic != "" {
+		req.Header.Set("apns-topic", a.Topic)
+	}
+	if a.AuthToken != "" {
+		req.Header.Set("Authorization", "bearer "+a.AuthToken)
+	}
+	if background {
+		// background pushes must be sent with low priority.
+		req.Header.Set("apns-push-type", "background")
+		req.Header.Set("apns-priority", "5")
+	} else {
+		req.Header.Set("apns-push-type", "alert")
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return false, &pigeon.TemporaryError{Err: err}
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusOK {
+		return false, nil
+	}
+
+	var r struct {
+		Reason string `json:"reason"`
+	}
+	json.NewDecoder(resp.Body).Decode(&r)
+
+	if resp.StatusCode == http.StatusGone || apnsInvalid[r.Reason] {
+		return true, nil
+	}
+	return false, temporary(errors.Errorf("apns: %s %s", resp.Status, r.Reason), resp)
+}
@@ -0,0 +1,149 @@
+package push
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"strings"
+
+	"github.com/iampigeon/pigeon"
+	"github.com/pkg/errors"
+)
+
+// FCMURL is the base URL of the FCM legacy HTTP API.
+const FCMURL = "https://fcm.googleapis.com"
+
+// fcmBatch is the maximum number of registration IDs of a request.
+const fcmBatch = 1000
+
+// fcmInvalid are the result errors of tokens that must be pruned.
+var fcmInvalid = map[string]bool{
+	"InvalidRegistration": true,
+	"NotRegistered":       true,
+	"MismatchSenderId":    true,
+}
+
+// fcmTemporary are the result errors of tokens that can be retried.
+var fcmTemporary = map[string]bool{
+	"Unavailable":               true,
+	"InternalServerError":       true,
+	"DeviceMessageRateExceeded": true,
+	"TopicsMessageRateExceeded": true,
+}
+
+// FCM is a Provider for the FCM legacy HTTP API.
+type FCM struct {
+	ServerKey string
+
+	// BaseURL is the API base URL, FCMURL when empty.
+	BaseURL string
+
+	// Client sends the requests, a client with DefaultTimeout when nil.
+	Client *http.Client
+}
+
+var _ Provider = (*FCM)(nil)
+
+type fcmRequest struct {
+	RegistrationIDs []string               `json:"registration_ids"`
+	Notification    *fcmNotification       `json:"notification,omitempty"`
+	Data            map[string]interface{} `json:"data,omitempty"`
+}
+
+type fcmNotification struct {
+	Title string `json:"title,omitempty"`
+	Body  string `json:"body,omitempty"`
+}
+
+type fcmResponse struct {
+	Success int `json:"success"`
+	Failure int `json:"failure"`
+	Results []struct {
+		MessageID string `json:"message_id"`
+		Error     string `json:"error"`
+	} `json:"results"`
+}
+
+// Send delivers n to tokens in batches.
+func (f *FCM) Send(tokens []string, n *pigeon.Push) ([]string, error) {
+	var invalid []string
+	var failed failures
+	for len(tokens) > 0 {
+		batch := tokens
+		if len(batch) > fcmBatch {
+			batch = batch[:fcmBatch]
+		}
+		tokens = tokens[len(batch):]
+
+		inv, err := f.send(batch, n, &failed)
+		if err != nil {
+			failed.add(err, batch...)
+		}
+		invalid = append(invalid, inv...)
+	}
+
+	return invalid, failed.err()
+}
+
+// send delivers n to a batch of tokens. It adds the tokens with result
+// errors to failed, and returns an error when the request failed.
+func (f *FCM) send(tokens []string, n *pigeon.Push, failed *failures) ([]string, error) {
+	base := f.BaseURL
+	if base == "" {
+		base = FCMURL
+	}
+	client := f.Client
+	if client == nil {
+		client = defaultClient
+	}
+
+	body := fcmRequest{RegistrationIDs: tokens, Data: n.Data}
+	if n.Title != "" || n.Body != "" {
+		body.Notification = &fcmNotification{Title: n.Title, Body: n.Body}
+	}
+
+	b, err := json.Marshal(body)
+	if err != nil {
+		return nil, err
+	}
+
+	req, err := http.NewRequest(http.MethodPost, strings.TrimRight(base, "/")+"/fcm/send", bytes.NewReader(b))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Authorization", "key="+f.ServerKey)
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, &pigeon.TemporaryError{Err: err}
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, temporary(errors.Errorf("fcm: %s", resp.Status), resp)
+	}
+
+	var r fcmResponse
+	if err := json.NewDecoder(resp.Body).Decode(&r); err != nil {
+		return nil, errors.Wrap(err, "fcm: invalid response")
+	}
+
+	var invalid []string
+	for i, res := range r.Results {
+		if i >= len(tokens) || res.Error == "" {
+			continue
+		}
+
+		err := errors.Errorf("fcm: %s", res.Error)
+		switch {
+		case fcmInvalid[res.Error]:
+			invalid = append(invalid, tokens[i])
+		case fcmTemporary[res.Error]:
+			failed.add(&pigeon.TemporaryError{Err: err}, tokens[i])
+		default:
+			failed.add(err, tokens[i])
+		}
+	}
+	return invalid, nil
+}
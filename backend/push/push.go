@@ -0,0 +1,299 @@
+/*
+Package push implements a pigeon.Backend that delivers pigeon.Push
+notifications to many device tokens through FCM or APNs.
+
+Tokens rejected by the provider as invalid or expired are reported with a
+*pigeon.InvalidRecipientsError so they can be pruned. The tokens that failed
+for a temporary reason are retried by the scheduler, and the retries skip the
+tokens that an earlier attempt of the message already reached.
+*/
+package push
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/iampigeon/pigeon"
+	"github.com/pkg/errors"
+)
+
+const (
+	// ProviderFCM is Firebase Cloud Messaging.
+	ProviderFCM = "fcm"
+	// ProviderAPNs is the Apple Push Notification service.
+	ProviderAPNs = "apns"
+
+	// MaxTokens is the maximum number of tokens of a notification.
+	MaxTokens = 10000
+
+	// DefaultTimeout bounds the requests to the providers when they have
+	// no client.
+	DefaultTimeout = 10 * time.Second
+
+	// sentTTL is how long the tokens reached by a failed attempt of a
+	// message are remembered, to skip them on its retries.
+	sentTTL = 24 * time.Hour
+)
+
+var defaultClient = &http.Client{Timeout: DefaultTimeout}
+
+// Provider sends notifications through a push service.
+type Provider interface {
+	// Send delivers n to tokens. It returns the tokens that the service
+	// rejected as invalid or expired, and a non-nil error when the others
+	// could not be delivered, a *TokensError when it lists the tokens that
+	// could not.
+	Send(tokens []string, n *pigeon.Push) (invalid []string, err error)
+}
+
+// TokensError is returned by Provider.Send when the notification could not
+// be delivered to some tokens. The tokens neither failed nor invalid
+// received it.
+type TokensError struct {
+	Tokens []string
+
+	// Err is the reason of the failure, a *pigeon.TemporaryError when all
+	// the tokens can be retried.
+	Err error
+}
+
+func (e *TokensError) Error() string {
+	return fmt.Sprintf("%d tokens failed, %v", len(e.Tokens), e.Err)
+}
+
+// failures collects the tokens that a provider could not deliver to.
+type failures struct {
+	tokens     []string
+	last       error
+	permanent  bool
+	retryAfter time.Duration
+}
+
+func (f *failures) add(err error, tokens ...string) {
+	f.tokens = append(f.tokens, tokens...)
+
+	e, ok := err.(*pigeon.TemporaryError)
+	if !ok {
+		f.last = err
+		f.permanent = true
+		return
+	}
+	if !f.permanent {
+		f.last = e.Err
+	}
+	if e.RetryAfter > f.retryAfter {
+		f.retryAfter = e.RetryAfter
+	}
+}
+
+// err returns the *TokensError of the failures, nil without them.
+func (f *failures) err() error {
+	if len(f.tokens) == 0 {
+		return nil
+	}
+
+	err := f.last
+	if !f.permanent {
+		err = &pigeon.TemporaryError{Err: f.last, RetryAfter: f.retryAfter}
+	}
+	return &TokensError{Tokens: f.tokens, Err: err}
+}
+
+// temporary returns err as a *pigeon.TemporaryError when the response
+// status is a rate limit or a server error, honoring its Retry-After
+// seconds.
+func temporary(err error, resp *http.Response) error {
+	if resp.StatusCode != http.StatusTooManyRequests && resp.StatusCode < 500 {
+		return err
+	}
+
+	var after time.Duration
+	var s int
+	if _, e := fmt.Sscan(resp.Header.Get("Retry-After"), &s); e == nil && s > 0 {
+		after = time.Duration(s) * time.Second
+	}
+	return &pigeon.TemporaryError{Err: err, RetryAfter: after}
+}
+
+// sentTokens are the tokens reached by the failed attempts of a message.
+type sentTokens struct {
+	tokens map[string]bool
+	at     time.Time
+}
+
+// Backend delivers push notifications.
+type Backend struct {
+	providers map[string]Provider
+
+	mu   sync.Mutex
+	sent map[string]*sentTokens
+}
+
+var _ pigeon.MessageBackend = (*Backend)(nil)
+
+// New returns a push backend that sends through the given providers, keyed
+// by provider name.
+func New(providers map[string]Provider) *Backend {
+	return &Backend{
+		providers: providers,
+		sent:      make(map[string]*sentTokens),
+	}
+}
+
+// Approve validates that content is a deliverable pigeon.Push.
+func (b *Backend) Approve(content []byte) (bool, error) {
+	if _, _, err := b.decode(content); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// Deliver sends the notification encoded in content to all its tokens.
+func (b *Backend) Deliver(content []byte) error {
+	return b.DeliverMessage("", content)
+}
+
+// DeliverMessage sends the notification of the message with the given id to
+// the tokens that its earlier attempts did not reach.
+func (b *Backend) DeliverMessage(id string, content []byte) error {
+	n, p, err := b.decode(content)
+	if err != nil {
+		return err
+	}
+
+	tokens := b.pending(id, n.Tokens)
+	invalid, err := p.Send(tokens, n)
+
+	failed := tokens
+	if e, ok := err.(*TokensError); ok {
+		failed = e.Tokens
+		err = e.Err
+	}
+	if err == nil {
+		failed = nil
+	}
+	b.record(id, tokens, invalid, failed)
+
+	if len(invalid) == 0 {
+		return err
+	}
+
+	delivered := len(n.Tokens) - len(invalid) - len(failed)
+	if delivered < 0 {
+		delivered = 0
+	}
+
+	return &pigeon.InvalidRecipientsError{
+		Recipients: invalid,
+		Delivered:  delivered,
+		Err:        err,
+	}
+}
+
+// pending returns the tokens that the earlier attempts of the message with
+// the given id did not reach.
+func (b *Backend) pending(id string, tokens []string) []string {
+	if id == "" {
+		return tokens
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	now := time.Now()
+	for k, s := range b.sent {
+		if now.Sub(s.at) > sentTTL {
+			delete(b.sent, k)
+		}
+	}
+
+	s, ok := b.sent[id]
+	if !ok {
+		return tokens
+	}
+
+	pending := make([]string, 0, len(tokens))
+	for _, t := range tokens {
+		if !s.tokens[t] {
+			pending = append(pending, t)
+		}
+	}
+	return pending
+}
+
+// record remembers the tokens reached by an attempt of the message with
+// the given id while some of them failed, and forgets the message once
+// none did.
+func (b *Backend) record(id string, tokens, invalid, failed []string) {
+	if id == "" {
+		return
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if len(failed) == 0 {
+		delete(b.sent, id)
+		return
+	}
+
+	skip := make(map[string]bool, len(invalid)+len(failed))
+	for _, t := range invalid {
+		skip[t] = true
+	}
+	for _, t := range failed {
+		skip[t] = true
+	}
+
+	s, ok := b.sent[id]
+	if !ok {
+		s = &sentTokens{tokens: make(map[string]bool)}
+		b.sent[id] = s
+	}
+	s.at = time.Now()
+	for _, t := range tokens {
+		if !skip[t] {
+			s.tokens[t] = true
+		}
+	}
+}
+
+func (b *Backend) decode(content []byte) (*pigeon.Push, Provider, error) {
+	n := new(pigeon.Push)
+	if err := json.Unmarshal(content, n); err != nil {
+		return nil, nil, errors.Wrap(err, "invalid push content")
+	}
+
+	p, ok := b.providers[n.Provider]
+	if !ok {
+		return nil, nil, errors.Errorf("unsupported push provider %q", n.Provider)
+	}
+
+	if n.Title == "" && n.Body == "" && len(n.Data) == 0 {
+		return nil, nil, errors.New("missing title, body or data")
+	}
+
+	// drop empty and repeated tokens.
+	seen := make(map[string]bool, len(n.Tokens))
+	tokens := n.Tokens[:0]
+	for _, t := range n.Tokens {
+		if t == "" || seen[t] {
+			continue
+		}
+		seen[t] = true
+		tokens = append(tokens, t)
+	}
+	n.Tokens = tokens
+
+	if len(n.Tokens) == 0 {
+		return nil, nil, errors.New("missing tokens")
+	}
+	if len(n.Tokens) > MaxTokens {
+		return nil, nil, errors.Errorf("too many tokens, the maximum is %d", MaxTokens)
+	}
+
+	return n, p, nil
+}
@@ -0,0 +1,272 @@
+package push
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/iampigeon/pigeon"
+)
+
+// fcmServer is a stand-in of the FCM API that answers each token with the
+// result error given in results, success when missing.
+type fcmServer struct {
+	*httptest.Server
+
+	mu       sync.Mutex
+	results  map[string]string
+	received []string
+}
+
+func newFCMServer(t *testing.T, results map[string]string) *fcmServer {
+	s := &fcmServer{results: results}
+	s.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/fcm/send" || r.Header.Get("Authorization") != "key=server-key" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+
+		var req fcmRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			t.Error(err)
+		}
+
+		s.mu.Lock()
+		defer s.mu.Unlock()
+
+		var resp fcmResponse
+		for _, token := range req.RegistrationIDs {
+			s.received = append(s.received, token)
+
+			var res struct {
+				MessageID string `json:"message_id"`
+				Error     string `json:"error"`
+			}
+			if res.Error = s.results[token]; res.Error == "" {
+				res.MessageID = "m-" + token
+				resp.Success++
+			} else {
+				resp.Failure++
+			}
+			resp.Results = append(resp.Results, res)
+		}
+		json.NewEncoder(w).Encode(resp)
+	}))
+	return s
+}
+
+func (s *fcmServer) tokens() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	tokens := s.received
+	s.received = nil
+	sort.Strings(tokens)
+	return tokens
+}
+
+func content(t *testing.T, n pigeon.Push) []byte {
+	b, err := json.Marshal(n)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+func TestFCMInvalidTokens(t *testing.T) {
+	s := newFCMServer(t, map[string]string{"b": "NotRegistered"})
+	defer s.Close()
+
+	b := New(map[string]Provider{ProviderFCM: &FCM{ServerKey: "server-key", BaseURL: s.URL}})
+	err := b.Deliver(content(t, pigeon.Push{Provider: ProviderFCM, Title: "hi", Tokens: []string{"a", "b", "c"}}))
+
+	e, ok := err.(*pigeon.InvalidRecipientsError)
+	if !ok {
+		t.Fatalf("error %v, want invalid recipients", err)
+	}
+	if strings.Join(e.Recipients, ",") != "b" || e.Delivered != 2 || e.Err != nil {
+		t.Errorf("invalid recipients %+v", e)
+	}
+}
+
+func TestFCMPartialFailure(t *testing.T) {
+	s := newFCMServer(t, map[string]string{"b": "Unavailable", "c": "NotRegistered"})
+	defer s.Close()
+
+	b := New(map[string]Provider{ProviderFCM: &FCM{ServerKey: "server-key", BaseURL: s.URL}})
+	n := content(t, pigeon.Push{Provider: ProviderFCM, Data: map[string]interface{}{"k": "v"}, Tokens: []string{"a", "b", "c"}})
+
+	err := b.DeliverMessage("m1", n)
+	e, ok := err.(*pigeon.InvalidRecipientsError)
+	if !ok {
+		t.Fatalf("error %v, want invalid recipients", err)
+	}
+	if _, ok := e.Err.(*pigeon.TemporaryError); !ok {
+		t.Fatalf("error of the unavailable token %v, want temporary", e.Err)
+	}
+	if got := strings.Join(s.tokens(), ","); got != "a,b,c" {
+		t.Fatalf("sent to %s", got)
+	}
+
+	// the retry skips the token reached by the first attempt.
+	delete(s.results, "b")
+	if err := b.DeliverMessage("m1", n); err != nil {
+		if e, ok := err.(*pigeon.InvalidRecipientsError); !ok || e.Err != nil {
+			t.Fatalf("retry error %v", err)
+		}
+	}
+	if got := strings.Join(s.tokens(), ","); got != "b,c" {
+		t.Errorf("retry sent to %s, want b,c", got)
+	}
+
+	// the message is forgotten once delivered.
+	if err := b.DeliverMessage("m1", n); err != nil {
+		if _, ok := err.(*pigeon.InvalidRecipientsError); !ok {
+			t.Fatal(err)
+		}
+	}
+	if got := strings.Join(s.tokens(), ","); got != "a,b,c" {
+		t.Errorf("new delivery sent to %s, want a,b,c", got)
+	}
+}
+
+func TestFCMPermanentFailure(t *testing.T) {
+	s := newFCMServer(t, map[string]string{"b": "MessageTooBig"})
+	defer s.Close()
+
+	f := &FCM{ServerKey: "server-key", BaseURL: s.URL}
+	_, err := f.Send([]string{"a", "b"}, &pigeon.Push{Title: "hi"})
+
+	e, ok := err.(*TokensError)
+	if !ok {
+		t.Fatalf("error %v, want failed tokens", err)
+	}
+	if strings.Join(e.Tokens, ",") != "b" {
+		t.Errorf("failed tokens %v", e.Tokens)
+	}
+	if _, ok := e.Err.(*pigeon.TemporaryError); ok {
+		t.Error("permanent failure returned as temporary")
+	}
+}
+
+func TestFCMUnavailable(t *testing.T) {
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Retry-After", "30")
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer s.Close()
+
+	b := New(map[string]Provider{ProviderFCM: &FCM{ServerKey: "server-key", BaseURL: s.URL}})
+	err := b.Deliver(content(t, pigeon.Push{Provider: ProviderFCM, Title: "hi", Tokens: []string{"a"}}))
+
+	e, ok := err.(*pigeon.TemporaryError)
+	if !ok {
+		t.Fatalf("error %v, want temporary", err)
+	}
+	if e.RetryAfter != 30*time.Second {
+		t.Errorf("retry after %s, want 30s", e.RetryAfter)
+	}
+}
+
+// apnsRequest is a request received by the APNs stand-in.
+type apnsRequest struct {
+	token   string
+	header  http.Header
+	payload map[string]interface{}
+}
+
+func newAPNsServer(t *testing.T, status map[string]int) (*httptest.Server, chan apnsRequest) {
+	requests := make(chan apnsRequest, 10)
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var payload map[string]interface{}
+		if err := json.NewDecoder(r.Body).Decode(&payload); err != nil {
+			t.Error(err)
+		}
+		token := strings.TrimPrefix(r.URL.Path, "/3/device/")
+		requests <- apnsRequest{token, r.Header, payload}
+
+		if code, ok := status[token]; ok {
+			w.WriteHeader(code)
+			json.NewEncoder(w).Encode(map[string]string{"reason": http.StatusText(code)})
+		}
+	}))
+	return s, requests
+}
+
+func TestAPNsAlert(t *testing.T) {
+	s, requests := newAPNsServer(t, nil)
+	defer s.Close()
+
+	a := &APNs{Topic: "com.example.app", AuthToken: "jwt", BaseURL: s.URL}
+	if _, err := a.Send([]string{"a"}, &pigeon.Push{Title: "hi", Data: map[string]interface{}{"k": "v"}}); err != nil {
+		t.Fatal(err)
+	}
+
+	r := <-requests
+	if r.header.Get("apns-topic") != "com.example.app" || r.header.Get("Authorization") != "bearer jwt" || r.header.Get("apns-push-type") != "alert" {
+		t.Errorf("headers %v", r.header)
+	}
+	aps := r.payload["aps"].(map[string]interface{})
+	alert := aps["alert"].(map[string]interface{})
+	if alert["title"] != "hi" || alert["body"] != nil || r.payload["k"] != "v" {
+		t.Errorf("payload %v", r.payload)
+	}
+}
+
+func TestAPNsBackground(t *testing.T) {
+	s, requests := newAPNsServer(t, nil)
+	defer s.Close()
+
+	a := &APNs{BaseURL: s.URL}
+	if _, err := a.Send([]string{"a"}, &pigeon.Push{Data: map[string]interface{}{"sync": true}}); err != nil {
+		t.Fatal(err)
+	}
+
+	r := <-requests
+	aps := r.payload["aps"].(map[string]interface{})
+	if _, ok := aps["alert"]; ok {
+		t.Errorf("background push with alert %v", aps)
+	}
+	if aps["content-available"] != float64(1) || r.payload["sync"] != true {
+		t.Errorf("payload %v", r.payload)
+	}
+	if r.header.Get("apns-push-type") != "background" || r.header.Get("apns-priority") != "5" {
+		t.Errorf("headers %v", r.header)
+	}
+}
+
+func TestAPNsFailures(t *testing.T) {
+	s, _ := newAPNsServer(t, map[string]int{
+		"gone":     http.StatusGone,
+		"throttle": http.StatusTooManyRequests,
+	})
+	defer s.Close()
+
+	a := &APNs{BaseURL: s.URL}
+	invalid, err := a.Send([]string{"ok", "gone", "throttle"}, &pigeon.Push{Title: "hi"})
+	if strings.Join(invalid, ",") != "gone" {
+		t.Errorf("invalid tokens %v", invalid)
+	}
+
+	e, ok := err.(*TokensError)
+	if !ok {
+		t.Fatalf("error %v, want failed tokens", err)
+	}
+	if strings.Join(e.Tokens, ",") != "throttle" {
+		t.Errorf("failed tokens %v", e.Tokens)
+	}
+	if _, ok := e.Err.(*pigeon.TemporaryError); !ok {
+		t.Errorf("throttled token error %v, want temporary", e.Err)
+	}
+}
+
+func TestDefaultClientTimeout(t *testing.T) {
+	if defaultClient.Timeout == 0 {
+		t.Fatal("default client without timeout")
+	}
+}
@@ -0,0 +1,53 @@
+package backend
+
+import (
+	"github.com/iampigeon/pigeon"
+	"github.com/iampigeon/pigeon/proto"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc"
+)
+
+// Reporter sends the receipts of delivered messages to the scheduler.
+//
+// Backends implementing pigeon.MessageBackend get the ID of each message and
+// report its receipts when the provider confirms them, for example from a
+// delivery status webhook.
+type Reporter struct {
+	conn   *grpc.ClientConn
+	client proto.SchedulerServiceClient
+}
+
+// NewReporter connects to the scheduler of config.
+func NewReporter(config Config) (*Reporter, error) {
+	creds, err := config.SchedulerTLS.DialOption(config.SchedulerAddr)
+	if err != nil {
+		return nil, err
+	}
+
+	conn, err := grpc.Dial(string(config.SchedulerAddr), creds)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Reporter{
+		conn:   conn,
+		client: proto.NewSchedulerServiceClient(conn),
+	}, nil
+}
+
+// Report records that the message with the given id was delivered, read or
+// acknowledged.
+func (r *Reporter) Report(id string, status pigeon.MessageStatus, detail string) error {
+	_, err := r.client.ReportReceipt(context.Background(), &proto.ReportReceiptRequest{
+		Id:     id,
+		Status: string(status),
+		Source: pigeon.SourceBackend,
+		Detail: detail,
+	})
+	return err
+}
+
+// Close closes the connection to the scheduler.
+func (r *Reporter) Close() error {
+	return r.conn.Close()
+}
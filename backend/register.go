@@ -0,0 +1,77 @@
+package backend
+
+import (
+	"log"
+	"time"
+
+	"github.com/iampigeon/pigeon"
+	"github.com/iampigeon/pigeon/proto"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc"
+)
+
+// registerRetry is the wait before retrying a failed registration.
+const registerRetry = 5 * time.Second
+
+// register announces the backend to the scheduler and sends heartbeats
+// until the process exits. Heartbeats are sent three times per TTL.
+func register(config Config, channel string) {
+	addr := config.AdvertiseAddr
+	if addr == "" {
+		addr = config.Addr
+	}
+
+	creds, err := config.SchedulerTLS.DialOption(config.SchedulerAddr)
+	if err != nil {
+		log.Printf("Error: could not register backend, %v", err)
+		return
+	}
+
+	conn, err := grpc.Dial(string(config.SchedulerAddr), creds)
+	if err != nil {
+		log.Printf("Error: could not register backend, %v", err)
+		return
+	}
+	defer conn.Close()
+
+	client := proto.NewSchedulerServiceClient(conn)
+
+	for {
+		ttl, err := registerOnce(client, channel, addr)
+		if err != nil {
+			log.Printf("Error: could not register backend in %s, %v", config.SchedulerAddr, err)
+			time.Sleep(registerRetry)
+			continue
+		}
+
+		for {
+			time.Sleep(ttl / 3)
+
+			_, err := client.Heartbeat(context.Background(), &proto.HeartbeatRequest{
+				Channel: channel,
+				Addr:    string(addr),
+			})
+			if err != nil {
+				log.Printf("Error: heartbeat to %s failed, %v", config.SchedulerAddr, err)
+				break
+			}
+		}
+	}
+}
+
+func registerOnce(client proto.SchedulerServiceClient, channel string, addr pigeon.NetAddr) (time.Duration, error) {
+	resp, err := client.Register(context.Background(), &proto.RegisterRequest{
+		Channel: channel,
+		Addr:    string(addr),
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	ttl := time.Duration(resp.TtlSeconds) * time.Second
+	if ttl <= 0 {
+		ttl = registerRetry * 3
+	}
+
+	return ttl, nil
+}
@@ -0,0 +1,59 @@
+package sms
+
+import "unicode/utf16"
+
+const (
+	// EncodingGSM7 is the GSM 03.38 7-bit default alphabet.
+	EncodingGSM7 = "GSM-7"
+	// EncodingUCS2 is used when the text has characters outside GSM-7.
+	EncodingUCS2 = "UCS-2"
+)
+
+const (
+	gsm7Single = 160
+	gsm7Multi  = 153
+	ucs2Single = 70
+	ucs2Multi  = 67
+)
+
+var (
+	gsm7Basic     = make(map[rune]bool)
+	gsm7Extension = make(map[rune]bool)
+)
+
+func init() {
+	for _, r := range "@£$¥èéùìòÇ\nØø\rÅåΔ_ΦΓΛΩΠΨΣΘΞÆæßÉ !\"#¤%&'()*+,-./0123456789:;<=>?" +
+		"¡ABCDEFGHIJKLMNOPQRSTUVWXYZÄÖÑÜ§¿abcdefghijklmnopqrstuvwxyzäöñüà" {
+		gsm7Basic[r] = true
+	}
+	for _, r := range "\f^{}\\[~]|€" {
+		gsm7Extension[r] = true
+	}
+}
+
+// Segments returns the encoding used to send text and the number of
+// segments it takes.
+func Segments(text string) (encoding string, n int) {
+	septets := 0
+	for _, r := range text {
+		switch {
+		case gsm7Basic[r]:
+			septets++
+		case gsm7Extension[r]:
+			// extension characters are sent as an escape and the
+			// character.
+			septets += 2
+		default:
+			return EncodingUCS2, count(len(utf16.Encode([]rune(text))), ucs2Single, ucs2Multi)
+		}
+	}
+
+	return EncodingGSM7, count(septets, gsm7Single, gsm7Multi)
+}
+
+func count(units, single, multi int) int {
+	if units <= single {
+		return 1
+	}
+	return (units + multi - 1) / multi
+}
@@ -0,0 +1,100 @@
+package sms
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/iampigeon/pigeon"
+)
+
+// SimulatorFile is the name of the file written by the simulator.
+const SimulatorFile = "messages.jsonl"
+
+// SimulatedMessage is a message recorded by the Simulator.
+type SimulatedMessage struct {
+	Phone    string    `json:"phone"`
+	From     string    `json:"from,omitempty"`
+	Text     string    `json:"text"`
+	Encoding string    `json:"encoding"`
+	Segments int       `json:"segments"`
+	SentAt   time.Time `json:"sent_at"`
+}
+
+// Simulator is a Driver that records messages, one JSON object per line,
+// in a file of a directory instead of sending them.
+type Simulator struct {
+	path string
+
+	mu sync.Mutex
+}
+
+var _ Driver = (*Simulator)(nil)
+
+// NewSimulator returns a simulator that writes to dir, creating it if
+// needed.
+func NewSimulator(dir string) (*Simulator, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	return &Simulator{path: filepath.Join(dir, SimulatorFile)}, nil
+}
+
+// Send records sms.
+func (s *Simulator) Send(sms *pigeon.SMS) error {
+	encoding, segments := Segments(sms.Text)
+
+	line, err := json.Marshal(SimulatedMessage{
+		Phone:    sms.Phone,
+		From:     sms.From,
+		Text:     sms.Text,
+		Encoding: encoding,
+		Segments: segments,
+		SentAt:   time.Now().UTC(),
+	})
+	if err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	f, err := os.OpenFile(s.path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+
+	if _, err := f.Write(append(line, '\n')); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// Messages returns the messages recorded so far.
+func (s *Simulator) Messages() ([]*SimulatedMessage, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	f, err := os.Open(s.path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var msgs []*SimulatedMessage
+	dec := json.NewDecoder(f)
+	for dec.More() {
+		m := new(SimulatedMessage)
+		if err := dec.Decode(m); err != nil {
+			return nil, err
+		}
+		msgs = append(msgs, m)
+	}
+	return msgs, nil
+}
@@ -0,0 +1,102 @@
+/*
+Package sms implements a pigeon.Backend that delivers pigeon.SMS contents
+through a provider Driver.
+
+Approve checks that phone numbers are in E.164 format and that the text
+fits in the configured number of segments, counted with the GSM-7 alphabet
+when possible and UCS-2 otherwise.
+*/
+package sms
+
+import (
+	"encoding/json"
+	"regexp"
+
+	"github.com/iampigeon/pigeon"
+	"github.com/pkg/errors"
+)
+
+// DefaultMaxSegments is the maximum number of segments of a message.
+const DefaultMaxSegments = 10
+
+var (
+	e164     = regexp.MustCompile(`^\+[1-9][0-9]{1,14}$`)
+	senderID = regexp.MustCompile(`^[A-Za-z0-9 ]{1,11}$`)
+)
+
+// Driver sends messages through an SMS provider.
+type Driver interface {
+	// Send delivers sms. The phone, text and sender ID are already
+	// validated.
+	Send(sms *pigeon.SMS) error
+}
+
+// Config configures the SMS backend.
+type Config struct {
+	// Driver sends the messages.
+	Driver Driver
+
+	// SenderID is the default sender ID, used when the content has none.
+	SenderID string
+
+	// MaxSegments is the maximum number of segments of a message.
+	MaxSegments int
+}
+
+// Backend delivers SMS.
+type Backend struct {
+	config Config
+}
+
+var _ pigeon.Backend = (*Backend)(nil)
+
+// New returns an SMS backend.
+func New(config Config) *Backend {
+	if config.MaxSegments == 0 {
+		config.MaxSegments = DefaultMaxSegments
+	}
+	return &Backend{config: config}
+}
+
+// Approve validates that content is a deliverable pigeon.SMS.
+func (b *Backend) Approve(content []byte) (bool, error) {
+	if _, err := b.decode(content); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// Deliver sends the message encoded in content.
+func (b *Backend) Deliver(content []byte) error {
+	sms, err := b.decode(content)
+	if err != nil {
+		return err
+	}
+	return b.config.Driver.Send(sms)
+}
+
+func (b *Backend) decode(content []byte) (*pigeon.SMS, error) {
+	sms := new(pigeon.SMS)
+	if err := json.Unmarshal(content, sms); err != nil {
+		return nil, errors.Wrap(err, "invalid sms content")
+	}
+
+	if !e164.MatchString(sms.Phone) {
+		return nil, errors.Errorf("phone %q is not in E.164 format", sms.Phone)
+	}
+	if sms.Text == "" {
+		return nil, errors.New("missing text")
+	}
+	if _, n := Segments(sms.Text); n > b.config.MaxSegments {
+		return nil, errors.Errorf("text needs %d segments, the maximum is %d", n, b.config.MaxSegments)
+	}
+
+	if sms.From == "" {
+		sms.From = b.config.SenderID
+	}
+	if sms.From != "" && !e164.MatchString(sms.From) && !senderID.MatchString(sms.From) {
+		return nil, errors.Errorf("invalid sender id %q", sms.From)
+	}
+
+	return sms, nil
+}
@@ -0,0 +1,161 @@
+package sms
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/iampigeon/pigeon"
+)
+
+func content(t *testing.T, sms pigeon.SMS) []byte {
+	b, err := json.Marshal(sms)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+func TestSegments(t *testing.T) {
+	tests := []struct {
+		text     string
+		encoding string
+		n        int
+	}{
+		{"hello", EncodingGSM7, 1},
+		{strings.Repeat("a", 160), EncodingGSM7, 1},
+		{strings.Repeat("a", 161), EncodingGSM7, 2},
+		{strings.Repeat("€", 80), EncodingGSM7, 1},
+		{strings.Repeat("€", 81), EncodingGSM7, 2},
+		{"olá", EncodingUCS2, 1},
+		{strings.Repeat("ñ", 160) + "á", EncodingUCS2, 3},
+		{strings.Repeat("🙂", 35), EncodingUCS2, 1},
+		{strings.Repeat("🙂", 36), EncodingUCS2, 2},
+	}
+
+	for _, tt := range tests {
+		encoding, n := Segments(tt.text)
+		if encoding != tt.encoding || n != tt.n {
+			t.Errorf("Segments(%.20q) = %s, %d, want %s, %d", tt.text, encoding, n, tt.encoding, tt.n)
+		}
+	}
+}
+
+func TestApprove(t *testing.T) {
+	b := New(Config{MaxSegments: 2})
+
+	tests := []struct {
+		name string
+		sms  pigeon.SMS
+	}{
+		{"phone without country code", pigeon.SMS{Phone: "5551234", Text: "hi"}},
+		{"missing text", pigeon.SMS{Phone: "+15551234567"}},
+		{"text over the segments", pigeon.SMS{Phone: "+15551234567", Text: strings.Repeat("a", 307)}},
+		{"sender id", pigeon.SMS{Phone: "+15551234567", Text: "hi", From: "a-very-long-sender"}},
+	}
+	for _, tt := range tests {
+		if ok, err := b.Approve(content(t, tt.sms)); ok || err == nil {
+			t.Errorf("%s approved", tt.name)
+		}
+	}
+
+	for _, from := range []string{"", "+15550000000", "Pigeon"} {
+		sms := pigeon.SMS{Phone: "+15551234567", Text: strings.Repeat("a", 306), From: from}
+		if ok, err := b.Approve(content(t, sms)); !ok || err != nil {
+			t.Errorf("sender %q not approved, %v", from, err)
+		}
+	}
+}
+
+func TestTwilio(t *testing.T) {
+	var form url.Values
+	var path, user, pass string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		path = r.URL.Path
+		user, pass, _ = r.BasicAuth()
+		r.ParseForm()
+		form = r.PostForm
+		w.WriteHeader(http.StatusCreated)
+	}))
+	defer srv.Close()
+
+	driver := &Twilio{AccountSID: "AC123", AuthToken: "token", BaseURL: srv.URL}
+	b := New(Config{Driver: driver, SenderID: "Pigeon"})
+	if err := b.Deliver(content(t, pigeon.SMS{Phone: "+15551234567", Text: "Your code is 1234"})); err != nil {
+		t.Fatal(err)
+	}
+
+	if path != "/2010-04-01/Accounts/AC123/Messages.json" {
+		t.Errorf("path %s", path)
+	}
+	if user != "AC123" || pass != "token" {
+		t.Errorf("basic auth %s:%s", user, pass)
+	}
+	if form.Get("To") != "+15551234567" || form.Get("From") != "Pigeon" || form.Get("Body") != "Your code is 1234" {
+		t.Errorf("form %v", form)
+	}
+}
+
+func TestTwilioError(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(`{"code": 21211, "message": "invalid To"}`))
+	}))
+	defer srv.Close()
+
+	driver := &Twilio{AccountSID: "AC123", AuthToken: "token", BaseURL: srv.URL}
+	err := driver.Send(&pigeon.SMS{Phone: "+15551234567", Text: "hi"})
+	if err == nil || !strings.Contains(err.Error(), "invalid To") {
+		t.Fatalf("error %v, want the provider message", err)
+	}
+}
+
+func TestTwilioDefaultClientTimeout(t *testing.T) {
+	if defaultClient.Timeout == 0 {
+		t.Fatal("default client without timeout")
+	}
+}
+
+func TestSimulator(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sms")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	sim, err := NewSimulator(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	msgs, err := sim.Messages()
+	if err != nil || len(msgs) != 0 {
+		t.Fatalf("messages before sending %v, %v", msgs, err)
+	}
+
+	b := New(Config{Driver: sim})
+	for _, text := range []string{"hello", "olá"} {
+		if err := b.Deliver(content(t, pigeon.SMS{Phone: "+15551234567", Text: text, From: "Pigeon"})); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	msgs, err = sim.Messages()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(msgs) != 2 {
+		t.Fatalf("%d messages recorded, want 2", len(msgs))
+	}
+	if m := msgs[0]; m.Phone != "+15551234567" || m.From != "Pigeon" || m.Text != "hello" || m.Encoding != EncodingGSM7 || m.Segments != 1 {
+		t.Errorf("first message %+v", m)
+	}
+	if m := msgs[1]; m.Encoding != EncodingUCS2 || m.SentAt.IsZero() {
+		t.Errorf("second message %+v", m)
+	}
+}
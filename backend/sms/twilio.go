@@ -0,0 +1,76 @@
+package sms
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/iampigeon/pigeon"
+	"github.com/pkg/errors"
+)
+
+const (
+	// TwilioURL is the base URL of the Twilio API.
+	TwilioURL = "https://api.twilio.com"
+
+	// DefaultTimeout bounds the requests to the provider when the driver
+	// has no client.
+	DefaultTimeout = 10 * time.Second
+)
+
+var defaultClient = &http.Client{Timeout: DefaultTimeout}
+
+// Twilio is a Driver for the Twilio messages API.
+type Twilio struct {
+	AccountSID string
+	AuthToken  string
+
+	// BaseURL is the API base URL, TwilioURL when empty.
+	BaseURL string
+
+	// Client sends the requests, a client with DefaultTimeout when nil.
+	Client *http.Client
+}
+
+var _ Driver = (*Twilio)(nil)
+
+// Send delivers sms through Twilio.
+func (t *Twilio) Send(sms *pigeon.SMS) error {
+	base := t.BaseURL
+	if base == "" {
+		base = TwilioURL
+	}
+	client := t.Client
+	if client == nil {
+		client = defaultClient
+	}
+
+	form := url.Values{}
+	form.Set("To", sms.Phone)
+	form.Set("From", sms.From)
+	form.Set("Body", sms.Text)
+
+	endpoint := fmt.Sprintf("%s/2010-04-01/Accounts/%s/Messages.json", strings.TrimRight(base, "/"), url.PathEscape(t.AccountSID))
+	req, err := http.NewRequest(http.MethodPost, endpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return err
+	}
+	req.SetBasicAuth(t.AccountSID, t.AuthToken)
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		body, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 1024))
+		return errors.Errorf("twilio: %s: %s", resp.Status, body)
+	}
+	return nil
+}
@@ -0,0 +1,257 @@
+/*
+Package webhook implements a pigeon.Backend that delivers pigeon.HTTP
+contents as HTTP requests.
+
+Only 2xx responses are successful deliveries. Requests that fail with a
+network error, a 429 or a 5xx response return a *pigeon.TemporaryError, so
+the scheduler retries them, after the Retry-After of the response when it
+has one.
+
+Header values are text/template templates executed with a Request value,
+for example "Bearer {{.Timestamp}}".
+
+When the content has a secret the request is signed: the X-Pigeon-Timestamp
+header holds the unix time of the request and X-Pigeon-Signature holds
+"sha256=" followed by the hex HMAC-SHA256 of the timestamp, a dot and the
+body.
+*/
+package webhook
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+	"text/template"
+	"time"
+
+	"github.com/iampigeon/pigeon"
+	"github.com/pkg/errors"
+)
+
+const (
+	// TimestampHeader holds the unix time of signed requests.
+	TimestampHeader = "X-Pigeon-Timestamp"
+	// SignatureHeader holds the signature of signed requests.
+	SignatureHeader = "X-Pigeon-Signature"
+
+	// DefaultTimeout is the timeout of each request.
+	DefaultTimeout = 10 * time.Second
+	// MaxTimeout is the maximum timeout a content can ask for.
+	MaxTimeout = 5 * time.Minute
+	// DefaultMaxBodySize is the maximum size of a request body.
+	DefaultMaxBodySize = 1 << 20
+	// DefaultMaxResponseSize is the maximum number of response bytes read.
+	DefaultMaxResponseSize = 64 << 10
+)
+
+var methods = map[string]bool{
+	http.MethodGet:    true,
+	http.MethodHead:   true,
+	http.MethodPost:   true,
+	http.MethodPut:    true,
+	http.MethodPatch:  true,
+	http.MethodDelete: true,
+}
+
+// Config configures the webhook backend. Zero values use the package
+// defaults.
+type Config struct {
+	// Client sends the requests, http.DefaultClient when nil.
+	Client *http.Client
+
+	MaxBodySize     int
+	MaxResponseSize int64
+
+	// DisableRetries fails the requests that could be retried instead of
+	// returning a *pigeon.TemporaryError.
+	DisableRetries bool
+}
+
+// Request is the data available to header templates.
+type Request struct {
+	Method    string
+	URL       string
+	Body      string
+	Timestamp int64
+}
+
+// Backend delivers webhooks.
+type Backend struct {
+	config Config
+}
+
+var _ pigeon.Backend = (*Backend)(nil)
+
+// New returns a webhook backend.
+func New(config Config) *Backend {
+	if config.Client == nil {
+		config.Client = http.DefaultClient
+	}
+	if config.MaxBodySize == 0 {
+		config.MaxBodySize = DefaultMaxBodySize
+	}
+	if config.MaxResponseSize == 0 {
+		config.MaxResponseSize = DefaultMaxResponseSize
+	}
+	return &Backend{config: config}
+}
+
+// Approve validates that content is a deliverable pigeon.HTTP.
+func (b *Backend) Approve(content []byte) (bool, error) {
+	if _, _, err := b.decode(content); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// Deliver sends the request encoded in content. Network errors, 429 and 5xx
+// responses return a *pigeon.TemporaryError unless retries are disabled.
+func (b *Backend) Deliver(content []byte) error {
+	h, headers, err := b.decode(content)
+	if err != nil {
+		return err
+	}
+
+	err = b.do(h, headers)
+	if e, ok := err.(*pigeon.TemporaryError); ok && b.config.DisableRetries {
+		return e.Err
+	}
+	return err
+}
+
+// decode validates content and parses its header templates.
+func (b *Backend) decode(content []byte) (*pigeon.HTTP, map[string]*template.Template, error) {
+	h := new(pigeon.HTTP)
+	if err := json.Unmarshal(content, h); err != nil {
+		return nil, nil, errors.Wrap(err, "invalid http content")
+	}
+
+	if h.URL == nil {
+		return nil, nil, errors.New("missing url")
+	}
+	if h.URL.Scheme != "http" && h.URL.Scheme != "https" {
+		return nil, nil, errors.Errorf("invalid url scheme %q", h.URL.Scheme)
+	}
+	if h.URL.Host == "" {
+		return nil, nil, errors.New("missing url host")
+	}
+
+	h.Method = strings.ToUpper(h.Method)
+	if h.Method == "" {
+		h.Method = http.MethodPost
+	}
+	if !methods[h.Method] {
+		return nil, nil, errors.Errorf("unsupported method %s", h.Method)
+	}
+
+	if len(h.Body) > b.config.MaxBodySize {
+		return nil, nil, errors.Errorf("body exceeds %d bytes", b.config.MaxBodySize)
+	}
+	if h.Timeout < 0 || time.Duration(h.Timeout)*time.Second > MaxTimeout {
+		return nil, nil, errors.Errorf("timeout must be between 0 and %d seconds", int64(MaxTimeout/time.Second))
+	}
+
+	headers := make(map[string]*template.Template, len(h.Headers))
+	for k, v := range h.Headers {
+		t, err := template.New(k).Parse(fmt.Sprint(v))
+		if err != nil {
+			return nil, nil, errors.Wrapf(err, "invalid header %s", k)
+		}
+		headers[k] = t
+	}
+
+	return h, headers, nil
+}
+
+// do sends one request, failures that can be retried are returned as a
+// *pigeon.TemporaryError.
+func (b *Backend) do(h *pigeon.HTTP, headers map[string]*template.Template) error {
+	timeout := DefaultTimeout
+	if h.Timeout > 0 {
+		timeout = time.Duration(h.Timeout) * time.Second
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	var body io.Reader
+	if h.Body != "" {
+		body = strings.NewReader(h.Body)
+	}
+
+	req, err := http.NewRequest(h.Method, h.URL.String(), body)
+	if err != nil {
+		return err
+	}
+	req = req.WithContext(ctx)
+
+	data := Request{
+		Method:    h.Method,
+		URL:       h.URL.String(),
+		Body:      h.Body,
+		Timestamp: time.Now().Unix(),
+	}
+
+	for k, t := range headers {
+		var v bytes.Buffer
+		if err := t.Execute(&v, data); err != nil {
+			return errors.Wrapf(err, "invalid header %s", k)
+		}
+		req.Header.Set(k, v.String())
+	}
+
+	if h.Secret != "" {
+		ts := strconv.FormatInt(data.Timestamp, 10)
+		req.Header.Set(TimestampHeader, ts)
+		req.Header.Set(SignatureHeader, Sign(h.Secret, ts, h.Body))
+	}
+
+	resp, err := b.config.Client.Do(req)
+	if err != nil {
+		return &pigeon.TemporaryError{Err: err}
+	}
+	defer resp.Body.Close()
+
+	// drain a bounded part of the body so the connection can be reused.
+	io.Copy(ioutil.Discard, io.LimitReader(resp.Body, b.config.MaxResponseSize))
+
+	switch {
+	case resp.StatusCode >= 200 && resp.StatusCode < 300:
+		return nil
+	case resp.StatusCode >= 500 || resp.StatusCode == http.StatusTooManyRequests:
+		return &pigeon.TemporaryError{
+			Err:        errors.Errorf("%s %s: %s", h.Method, h.URL, resp.Status),
+			RetryAfter: retryAfter(resp.Header.Get("Retry-After")),
+		}
+	default:
+		return errors.Errorf("%s %s: %s", h.Method, h.URL, resp.Status)
+	}
+}
+
+// retryAfter parses the seconds of a Retry-After header, zero when it is
+// missing or a date.
+func retryAfter(v string) time.Duration {
+	seconds, err := strconv.Atoi(v)
+	if err != nil || seconds < 0 {
+		return 0
+	}
+	return time.Duration(seconds) * time.Second
+}
+
+// Sign returns the signature of a request sent at timestamp with body.
+func Sign(secret, timestamp, body string) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(timestamp))
+	mac.Write([]byte("."))
+	mac.Write([]byte(body))
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
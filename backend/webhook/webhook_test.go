@@ -0,0 +1,207 @@
+package webhook
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/iampigeon/pigeon"
+)
+
+// received is a request received by a test server.
+type received struct {
+	method string
+	header http.Header
+	body   string
+}
+
+func newServer(t *testing.T, status int, header http.Header) (*httptest.Server, chan received) {
+	requests := make(chan received, 10)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			t.Error(err)
+		}
+		requests <- received{r.Method, r.Header, string(body)}
+
+		for k, v := range header {
+			w.Header()[k] = v
+		}
+		w.WriteHeader(status)
+	}))
+	return srv, requests
+}
+
+func content(t *testing.T, rawURL string, h pigeon.HTTP) []byte {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	h.URL = u
+
+	b, err := json.Marshal(h)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+func TestDeliverStatus(t *testing.T) {
+	tests := []struct {
+		status     int
+		header     http.Header
+		wantErr    bool
+		temporary  bool
+		retryAfter time.Duration
+	}{
+		{status: http.StatusOK},
+		{status: http.StatusNoContent},
+		{status: http.StatusBadRequest, wantErr: true},
+		{status: http.StatusNotFound, wantErr: true},
+		{status: http.StatusInternalServerError, wantErr: true, temporary: true},
+		{status: http.StatusServiceUnavailable, header: http.Header{"Retry-After": {"30"}}, wantErr: true, temporary: true, retryAfter: 30 * time.Second},
+		{status: http.StatusTooManyRequests, header: http.Header{"Retry-After": {"5"}}, wantErr: true, temporary: true, retryAfter: 5 * time.Second},
+	}
+
+	for _, tt := range tests {
+		srv, requests := newServer(t, tt.status, tt.header)
+
+		err := New(Config{}).Deliver(content(t, srv.URL, pigeon.HTTP{Body: "{}"}))
+		if (err != nil) != tt.wantErr {
+			t.Errorf("%d: error %v", tt.status, err)
+		}
+		e, ok := err.(*pigeon.TemporaryError)
+		if ok != tt.temporary {
+			t.Errorf("%d: temporary error %v, want %v", tt.status, ok, tt.temporary)
+		}
+		if ok && e.RetryAfter != tt.retryAfter {
+			t.Errorf("%d: retry after %s, want %s", tt.status, e.RetryAfter, tt.retryAfter)
+		}
+		if n := len(requests); n != 1 {
+			t.Errorf("%d: %d requests, want 1", tt.status, n)
+		}
+
+		srv.Close()
+	}
+}
+
+func TestDeliverDisableRetries(t *testing.T) {
+	srv, _ := newServer(t, http.StatusBadGateway, nil)
+	defer srv.Close()
+
+	err := New(Config{DisableRetries: true}).Deliver(content(t, srv.URL, pigeon.HTTP{}))
+	if err == nil {
+		t.Fatal("5xx response delivered")
+	}
+	if _, ok := err.(*pigeon.TemporaryError); ok {
+		t.Fatal("temporary error with retries disabled")
+	}
+}
+
+func TestDeliverNetworkError(t *testing.T) {
+	srv, _ := newServer(t, http.StatusOK, nil)
+	srv.Close()
+
+	err := New(Config{}).Deliver(content(t, srv.URL, pigeon.HTTP{}))
+	if _, ok := err.(*pigeon.TemporaryError); !ok {
+		t.Fatalf("network error %v is not temporary", err)
+	}
+}
+
+func TestDeliverMethods(t *testing.T) {
+	srv, requests := newServer(t, http.StatusOK, nil)
+	defer srv.Close()
+
+	for method, want := range map[string]string{
+		"":       http.MethodPost,
+		"get":    http.MethodGet,
+		"PUT":    http.MethodPut,
+		"patch":  http.MethodPatch,
+		"DELETE": http.MethodDelete,
+	} {
+		if err := New(Config{}).Deliver(content(t, srv.URL, pigeon.HTTP{Method: method})); err != nil {
+			t.Fatalf("%q: %v", method, err)
+		}
+		if r := <-requests; r.method != want {
+			t.Errorf("%q sent as %s, want %s", method, r.method, want)
+		}
+	}
+
+	if ok, err := New(Config{}).Approve(content(t, srv.URL, pigeon.HTTP{Method: "CONNECT"})); ok || err == nil {
+		t.Error("CONNECT approved")
+	}
+}
+
+func TestApprove(t *testing.T) {
+	b := New(Config{MaxBodySize: 8})
+
+	tests := []struct {
+		name string
+		url  string
+		h    pigeon.HTTP
+	}{
+		{"body over the size limit", "http://example.com", pigeon.HTTP{Body: "123456789"}},
+		{"scheme", "ftp://example.com", pigeon.HTTP{}},
+		{"host", "http://", pigeon.HTTP{}},
+		{"timeout", "http://example.com", pigeon.HTTP{Timeout: int64(MaxTimeout/time.Second) + 1}},
+		{"header template", "http://example.com", pigeon.HTTP{Headers: map[string]interface{}{"X-A": "{{"}}},
+	}
+	for _, tt := range tests {
+		if ok, err := b.Approve(content(t, tt.url, tt.h)); ok || err == nil {
+			t.Errorf("invalid %s approved", tt.name)
+		}
+	}
+
+	if ok, err := b.Approve(content(t, "http://example.com", pigeon.HTTP{Body: "12345678"})); !ok || err != nil {
+		t.Errorf("body at the size limit not approved, %v", err)
+	}
+}
+
+func TestDeliverSigned(t *testing.T) {
+	srv, requests := newServer(t, http.StatusOK, nil)
+	defer srv.Close()
+
+	err := New(Config{}).Deliver(content(t, srv.URL, pigeon.HTTP{
+		Body:    `{"order":42}`,
+		Secret:  "s3cret",
+		Headers: map[string]interface{}{"X-Sent-At": "{{.Timestamp}}"},
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r := <-requests
+	ts := r.header.Get(TimestampHeader)
+	if ts == "" {
+		t.Fatal("missing timestamp header")
+	}
+	if got := r.header.Get("X-Sent-At"); got != ts {
+		t.Errorf("templated header %q, want %q", got, ts)
+	}
+	if got, want := r.header.Get(SignatureHeader), Sign("s3cret", ts, r.body); got != want {
+		t.Errorf("signature %q, want %q", got, want)
+	}
+	if !strings.HasPrefix(Sign("s3cret", ts, r.body), "sha256=") {
+		t.Error("signature without sha256 prefix")
+	}
+	if Sign("other", ts, r.body) == r.header.Get(SignatureHeader) {
+		t.Error("signature does not depend on the secret")
+	}
+}
+
+func TestDeliverUnsigned(t *testing.T) {
+	srv, requests := newServer(t, http.StatusOK, nil)
+	defer srv.Close()
+
+	if err := New(Config{}).Deliver(content(t, srv.URL, pigeon.HTTP{Body: "x"})); err != nil {
+		t.Fatal(err)
+	}
+	if r := <-requests; r.header.Get(SignatureHeader) != "" {
+		t.Error("request without secret signed")
+	}
+}
@@ -0,0 +1,33 @@
+package main
+
+import (
+	"flag"
+	"log"
+
+	"github.com/iampigeon/pigeon"
+	"github.com/iampigeon/pigeon/backend"
+	"github.com/iampigeon/pigeon/backend/chat"
+)
+
+func main() {
+	loadConfig := backend.ConfigFromFlags(flag.CommandLine, 9060, pigeon.ServicePigeonTelegram, pigeon.ServicePigeonSlack)
+
+	telegramToken := flag.String("telegram_bot_token", "", "default Telegram bot token")
+	telegramURL := flag.String("telegram_url", chat.TelegramURL, "Telegram Bot API base URL")
+	flag.Parse()
+
+	config, err := loadConfig()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	b := chat.New(map[string]chat.Provider{
+		pigeon.ServicePigeonTelegram: &chat.Telegram{BotToken: *telegramToken, BaseURL: *telegramURL},
+		pigeon.ServicePigeonSlack:    &chat.Slack{},
+	})
+
+	log.Printf("Serving chat backend at %s", config.Addr)
+	if err := backend.Serve(config, b); err != nil {
+		log.Fatal(err)
+	}
+}
@@ -0,0 +1,43 @@
+package main
+
+import (
+	"flag"
+	"log"
+
+	"github.com/iampigeon/pigeon"
+	"github.com/iampigeon/pigeon/backend"
+	"github.com/iampigeon/pigeon/backend/email"
+)
+
+func main() {
+	loadConfig := backend.ConfigFromFlags(flag.CommandLine, 9030, pigeon.ServicePigeonEmail)
+
+	smtpHost := flag.String("smtp_host", "", "default SMTP server host")
+	smtpPort := flag.Int("smtp_port", email.DefaultPort, "default SMTP server port")
+	smtpUsername := flag.String("smtp_username", "", "default SMTP username")
+	smtpPassword := flag.String("smtp_password", "", "default SMTP password")
+	smtpStartTLS := flag.String("smtp_starttls", email.StartTLSOpportunistic, "STARTTLS mode: opportunistic, required or disabled")
+	hostname := flag.String("hostname", "", "name sent in the SMTP HELO command")
+	flag.Parse()
+
+	config, err := loadConfig()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	b := email.New(email.Config{
+		SMTP: pigeon.SMTPOptions{
+			Host:     *smtpHost,
+			Port:     *smtpPort,
+			Username: *smtpUsername,
+			Password: *smtpPassword,
+			StartTLS: *smtpStartTLS,
+		},
+		Hostname: *hostname,
+	})
+
+	log.Printf("Serving email backend at %s", config.Addr)
+	if err := backend.Serve(config, b); err != nil {
+		log.Fatal(err)
+	}
+}
@@ -0,0 +1,40 @@
+package main
+
+import (
+	"flag"
+	"log"
+
+	"github.com/iampigeon/pigeon"
+	"github.com/iampigeon/pigeon/backend"
+	"github.com/iampigeon/pigeon/backend/mqtt"
+)
+
+func main() {
+	loadConfig := backend.ConfigFromFlags(flag.CommandLine, 9010, pigeon.ServicePigeonMQTT)
+
+	broker := flag.String("broker", "", "default broker URL, for example tcp://localhost:1883")
+	username := flag.String("username", "", "default broker username")
+	password := flag.String("password", "", "default broker password")
+	clientID := flag.String("client_id", "", "default client ID")
+	timeout := flag.Duration("timeout", mqtt.DefaultTimeout, "timeout to connect and publish")
+	flag.Parse()
+
+	config, err := loadConfig()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	b := mqtt.New(mqtt.Config{
+		Broker:   *broker,
+		Username: *username,
+		Password: *password,
+		ClientID: *clientID,
+		Timeout:  *timeout,
+	})
+	defer b.Close()
+
+	log.Printf("Serving mqtt backend at %s", config.Addr)
+	if err := backend.Serve(config, b); err != nil {
+		log.Fatal(err)
+	}
+}
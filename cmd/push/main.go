@@ -0,0 +1,42 @@
+package main
+
+import (
+	"flag"
+	"log"
+
+	"github.com/iampigeon/pigeon"
+	"github.com/iampigeon/pigeon/backend"
+	"github.com/iampigeon/pigeon/backend/push"
+)
+
+func main() {
+	loadConfig := backend.ConfigFromFlags(flag.CommandLine, 9050, pigeon.ServicePigeonPush)
+
+	fcmKey := flag.String("fcm_server_key", "", "FCM server key, enables the fcm provider")
+	fcmURL := flag.String("fcm_url", push.FCMURL, "FCM API base URL")
+	apnsTopic := flag.String("apns_topic", "", "APNs app bundle ID, enables the apns provider")
+	apnsToken := flag.String("apns_auth_token", "", "APNs provider token")
+	apnsURL := flag.String("apns_url", push.APNsURL, "APNs API base URL")
+	flag.Parse()
+
+	config, err := loadConfig()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	providers := make(map[string]push.Provider)
+	if *fcmKey != "" {
+		providers[push.ProviderFCM] = &push.FCM{ServerKey: *fcmKey, BaseURL: *fcmURL}
+	}
+	if *apnsTopic != "" {
+		providers[push.ProviderAPNs] = &push.APNs{Topic: *apnsTopic, AuthToken: *apnsToken, BaseURL: *apnsURL}
+	}
+	if len(providers) == 0 {
+		log.Fatal("no push provider configured")
+	}
+
+	log.Printf("Serving push backend at %s", config.Addr)
+	if err := backend.Serve(config, push.New(providers)); err != nil {
+		log.Fatal(err)
+	}
+}
@@ -1,24 +1,31 @@
 package main
 
 import (
+	"encoding/json"
+	_ "expvar"
 	"flag"
 	"fmt"
 	"log"
 	"net"
 	"net/http"
+	"strings"
 	"time"
 
 	adbHttp "github.com/arangodb/go-driver/http"
+	"github.com/iampigeon/pigeon/connpool"
 	"github.com/iampigeon/pigeon/db"
 	"github.com/iampigeon/pigeon/httpsvc"
 	"github.com/iampigeon/pigeon/proto"
 	"github.com/iampigeon/pigeon/rpc/scheduler"
 	"github.com/iampigeon/pigeon/scheduler"
+	"github.com/iampigeon/pigeon/tlsutil"
 	"google.golang.org/grpc"
 	"google.golang.org/grpc/reflection"
 )
 
 func main() {
+	var err error
+
 	port := flag.Int("port", 9001, "port of the service")
 	host := flag.String("host", "", "host of the service")
 	dbfile := flag.String("db", "messages.db", "file to store messages")
@@ -28,9 +35,93 @@ func main() {
 	redisIdleTimeout := flag.Duration("redis_idle_timeout", 5*time.Second, "Timeout for redis idle connections.")
 	redisDatabase := flag.Int("redis_db", 1, "Redis database to use")
 	redisMaxIdle := flag.Int("redis_max_idle", 10, "Maximum number of idle connections in the pool")
+	memoryQueue := flag.Bool("memory_queue", false, "keep the queue, backend registrations and limits in memory instead of redis, for a single scheduler")
+
+	registryTTL := flag.Duration("registry_ttl", scheduler.DefaultRegistryTTL, "How long a backend registration lasts without heartbeats")
+	instanceID := flag.String("instance_id", "", "identifies the leases of the scheduler among the ones sharing the queue, unique to the process when empty")
+	deadInstanceIDs := flag.String("dead_instance_ids", "", "comma separated instance ids of stopped schedulers whose messages are queued again on start")
+	leaseTTL := flag.Duration("lease_ttl", scheduler.DefaultLeaseTTL, "How long a popped message is leased before another scheduler reclaims it")
+
+	adminAddr := flag.String("admin_addr", "localhost:9002", "address of the admin server exposing /debug/vars and the scheduler admin endpoints")
+	breakerFailures := flag.Int("breaker_failures", scheduler.DefaultBreakerFailures, "consecutive failed calls that open the circuit of a backend")
+	breakerCooldown := flag.Duration("breaker_cooldown", scheduler.DefaultBreakerCooldown, "how long the circuit of a backend stays open before a probe call")
+	limitsJSON := flag.String("limits", "", `json delivery limits keyed by backend address, channel or priority, such as {"sms": {"rate": 10, "max_in_flight": 4}, "priority:bulk": {"max_in_flight": 8}}`)
+
+	unsubscribeSecret := flag.String("unsubscribe_secret", "", "secret signing the unsubscribe links, enables them")
+	ackSecret := flag.String("ack_secret", "", "secret signing the message acknowledgement links, enables them")
+	publicURL := flag.String("public_url", "http://localhost:9000", "public base URL of the http service, used in unsubscribe and ack links")
+
+	tlsCert := flag.String("tls_cert", "", "PEM certificate of the service, enables TLS")
+	tlsKey := flag.String("tls_key", "", "PEM private key of the service certificate")
+	tlsCA := flag.String("tls_ca", "", "PEM bundle to verify clients, enables mutual TLS")
+
+	schedulerTLSCert := flag.String("scheduler_tls_cert", "", "PEM client certificate presented by the http service to the scheduler, -tls_cert when empty")
+	schedulerTLSKey := flag.String("scheduler_tls_key", "", "PEM private key of the scheduler client certificate, -tls_key when empty")
+	schedulerTLSCA := flag.String("scheduler_tls_ca", "", "PEM bundle used by the http service to verify the scheduler, system roots when empty")
+
+	backendTLSCert := flag.String("backend_tls_cert", "", "PEM client certificate presented to backends")
+	backendTLSKey := flag.String("backend_tls_key", "", "PEM private key of the backend client certificate")
+	backendTLSCA := flag.String("backend_tls_ca", "", "PEM bundle to verify backends, enables TLS to backends")
 
 	flag.Parse()
 
+	// ----- Init TLS
+	var serverTLS *tlsutil.Credentials
+	if *tlsCert != "" {
+		serverTLS, err = tlsutil.Load(tlsutil.Config{
+			CertFile:   *tlsCert,
+			KeyFile:    *tlsKey,
+			CAFile:     *tlsCA,
+			ClientAuth: *tlsCA != "",
+		})
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	// the http service connects to the scheduler as a client, its ca
+	// verifies the scheduler certificate instead of the clients.
+	var schedulerTLS *tlsutil.Credentials
+	if serverTLS != nil {
+		certFile, keyFile := *schedulerTLSCert, *schedulerTLSKey
+		if certFile == "" {
+			certFile, keyFile = *tlsCert, *tlsKey
+		}
+		schedulerTLS, err = tlsutil.Load(tlsutil.Config{
+			CertFile: certFile,
+			KeyFile:  keyFile,
+			CAFile:   *schedulerTLSCA,
+		})
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	var backendTLS *tlsutil.Credentials
+	if *backendTLSCA != "" || *backendTLSCert != "" {
+		backendTLS, err = tlsutil.Load(tlsutil.Config{
+			CertFile: *backendTLSCert,
+			KeyFile:  *backendTLSKey,
+			CAFile:   *backendTLSCA,
+		})
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	initialLimits := scheduler.DefaultLimits
+	if *limitsJSON != "" {
+		initialLimits = nil
+		if err := json.Unmarshal([]byte(*limitsJSON), &initialLimits); err != nil {
+			log.Fatalf("invalid limits, %v", err)
+		}
+	}
+	limits := scheduler.NewLimits(initialLimits)
+	breakers := scheduler.NewBreakers(scheduler.BreakerConfig{
+		Failures: *breakerFailures,
+		Cooldown: *breakerCooldown,
+	})
+
 	// ----- Init DB
 	conn, err := adbHttp.NewConnection(adbHttp.ConnectionConfig{
 		Endpoints: []string{*endpoint},
@@ -47,7 +138,13 @@ func main() {
 
 	// ----- Init HTTP
 	// TODO: implements recover
-	httpServer := httpsvc.NewHTTPServer(dst)
+	httpConfig := httpsvc.Config{
+		SchedulerTLS:      schedulerTLS,
+		UnsubscribeSecret: []byte(*unsubscribeSecret),
+		AckSecret:         []byte(*ackSecret),
+		PublicURL:         *publicURL,
+	}
+	httpServer := httpsvc.NewHTTPServer(dst, httpConfig)
 	log.Printf("Running server on: " + httpServer.Addr)
 
 	go func() {
@@ -57,6 +154,16 @@ func main() {
 		}
 	}()
 
+	// ----- Init admin
+	// expvar registers /debug/vars on the default mux.
+	http.Handle("/debug/scheduler/limits", limits)
+	http.Handle("/debug/scheduler/breakers", breakers)
+	go func() {
+		if err := http.ListenAndServe(*adminAddr, nil); err != nil {
+			log.Println(err)
+		}
+	}()
+
 	addr := fmt.Sprintf("%s:%d", *host, *port)
 	lis, err := net.Listen("tcp", addr)
 	if err != nil {
@@ -69,16 +176,36 @@ func main() {
 		log.Fatal(err)
 	}
 
+	digests, err := httpsvc.NewDigestRenderer(dst, httpConfig)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	var queue scheduler.Queue
+	if *memoryQueue {
+		queue = scheduler.NewMemoryQueue(*leaseTTL)
+	}
+
 	// ----- Init grpc
-	s := grpc.NewServer()
+	opts := append(serverTLS.ServerOptions(), connpool.ServerOption())
+	s := grpc.NewServer(opts...)
 	log.Printf("Starting server at %s redis_url: %s redis_db: %d database: %s\n", addr, *redisURL, *redisDatabase, *dbfile)
 	proto.RegisterSchedulerServiceServer(s, schedulersvc.New(scheduler.StorageConfig{
 		// BoltDatabase:     *dbfile,
 		MessageStore:     ms,
 		RedisURL:         *redisURL,
+		Queue:            queue,
 		RedisIdleTimeout: *redisIdleTimeout,
 		RedisDatabase:    *redisDatabase,
 		RedisMaxIdle:     *redisMaxIdle,
+		BackendTLS:       backendTLS,
+		RegistryTTL:      *registryTTL,
+		LeaseTTL:         *leaseTTL,
+		InstanceID:       *instanceID,
+		DeadInstanceIDs:  splitList(*deadInstanceIDs),
+		Digests:          digests,
+		Limits:           limits,
+		Breakers:         breakers,
 	}))
 
 	reflection.Register(s)
@@ -86,3 +213,14 @@ func main() {
 		log.Fatal(err)
 	}
 }
+
+// splitList returns the comma separated items of s, none when empty.
+func splitList(s string) []string {
+	var items []string
+	for _, item := range strings.Split(s, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
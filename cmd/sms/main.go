@@ -0,0 +1,57 @@
+package main
+
+import (
+	"flag"
+	"log"
+
+	"github.com/iampigeon/pigeon"
+	"github.com/iampigeon/pigeon/backend"
+	"github.com/iampigeon/pigeon/backend/sms"
+)
+
+func main() {
+	loadConfig := backend.ConfigFromFlags(flag.CommandLine, 9040, pigeon.ServicePigeonSMS)
+
+	driver := flag.String("driver", "simulator", "provider driver: simulator or twilio")
+	senderID := flag.String("sender_id", "", "default sender ID")
+	maxSegments := flag.Int("max_segments", sms.DefaultMaxSegments, "maximum number of segments of a message")
+	simulatorDir := flag.String("simulator_dir", "sms", "directory where the simulator records messages")
+	twilioSID := flag.String("twilio_account_sid", "", "Twilio account SID")
+	twilioToken := flag.String("twilio_auth_token", "", "Twilio auth token")
+	twilioURL := flag.String("twilio_url", sms.TwilioURL, "Twilio API base URL")
+	flag.Parse()
+
+	config, err := loadConfig()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	var d sms.Driver
+	switch *driver {
+	case "simulator":
+		s, err := sms.NewSimulator(*simulatorDir)
+		if err != nil {
+			log.Fatal(err)
+		}
+		d = s
+	case "twilio":
+		d = &sms.Twilio{
+			AccountSID: *twilioSID,
+			AuthToken:  *twilioToken,
+			BaseURL:    *twilioURL,
+		}
+	default:
+		log.Fatalf("unknown sms driver %s", *driver)
+	}
+
+	b := sms.New(sms.Config{
+		Driver:      d,
+		SenderID:    *senderID,
+		MaxSegments: *maxSegments,
+	})
+
+	log.Printf("Serving sms backend at %s with %s driver", config.Addr, *driver)
+	if err := backend.Serve(config, b); err != nil {
+		log.Fatal(err)
+	}
+}
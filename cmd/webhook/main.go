@@ -0,0 +1,33 @@
+package main
+
+import (
+	"flag"
+	"log"
+
+	"github.com/iampigeon/pigeon"
+	"github.com/iampigeon/pigeon/backend"
+	"github.com/iampigeon/pigeon/backend/webhook"
+)
+
+func main() {
+	loadConfig := backend.ConfigFromFlags(flag.CommandLine, 9020, pigeon.ServicePigeonHTTP)
+
+	maxBodySize := flag.Int("max_body_size", webhook.DefaultMaxBodySize, "maximum size of a request body in bytes")
+	disableRetries := flag.Bool("disable_retries", false, "fail the requests with a network error, 429 or 5xx response instead of having the scheduler retry them")
+	flag.Parse()
+
+	config, err := loadConfig()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	b := webhook.New(webhook.Config{
+		MaxBodySize:    *maxBodySize,
+		DisableRetries: *disableRetries,
+	})
+
+	log.Printf("Serving webhook backend at %s", config.Addr)
+	if err := backend.Serve(config, b); err != nil {
+		log.Fatal(err)
+	}
+}
@@ -0,0 +1,251 @@
+/*
+Package connpool shares long-lived grpc connections keyed by network address.
+
+Connections are dialed lazily on first use and kept open with keepalives.
+Connections that stay in a failure state longer than Config.EvictAfter are
+closed and dialed again on the next use, the evicted connection is closed
+once the RPCs in flight had Config.CloseGrace to finish. The counters of
+each pool are published through expvar under "connpool." followed by its
+Config.Name.
+*/
+package connpool
+
+import (
+	"expvar"
+	"sync"
+	"time"
+
+	"github.com/iampigeon/pigeon"
+	"github.com/iampigeon/pigeon/tlsutil"
+	"github.com/pkg/errors"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/connectivity"
+	"google.golang.org/grpc/keepalive"
+)
+
+const (
+	// DefaultKeepaliveTime is the interval between keepalive pings.
+	DefaultKeepaliveTime = time.Minute
+	// DefaultKeepaliveTimeout is how long to wait for a ping ack.
+	DefaultKeepaliveTimeout = 20 * time.Second
+	// DefaultEvictAfter is how long a connection can fail before eviction.
+	DefaultEvictAfter = 30 * time.Second
+	// DefaultCheckInterval is how often connection health is checked.
+	DefaultCheckInterval = 5 * time.Second
+	// DefaultCloseGrace is how long an evicted connection stays open for
+	// the RPCs in flight.
+	DefaultCloseGrace = 2 * time.Minute
+)
+
+// ErrClosed is returned by Get after Close.
+var ErrClosed = errors.New("connpool: pool closed")
+
+// Config configures a Pool. Zero durations use the package defaults.
+type Config struct {
+	// Name publishes the counters of the pool as "connpool.<Name>", they
+	// are not published when empty. Each pool must have its own name.
+	Name string
+
+	// TLS secures the connections, plain text is used when nil.
+	TLS *tlsutil.Credentials
+
+	KeepaliveTime    time.Duration
+	KeepaliveTimeout time.Duration
+	EvictAfter       time.Duration
+	CheckInterval    time.Duration
+	CloseGrace       time.Duration
+}
+
+// Pool is a set of grpc connections keyed by network address. It is safe
+// for concurrent use.
+type Pool struct {
+	config  Config
+	metrics *expvar.Map
+
+	mu    sync.Mutex
+	conns map[pigeon.NetAddr]*entry
+	done  chan struct{}
+}
+
+type entry struct {
+	conn *grpc.ClientConn
+
+	// failingSince is the first check that saw the connection failing, zero
+	// while it is healthy.
+	failingSince time.Time
+}
+
+// New returns a pool and starts its health checks.
+func New(config Config) *Pool {
+	if config.KeepaliveTime == 0 {
+		config.KeepaliveTime = DefaultKeepaliveTime
+	}
+	if config.KeepaliveTimeout == 0 {
+		config.KeepaliveTimeout = DefaultKeepaliveTimeout
+	}
+	if config.EvictAfter == 0 {
+		config.EvictAfter = DefaultEvictAfter
+	}
+	if config.CheckInterval == 0 {
+		config.CheckInterval = DefaultCheckInterval
+	}
+	if config.CloseGrace == 0 {
+		config.CloseGrace = DefaultCloseGrace
+	}
+
+	metrics := new(expvar.Map).Init()
+	if config.Name != "" {
+		expvar.Publish("connpool."+config.Name, metrics)
+	}
+
+	p := &Pool{
+		config:  config,
+		metrics: metrics,
+		conns:   make(map[pigeon.NetAddr]*entry),
+		done:    make(chan struct{}),
+	}
+
+	go p.run()
+
+	return p
+}
+
+// Get returns the connection to addr, dialing it if needed. The connection
+// is owned by the pool and must not be closed by the caller.
+func (p *Pool) Get(addr pigeon.NetAddr) (*grpc.ClientConn, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.conns == nil {
+		return nil, ErrClosed
+	}
+
+	if e, ok := p.conns[addr]; ok {
+		p.metrics.Add("hits", 1)
+		return e.conn, nil
+	}
+
+	creds, err := p.config.TLS.DialOption(addr)
+	if err != nil {
+		return nil, err
+	}
+
+	conn, err := grpc.Dial(string(addr), creds, grpc.WithKeepaliveParams(keepalive.ClientParameters{
+		Time:                p.config.KeepaliveTime,
+		Timeout:             p.config.KeepaliveTimeout,
+		PermitWithoutStream: true,
+	}))
+	if err != nil {
+		p.metrics.Add("dial_errors", 1)
+		return nil, err
+	}
+
+	p.conns[addr] = &entry{conn: conn}
+	p.metrics.Add("dials", 1)
+	p.metrics.Add("open", 1)
+
+	return conn, nil
+}
+
+// Failing reports whether the connection to addr is currently failing. An
+// address without a connection is not failing.
+func (p *Pool) Failing(addr pigeon.NetAddr) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	e, ok := p.conns[addr]
+	if !ok {
+		return false
+	}
+	return e.conn.GetState() == connectivity.TransientFailure
+}
+
+// Evict closes the connection to addr so the next Get dials it again.
+func (p *Pool) Evict(addr pigeon.NetAddr) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.evict(addr)
+}
+
+// Close closes every connection and stops the health checks.
+func (p *Pool) Close() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.conns == nil {
+		return ErrClosed
+	}
+
+	for addr, e := range p.conns {
+		e.conn.Close()
+		delete(p.conns, addr)
+		p.metrics.Add("open", -1)
+	}
+	p.conns = nil
+	close(p.done)
+
+	return nil
+}
+
+// evict must be called with p.mu held. The connection may still be used by
+// RPCs in flight, it is closed after the close grace.
+func (p *Pool) evict(addr pigeon.NetAddr) {
+	e, ok := p.conns[addr]
+	if !ok {
+		return
+	}
+
+	time.AfterFunc(p.config.CloseGrace, func() {
+		e.conn.Close()
+	})
+	delete(p.conns, addr)
+	p.metrics.Add("evictions", 1)
+	p.metrics.Add("open", -1)
+}
+
+func (p *Pool) run() {
+	ticker := time.NewTicker(p.config.CheckInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			p.check(time.Now())
+		case <-p.done:
+			return
+		}
+	}
+}
+
+// check evicts connections that were shut down or have been failing for
+// longer than the configured limit.
+func (p *Pool) check(now time.Time) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	for addr, e := range p.conns {
+		switch e.conn.GetState() {
+		case connectivity.Shutdown:
+			p.evict(addr)
+		case connectivity.TransientFailure:
+			if e.failingSince.IsZero() {
+				e.failingSince = now
+			}
+			if now.Sub(e.failingSince) >= p.config.EvictAfter {
+				p.evict(addr)
+			}
+		default:
+			e.failingSince = time.Time{}
+		}
+	}
+}
+
+// ServerOption returns the keepalive policy that servers must use to accept
+// the pings sent by pooled connections.
+func ServerOption() grpc.ServerOption {
+	return grpc.KeepaliveEnforcementPolicy(keepalive.EnforcementPolicy{
+		MinTime:             DefaultKeepaliveTime / 2,
+		PermitWithoutStream: true,
+	})
+}
@@ -0,0 +1,67 @@
+package connpool
+
+import (
+	"expvar"
+	"testing"
+	"time"
+
+	"google.golang.org/grpc/connectivity"
+)
+
+func TestEvictClosesAfterGrace(t *testing.T) {
+	p := New(Config{CloseGrace: 50 * time.Millisecond})
+	defer p.Close()
+
+	conn, err := p.Get("localhost:1")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	p.Evict("localhost:1")
+	if conn.GetState() == connectivity.Shutdown {
+		t.Fatal("evicted connection closed before its grace")
+	}
+
+	again, err := p.Get("localhost:1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if again == conn {
+		t.Fatal("evicted connection returned again")
+	}
+
+	deadline := time.Now().Add(time.Second)
+	for conn.GetState() != connectivity.Shutdown {
+		if time.Now().After(deadline) {
+			t.Fatal("evicted connection not closed after its grace")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestMetricsPerPool(t *testing.T) {
+	a := New(Config{Name: "test_a"})
+	defer a.Close()
+	b := New(Config{Name: "test_b"})
+	defer b.Close()
+
+	if _, err := a.Get("localhost:1"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := a.Get("localhost:1"); err != nil {
+		t.Fatal(err)
+	}
+
+	ma := expvar.Get("connpool.test_a").(*expvar.Map)
+	mb := expvar.Get("connpool.test_b").(*expvar.Map)
+
+	if v := ma.Get("dials"); v == nil || v.String() != "1" {
+		t.Errorf("dials of a = %v, want 1", v)
+	}
+	if v := ma.Get("hits"); v == nil || v.String() != "1" {
+		t.Errorf("hits of a = %v, want 1", v)
+	}
+	if v := mb.Get("dials"); v != nil {
+		t.Errorf("dials of b = %v, want none", v)
+	}
+}
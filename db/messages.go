@@ -2,8 +2,11 @@ package db
 
 import (
 	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
+	"time"
 
 	"github.com/iampigeon/pigeon"
 	"github.com/oklog/ulid"
@@ -16,6 +19,9 @@ const (
 	msgCollection = "message_collection"
 )
 
+// ErrMessageNotFound ...
+var ErrMessageNotFound = errors.New("message not found")
+
 // MessageStore ...
 type MessageStore struct {
 	Dst        *Datastore
@@ -65,6 +71,22 @@ func (ss *MessageStore) AddMessage(m pigeon.Message) error {
 		"status":     string(m.Status),
 		"subject_id": string(m.SubjectID),
 		"user_id":    m.UserID,
+		"channel":    m.Channel,
+		"window":     m.Window,
+		"chain_id":   m.ChainID,
+		"chain_step": m.ChainStep,
+		"events":     []map[string]interface{}{newEvent(m.Status, pigeon.SourceScheduler, "")},
+		"digest_id":  m.DigestID,
+		"digest":     m.Digest,
+		"priority":   m.Priority,
+		"expires_at": toMillis(m.ExpiresAt),
+	}
+	if m.Variables != nil {
+		variables, err := json.Marshal(m.Variables)
+		if err != nil {
+			return err
+		}
+		msg["variables"] = variables
 	}
 
 	_, err := ss.Collection.CreateDocument(ctx, msg)
@@ -104,6 +126,19 @@ func (ss *MessageStore) GetMessage(id ulid.ULID, u *pigeon.User) (*pigeon.Messag
 		Endpoint:  pigeon.NetAddr(msg.Endpoint),
 		Status:    pigeon.MessageStatus(msg.Status),
 		SubjectID: msg.SubjectId,
+		UserID:    msg.UserId,
+		Channel:   msg.Channel,
+
+		InvalidRecipients: msg.InvalidRecipients,
+		Attempts:          int(msg.Attempts),
+		Window:            windowFromProto(msg.Window),
+		ChainID:           msg.ChainId,
+		ChainStep:         int(msg.ChainStep),
+		Events:            eventsFromProto(msg.Events),
+		DigestID:          msg.DigestId,
+		Digest:            digestFromProto(msg.Digest),
+		Priority:          msg.Priority,
+		ExpiresAt:         fromMillis(msg.ExpiresAt),
 	}, nil
 }
 
@@ -135,20 +170,36 @@ func (ss *MessageStore) GetMessageByID(id ulid.ULID) (*pigeon.Message, error) {
 		Endpoint:  pigeon.NetAddr(msg.Endpoint),
 		Status:    pigeon.MessageStatus(msg.Status),
 		SubjectID: msg.SubjectId,
+		UserID:    msg.UserId,
+		Channel:   msg.Channel,
+
+		InvalidRecipients: msg.InvalidRecipients,
+		Attempts:          int(msg.Attempts),
+		Window:            windowFromProto(msg.Window),
+		ChainID:           msg.ChainId,
+		ChainStep:         int(msg.ChainStep),
+		Events:            eventsFromProto(msg.Events),
+		DigestID:          msg.DigestId,
+		Digest:            digestFromProto(msg.Digest),
+		Priority:          msg.Priority,
+		ExpiresAt:         fromMillis(msg.ExpiresAt),
 	}, nil
 }
 
 // UpdateContent ...
 func (ss *MessageStore) UpdateContent(id ulid.ULID, content []byte) error {
-	query := fmt.Sprintf(`
+	query := `
 	FOR msg IN message_collection
-	FILTER msg.id == '%s'
-	UPDATE msg WITH { _key: msg._key,  content: '%s' }
+	FILTER msg.id == @id
+	UPDATE msg WITH { _key: msg._key, content: @content }
 	IN message_collection
-	`, id.String(), content)
-	fmt.Println(query)
+	`
 
-	_, err := ss.Collection.Database().Query(*ss.Dst.Context, query, nil)
+	// the content is encoded like in AddMessage.
+	_, err := ss.Collection.Database().Query(*ss.Dst.Context, query, map[string]interface{}{
+		"id":      id.String(),
+		"content": content,
+	})
 	if err != nil {
 		return err
 	}
@@ -157,18 +208,346 @@ func (ss *MessageStore) UpdateContent(id ulid.ULID, content []byte) error {
 }
 
 // UpdateStatus ...
+//
+// A receipt reported while the message was being sent is kept, the sent
+// status does not replace it.
 func (ss *MessageStore) UpdateStatus(id ulid.ULID, status pigeon.MessageStatus) error {
-	query := fmt.Sprintf(`
+	query := `
 	FOR msg IN message_collection
-	FILTER msg.id == '%s'
-	UPDATE msg WITH { _key: msg._key,  status: '%s' }
+	FILTER msg.id == @id
+	UPDATE msg WITH {
+		_key: msg._key,
+		status: POSITION(@keep, msg.status) ? msg.status : @status,
+		events: PUSH(msg.events || [], @event)
+	}
 	IN message_collection
-	`, id.String(), string(status))
+	`
+
+	keep := []string{}
+	if status == pigeon.StatusSent {
+		keep = []string{string(pigeon.StatusDelivered), string(pigeon.StatusRead), string(pigeon.StatusAcknowledged)}
+	}
 
-	_, err := ss.Collection.Database().Query(*ss.Dst.Context, query, nil)
+	_, err := ss.Collection.Database().Query(*ss.Dst.Context, query, map[string]interface{}{
+		"id":     id.String(),
+		"status": string(status),
+		"keep":   keep,
+		"event":  newEvent(status, pigeon.SourceScheduler, ""),
+	})
 	if err != nil {
 		return err
 	}
 
 	return nil
 }
+
+// AddReceipt adds a receipt to the history of a message, and sets its status
+// when the receipt moves the message forward.
+func (ss *MessageStore) AddReceipt(id ulid.ULID, status pigeon.MessageStatus, source, detail string) error {
+	query := `
+	FOR msg IN message_collection
+	FILTER msg.id == @id
+	UPDATE msg WITH {
+		_key: msg._key,
+		status: POSITION(@replaces, msg.status) ? @status : msg.status,
+		events: PUSH(msg.events || [], @event)
+	}
+	IN message_collection
+	RETURN NEW
+	`
+
+	var replaces []string
+	for _, s := range status.Replaces() {
+		replaces = append(replaces, string(s))
+	}
+
+	cursor, err := ss.Collection.Database().Query(*ss.Dst.Context, query, map[string]interface{}{
+		"id":       id.String(),
+		"status":   string(status),
+		"replaces": replaces,
+		"event":    newEvent(status, source, detail),
+	})
+	if err != nil {
+		return err
+	}
+	defer cursor.Close()
+
+	if !cursor.HasMore() {
+		return ErrMessageNotFound
+	}
+
+	return nil
+}
+
+// UpdateInvalidRecipients ...
+func (ss *MessageStore) UpdateInvalidRecipients(id ulid.ULID, recipients []string) error {
+	query := `
+	FOR msg IN message_collection
+	FILTER msg.id == @id
+	UPDATE msg WITH { _key: msg._key, invalid_recipients: @recipients }
+	IN message_collection
+	`
+
+	_, err := ss.Collection.Database().Query(*ss.Dst.Context, query, map[string]interface{}{
+		"id":         id.String(),
+		"recipients": recipients,
+	})
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// UpdateAttempts ...
+func (ss *MessageStore) UpdateAttempts(id ulid.ULID, attempts int) error {
+	query := `
+	FOR msg IN message_collection
+	FILTER msg.id == @id
+	UPDATE msg WITH { _key: msg._key, attempts: @attempts }
+	IN message_collection
+	`
+
+	_, err := ss.Collection.Database().Query(*ss.Dst.Context, query, map[string]interface{}{
+		"id":       id.String(),
+		"attempts": attempts,
+	})
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// GetChain returns the messages of an escalation chain sorted by step.
+func (ss *MessageStore) GetChain(chainID string) ([]*pigeon.Message, error) {
+	query := `
+	FOR m IN message_collection
+	FILTER m.chain_id == @chain_id
+	SORT m.chain_step
+	RETURN m
+	`
+
+	cursor, err := ss.Collection.Database().Query(*ss.Dst.Context, query, map[string]interface{}{
+		"chain_id": chainID,
+	})
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close()
+
+	chain := make([]*pigeon.Message, 0)
+	for cursor.HasMore() {
+		var msg pb.Message
+		if _, err := cursor.ReadDocument(*ss.Dst.Context, &msg); err != nil {
+			return nil, err
+		}
+
+		id, err := ulid.Parse(msg.Id)
+		if err != nil {
+			return nil, err
+		}
+
+		chain = append(chain, &pigeon.Message{
+			ID:        id,
+			Endpoint:  pigeon.NetAddr(msg.Endpoint),
+			Status:    pigeon.MessageStatus(msg.Status),
+			SubjectID: msg.SubjectId,
+			UserID:    msg.UserId,
+			Channel:   msg.Channel,
+			ChainID:   msg.ChainId,
+			ChainStep: int(msg.ChainStep),
+			Priority:  msg.Priority,
+		})
+	}
+
+	return chain, nil
+}
+
+// AddDigest stores the digest message m unless it exists, and returns the
+// status of the stored digest.
+func (ss *MessageStore) AddDigest(m pigeon.Message) (pigeon.MessageStatus, error) {
+	query := `
+	UPSERT { id: @id }
+	INSERT @msg
+	UPDATE {}
+	IN message_collection
+	RETURN NEW.status
+	`
+
+	cursor, err := ss.Collection.Database().Query(*ss.Dst.Context, query, map[string]interface{}{
+		"id": m.ID.String(),
+		"msg": map[string]interface{}{
+			"id":         m.ID.String(),
+			"endpoint":   string(m.Endpoint),
+			"status":     string(m.Status),
+			"subject_id": m.SubjectID,
+			"user_id":    m.UserID,
+			"channel":    m.Channel,
+			"window":     m.Window,
+			"digest":     m.Digest,
+			"priority":   m.Priority,
+			"events":     []map[string]interface{}{newEvent(m.Status, pigeon.SourceScheduler, "")},
+		},
+	})
+	if err != nil {
+		return "", err
+	}
+	defer cursor.Close()
+
+	var status string
+	if _, err := cursor.ReadDocument(*ss.Dst.Context, &status); err != nil {
+		return "", err
+	}
+
+	return pigeon.MessageStatus(status), nil
+}
+
+// GetDigestMessages returns the pending messages accumulated in a digest.
+func (ss *MessageStore) GetDigestMessages(digestID ulid.ULID) ([]*pigeon.Message, error) {
+	query := `
+	FOR m IN message_collection
+	FILTER m.digest_id == @digest_id
+	FILTER m.status == @status
+	SORT m.id
+	RETURN m
+	`
+
+	cursor, err := ss.Collection.Database().Query(*ss.Dst.Context, query, map[string]interface{}{
+		"digest_id": digestID.String(),
+		"status":    pigeon.StatusPending,
+	})
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close()
+
+	messages := make([]*pigeon.Message, 0)
+	for cursor.HasMore() {
+		var msg pb.Message
+		if _, err := cursor.ReadDocument(*ss.Dst.Context, &msg); err != nil {
+			return nil, err
+		}
+
+		id, err := ulid.Parse(msg.Id)
+		if err != nil {
+			return nil, err
+		}
+
+		m := &pigeon.Message{
+			ID:        id,
+			Content:   msg.Content,
+			Status:    pigeon.MessageStatus(msg.Status),
+			SubjectID: msg.SubjectId,
+			UserID:    msg.UserId,
+			Channel:   msg.Channel,
+			DigestID:  msg.DigestId,
+			ExpiresAt: fromMillis(msg.ExpiresAt),
+		}
+		if len(msg.Variables) > 0 {
+			if err := json.Unmarshal(msg.Variables, &m.Variables); err != nil {
+				return nil, err
+			}
+		}
+
+		messages = append(messages, m)
+	}
+
+	return messages, nil
+}
+
+// MergeDigest sets the status of the messages accumulated in a digest to
+// merged.
+func (ss *MessageStore) MergeDigest(digestID ulid.ULID, ids []ulid.ULID) error {
+	query := `
+	FOR msg IN message_collection
+	FILTER msg.id IN @ids
+	FILTER msg.digest_id == @digest_id
+	UPDATE msg WITH { _key: msg._key, status: @status, events: PUSH(msg.events || [], @event) }
+	IN message_collection
+	`
+
+	keys := make([]string, 0, len(ids))
+	for _, id := range ids {
+		keys = append(keys, id.String())
+	}
+
+	_, err := ss.Collection.Database().Query(*ss.Dst.Context, query, map[string]interface{}{
+		"ids":       keys,
+		"digest_id": digestID.String(),
+		"status":    pigeon.StatusMerged,
+		"event":     newEvent(pigeon.StatusMerged, pigeon.SourceScheduler, digestID.String()),
+	})
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// newEvent returns the document of an event, with the time in unix
+// milliseconds like the proto message.
+func newEvent(status pigeon.MessageStatus, source, detail string) map[string]interface{} {
+	return map[string]interface{}{
+		"status": string(status),
+		"time":   time.Now().UnixNano() / int64(time.Millisecond),
+		"source": source,
+		"detail": detail,
+	}
+}
+
+// toMillis returns t in unix milliseconds like the proto messages, zero
+// when nil.
+func toMillis(t *time.Time) int64 {
+	if t == nil {
+		return 0
+	}
+	return t.UnixNano() / int64(time.Millisecond)
+}
+
+// fromMillis returns the time of unix milliseconds, nil when zero.
+func fromMillis(ms int64) *time.Time {
+	if ms == 0 {
+		return nil
+	}
+	t := time.Unix(0, ms*int64(time.Millisecond))
+	return &t
+}
+
+func eventsFromProto(events []*pb.Event) []*pigeon.Event {
+	var result []*pigeon.Event
+	for _, e := range events {
+		result = append(result, &pigeon.Event{
+			Status: pigeon.MessageStatus(e.Status),
+			Time:   time.Unix(0, e.Time*int64(time.Millisecond)),
+			Source: e.Source,
+			Detail: e.Detail,
+		})
+	}
+	return result
+}
+
+func digestFromProto(d *pb.MessageDigest) *pigeon.MessageDigest {
+	if d == nil {
+		return nil
+	}
+
+	return &pigeon.MessageDigest{
+		SubjectChannelID: d.SubjectChannelId,
+		RecipientID:      d.RecipientId,
+		Locale:           d.Locale,
+	}
+}
+
+func windowFromProto(w *pb.DeliveryWindow) *pigeon.DeliveryWindow {
+	if w == nil {
+		return nil
+	}
+
+	return &pigeon.DeliveryWindow{
+		Days:     w.Days,
+		Start:    w.Start,
+		End:      w.End,
+		Timezone: w.Timezone,
+	}
+}
@@ -0,0 +1,215 @@
+package db
+
+import (
+	"errors"
+
+	"github.com/iampigeon/pigeon"
+
+	arango "github.com/arangodb/go-driver"
+)
+
+const (
+	recipientCollection = "recipient_collection"
+)
+
+// ErrRecipientNotFound is returned when a user has no recipient with the
+// given id.
+var ErrRecipientNotFound = errors.New("recipient not found")
+
+// RecipientStore ...
+type RecipientStore struct {
+	Dst        *Datastore
+	Collection arango.Collection
+}
+
+// NewRecipientStore ...
+func NewRecipientStore(dst *Datastore) (*RecipientStore, error) {
+	found, err := dst.PigeonDB.CollectionExists(*dst.Context, recipientCollection)
+	if err != nil {
+		return nil, err
+	}
+
+	var col arango.Collection
+
+	if !found {
+		opt := new(arango.CreateCollectionOptions)
+		col, err = dst.PigeonDB.CreateCollection(*dst.Context, recipientCollection, opt)
+		if err != nil {
+			return nil, err
+		}
+	} else {
+		col, err = dst.PigeonDB.Collection(*dst.Context, recipientCollection)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return &RecipientStore{
+		Dst:        dst,
+		Collection: col,
+	}, nil
+}
+
+// AddRecipient ...
+func (rs *RecipientStore) AddRecipient(r *pigeon.Recipient) error {
+	_, err := rs.Collection.CreateDocument(*rs.Dst.Context, r)
+	return err
+}
+
+// UpdateRecipient replaces the name, locale, timezone, contact points and
+// preferences of r.
+func (rs *RecipientStore) UpdateRecipient(r *pigeon.Recipient) error {
+	query := `
+	FOR r IN recipient_collection
+	FILTER r.id == @id
+	FILTER r.user_id == @user_id
+	UPDATE r WITH { name: @name, locale: @locale, timezone: @timezone, contact_points: @contact_points, preferences: @preferences }
+	IN recipient_collection
+	OPTIONS { mergeObjects: false }
+	RETURN NEW
+	`
+
+	cursor, err := rs.Collection.Database().Query(*rs.Dst.Context, query, map[string]interface{}{
+		"id":             r.ID,
+		"user_id":        r.UserID,
+		"name":           r.Name,
+		"locale":         r.Locale,
+		"timezone":       r.Timezone,
+		"contact_points": r.ContactPoints,
+		"preferences":    r.Preferences,
+	})
+	if err != nil {
+		return err
+	}
+	defer cursor.Close()
+
+	if _, err := cursor.ReadDocument(*rs.Dst.Context, r); err != nil {
+		if arango.IsNoMoreDocuments(err) {
+			return ErrRecipientNotFound
+		}
+		return err
+	}
+
+	return nil
+}
+
+// SetPreference replaces the preference of a recipient for the subject and
+// channel of p.
+func (rs *RecipientStore) SetPreference(userID, id string, p *pigeon.Preference) error {
+	query := `
+	FOR r IN recipient_collection
+	FILTER r.id == @id
+	FILTER r.user_id == @user_id
+	LET others = (
+		FOR p IN r.preferences || []
+		FILTER (p.subject || "") != @subject OR (p.channel || "") != @channel
+		RETURN p
+	)
+	UPDATE r WITH { preferences: APPEND(others, [@preference]) }
+	IN recipient_collection
+	OPTIONS { mergeObjects: false }
+	RETURN NEW
+	`
+
+	cursor, err := rs.Collection.Database().Query(*rs.Dst.Context, query, map[string]interface{}{
+		"id":         id,
+		"user_id":    userID,
+		"subject":    p.Subject,
+		"channel":    p.Channel,
+		"preference": p,
+	})
+	if err != nil {
+		return err
+	}
+	defer cursor.Close()
+
+	if !cursor.HasMore() {
+		return ErrRecipientNotFound
+	}
+
+	return nil
+}
+
+// DeleteRecipient ...
+func (rs *RecipientStore) DeleteRecipient(userID, id string) error {
+	query := `
+	FOR r IN recipient_collection
+	FILTER r.id == @id
+	FILTER r.user_id == @user_id
+	REMOVE r IN recipient_collection
+	RETURN OLD
+	`
+
+	cursor, err := rs.Collection.Database().Query(*rs.Dst.Context, query, map[string]interface{}{
+		"id":      id,
+		"user_id": userID,
+	})
+	if err != nil {
+		return err
+	}
+	defer cursor.Close()
+
+	if !cursor.HasMore() {
+		return ErrRecipientNotFound
+	}
+
+	return nil
+}
+
+// GetRecipient ...
+func (rs *RecipientStore) GetRecipient(userID, id string) (*pigeon.Recipient, error) {
+	query := `
+	FOR r IN recipient_collection
+	FILTER r.id == @id
+	FILTER r.user_id == @user_id
+	RETURN r
+	`
+
+	cursor, err := rs.Collection.Database().Query(*rs.Dst.Context, query, map[string]interface{}{
+		"id":      id,
+		"user_id": userID,
+	})
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close()
+
+	r := new(pigeon.Recipient)
+	if _, err := cursor.ReadDocument(*rs.Dst.Context, r); err != nil {
+		if arango.IsNoMoreDocuments(err) {
+			return nil, ErrRecipientNotFound
+		}
+		return nil, err
+	}
+
+	return r, nil
+}
+
+// GetRecipientsByUserID ...
+func (rs *RecipientStore) GetRecipientsByUserID(userID string) ([]*pigeon.Recipient, error) {
+	query := `
+	FOR r IN recipient_collection
+	FILTER r.user_id == @user_id
+	SORT r.id
+	RETURN r
+	`
+
+	cursor, err := rs.Collection.Database().Query(*rs.Dst.Context, query, map[string]interface{}{
+		"user_id": userID,
+	})
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close()
+
+	recipients := make([]*pigeon.Recipient, 0)
+	for cursor.HasMore() {
+		r := new(pigeon.Recipient)
+		if _, err := cursor.ReadDocument(*rs.Dst.Context, r); err != nil {
+			return nil, err
+		}
+		recipients = append(recipients, r)
+	}
+
+	return recipients, nil
+}
@@ -0,0 +1,108 @@
+package db
+
+import (
+	"errors"
+
+	"github.com/iampigeon/pigeon"
+
+	arango "github.com/arangodb/go-driver"
+)
+
+const (
+	templateCollection = "template_collection"
+)
+
+// ErrTemplateNotFound is returned when a subject channel has no template.
+var ErrTemplateNotFound = errors.New("template not found")
+
+// TemplateStore ...
+type TemplateStore struct {
+	Dst        *Datastore
+	Collection arango.Collection
+}
+
+// NewTemplateStore ...
+func NewTemplateStore(dst *Datastore) (*TemplateStore, error) {
+	found, err := dst.PigeonDB.CollectionExists(*dst.Context, templateCollection)
+	if err != nil {
+		return nil, err
+	}
+
+	var col arango.Collection
+
+	if !found {
+		opt := new(arango.CreateCollectionOptions)
+		col, err = dst.PigeonDB.CreateCollection(*dst.Context, templateCollection, opt)
+		if err != nil {
+			return nil, err
+		}
+	} else {
+		col, err = dst.PigeonDB.Collection(*dst.Context, templateCollection)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return &TemplateStore{
+		Dst:        dst,
+		Collection: col,
+	}, nil
+}
+
+// SaveTemplate creates or replaces the template of a subject channel.
+func (ts *TemplateStore) SaveTemplate(t *pigeon.Template) error {
+	query := `
+	UPSERT { user_id: @user_id, subject_channel_id: @subject_channel_id }
+	INSERT { id: @id, user_id: @user_id, subject_channel_id: @subject_channel_id, fields: @fields, locales: @locales, digest: @digest, json: @json }
+	UPDATE { fields: @fields, locales: @locales, digest: @digest, json: @json }
+	IN template_collection
+	RETURN NEW
+	`
+
+	cursor, err := ts.Collection.Database().Query(*ts.Dst.Context, query, map[string]interface{}{
+		"id":                 t.ID,
+		"user_id":            t.UserID,
+		"subject_channel_id": t.SubjectChannelID,
+		"fields":             t.Fields,
+		"locales":            t.Locales,
+		"digest":             t.Digest,
+		"json":               t.JSON,
+	})
+	if err != nil {
+		return err
+	}
+	defer cursor.Close()
+
+	// keep the id of a replaced template.
+	_, err = cursor.ReadDocument(*ts.Dst.Context, t)
+	return err
+}
+
+// GetTemplate ...
+func (ts *TemplateStore) GetTemplate(userID, subjectChannelID string) (*pigeon.Template, error) {
+	query := `
+	FOR t IN template_collection
+	FILTER t.user_id == @user_id
+	FILTER t.subject_channel_id == @subject_channel_id
+	RETURN t
+	`
+
+	cursor, err := ts.Collection.Database().Query(*ts.Dst.Context, query, map[string]interface{}{
+		"user_id":            userID,
+		"subject_channel_id": subjectChannelID,
+	})
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close()
+
+	t := new(pigeon.Template)
+	if _, err := cursor.ReadDocument(*ts.Dst.Context, t); err != nil {
+		if arango.IsNoMoreDocuments(err) {
+			return nil, ErrTemplateNotFound
+		}
+		return nil, err
+	}
+
+	return t, nil
+}
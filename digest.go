@@ -0,0 +1,89 @@
+package pigeon
+
+import (
+	"fmt"
+	"time"
+)
+
+// Windows of a Digest.
+const (
+	DigestHourly = "hourly"
+	DigestDaily  = "daily"
+)
+
+// Digest coalesces the messages of a subject channel sent to a recipient
+// within a window into one message, sent when the window closes and
+// rendered from the digest fields of the template of the subject channel.
+type Digest struct {
+	// Window is hourly or daily.
+	Window string `json:"window"`
+
+	// At is the time of day daily digests close, such as "08:00",
+	// midnight when empty.
+	At string `json:"at,omitempty"`
+
+	// Timezone is the IANA timezone of the daily digests when the
+	// recipient has none, UTC when empty.
+	Timezone string `json:"timezone,omitempty"`
+}
+
+// Validate checks the window, time of day and timezone of d.
+func (d *Digest) Validate() error {
+	if d.Window != DigestHourly && d.Window != DigestDaily {
+		return fmt.Errorf("invalid digest window %s", d.Window)
+	}
+	if d.At != "" {
+		if _, err := parseClock(d.At); err != nil {
+			return fmt.Errorf("invalid digest time %s", d.At)
+		}
+	}
+	if _, err := time.LoadLocation(d.Timezone); err != nil {
+		return fmt.Errorf("invalid digest timezone %s", d.Timezone)
+	}
+	return nil
+}
+
+// Close returns when the window of d that contains t closes.
+func (d *Digest) Close(t time.Time) (time.Time, error) {
+	loc, err := time.LoadLocation(d.Timezone)
+	if err != nil {
+		return t, err
+	}
+	lt := t.In(loc)
+
+	switch d.Window {
+	case DigestHourly:
+		hour := time.Date(lt.Year(), lt.Month(), lt.Day(), lt.Hour(), 0, 0, 0, loc)
+		return hour.Add(time.Hour), nil
+	case DigestDaily:
+		var at int
+		if d.At != "" {
+			if at, err = parseClock(d.At); err != nil {
+				return t, err
+			}
+		}
+
+		y, m, day := lt.Date()
+		close := time.Date(y, m, day, 0, at, 0, 0, loc)
+		if !close.After(lt) {
+			close = time.Date(y, m, day+1, 0, at, 0, 0, loc)
+		}
+		return close, nil
+	}
+
+	return t, fmt.Errorf("invalid digest window %s", d.Window)
+}
+
+// MessageDigest describes a digest message, rendered when its window closes
+// from the messages accumulated in it.
+type MessageDigest struct {
+	SubjectChannelID string `json:"subject_channel_id"`
+	RecipientID      string `json:"recipient_id,omitempty"`
+	Locale           string `json:"locale,omitempty"`
+}
+
+// DigestRenderer renders the content of a digest message from the messages
+// merged into it.
+type DigestRenderer interface {
+	RenderDigest(digest *Message, messages []*Message) ([]byte, error)
+}
@@ -3,14 +3,24 @@ package main
 import (
 	"errors"
 	"flag"
-	"fmt"
 	"log"
+	"sync"
 
 	"github.com/iampigeon/pigeon"
 	"github.com/iampigeon/pigeon/backend"
 )
 
-type service struct{}
+// recentDeliveries is the number of delivery ids remembered to skip
+// repeated deliveries.
+const recentDeliveries = 1024
+
+type service struct {
+	reporter *backend.Reporter
+
+	mu         sync.Mutex
+	delivered  map[string]bool
+	deliveries []string
+}
 
 func (s *service) Approve(content []byte) (valid bool, err error) {
 	if content == nil {
@@ -24,15 +34,63 @@ func (s *service) Deliver(content []byte) error {
 	return nil
 }
 
+// DeliverMessage logs the message and reports it as delivered when the
+// backend is registered in a scheduler.
+func (s *service) DeliverMessage(id string, content []byte) error {
+	log.Printf("message %s received: %s", id, content)
+	if s.reporter == nil {
+		return nil
+	}
+
+	go func() {
+		if err := s.reporter.Report(id, pigeon.StatusDelivered, ""); err != nil {
+			log.Printf("Error: could not report message %s, %v", id, err)
+		}
+	}()
+	return nil
+}
+
+// DeliverOnce delivers the message unless deliveryID is among the recent
+// deliveries.
+func (s *service) DeliverOnce(deliveryID, id string, content []byte) error {
+	s.mu.Lock()
+	if s.delivered[deliveryID] {
+		s.mu.Unlock()
+		log.Printf("message %s already delivered as %s", id, deliveryID)
+		return nil
+	}
+	if len(s.deliveries) == recentDeliveries {
+		delete(s.delivered, s.deliveries[0])
+		s.deliveries = s.deliveries[1:]
+	}
+	s.delivered[deliveryID] = true
+	s.deliveries = append(s.deliveries, deliveryID)
+	s.mu.Unlock()
+
+	return s.DeliverMessage(id, content)
+}
+
 func main() {
-	host := flag.String("host", "localhost", "host of the service")
-	port := flag.Int("port", 5000, "host of the service")
+	loadConfig := backend.ConfigFromFlags(flag.CommandLine, 5000)
 	flag.Parse()
 
-	addr := fmt.Sprintf("%s:%d", *host, *port)
+	config, err := loadConfig()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	svc := &service{delivered: make(map[string]bool)}
+	if config.SchedulerAddr != "" {
+		reporter, err := backend.NewReporter(config)
+		if err != nil {
+			log.Fatal(err)
+		}
+		defer reporter.Close()
+		svc.reporter = reporter
+	}
 
-	log.Printf("Serving at %s", addr)
-	if err := backend.ListenAndServe(pigeon.NetAddr(addr), &service{}); err != nil {
+	log.Printf("Serving at %s", config.Addr)
+	if err := backend.Serve(config, svc); err != nil {
 		log.Fatal(err)
 	}
 }
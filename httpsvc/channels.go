@@ -0,0 +1,298 @@
+package httpsvc
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/url"
+
+	"github.com/iampigeon/pigeon"
+)
+
+// recipientFields are the content fields that hold the address of a
+// recipient in each channel. Fields of list channels take all the verified
+// addresses of the recipient, the others the first one. Endpoint fields,
+// which say where the backend connects to, are never taken from the request
+// content; the builder of the channel takes them from the recipient or the
+// subject channel options.
+var recipientFields = map[string]struct {
+	field    string
+	list     bool
+	endpoint bool
+}{
+	pigeon.ServicePigeonMQTT:     {"mqtt_topic", false, true},
+	pigeon.ServicePigeonHTTP:     {"url", false, true},
+	pigeon.ServicePigeonEmail:    {"to", true, false},
+	pigeon.ServicePigeonSMS:      {"phone", false, false},
+	pigeon.ServicePigeonPush:     {"tokens", true, false},
+	pigeon.ServicePigeonTelegram: {"chat_id", false, true},
+	pigeon.ServicePigeonSlack:    {"webhook_url", false, true},
+}
+
+// applyRecipient sets the address of r in the channel value, except for
+// endpoint fields, which buildChannelContent takes from r.
+func applyRecipient(channelName string, value interface{}, r *pigeon.Recipient) (interface{}, error) {
+	f, ok := recipientFields[channelName]
+	if !ok {
+		return nil, fmt.Errorf("channel %s does not support recipients", channelName)
+	}
+
+	addrs := r.Addresses(channelName)
+	if len(addrs) == 0 {
+		return nil, fmt.Errorf("recipient %s has no verified %s contact point", r.ID, channelName)
+	}
+
+	content := make(map[string]interface{})
+	if value != nil {
+		if err := decode(channelName, value, &content); err != nil {
+			return nil, err
+		}
+	}
+
+	switch {
+	case f.endpoint:
+	case f.list:
+		content[f.field] = addrs
+	default:
+		content[f.field] = addrs[0]
+	}
+
+	return content, nil
+}
+
+// recipientEndpoint returns the endpoint address of r in the channel, empty
+// without a recipient or when the channel has no endpoint field.
+func recipientEndpoint(channelName string, r *pigeon.Recipient) string {
+	if r == nil || !recipientFields[channelName].endpoint {
+		return ""
+	}
+
+	addrs := r.Addresses(channelName)
+	if len(addrs) == 0 {
+		return ""
+	}
+	return addrs[0]
+}
+
+// channelBuilder builds the content sent to the backend of a channel from
+// the value of the message request, the subject channel options and the
+// endpoint address of the recipient, empty without one.
+type channelBuilder struct {
+	endpoint string
+	build    func(channelName string, value interface{}, options map[string]interface{}, address string) (interface{}, error)
+}
+
+var channelBuilders = map[string]channelBuilder{
+	pigeon.ServicePigeonMQTT:  {pigeon.EndpointMQTT, buildMQTT},
+	pigeon.ServicePigeonHTTP:  {pigeon.EndpointHTTP, buildHTTP},
+	pigeon.ServicePigeonEmail: {pigeon.EndpointEmail, buildEmail},
+	pigeon.ServicePigeonSMS:   {pigeon.EndpointSMS, buildSMS},
+	pigeon.ServicePigeonPush:  {pigeon.EndpointPush, buildPush},
+
+	pigeon.ServicePigeonTelegram: {pigeon.EndpointChat, buildChat},
+	pigeon.ServicePigeonSlack:    {pigeon.EndpointChat, buildChat},
+}
+
+// buildChannelContent returns the encoded backend content of the channel
+// for recipient r, which can be nil, and the default endpoint of its
+// backend.
+func buildChannelContent(channelName string, value interface{}, sc *pigeon.SubjectChannel, r *pigeon.Recipient) ([]byte, string, error) {
+	b, ok := channelBuilders[channelName]
+	if !ok {
+		return nil, "", fmt.Errorf("invalid channel name %s", channelName)
+	}
+
+	v, err := b.build(channelName, value, sc.Options, recipientEndpoint(channelName, r))
+	if err != nil {
+		return nil, "", err
+	}
+
+	content, err := json.Marshal(v)
+	if err != nil {
+		return nil, "", fmt.Errorf("invalid json mashall for %s channel", channelName)
+	}
+
+	return content, b.endpoint, nil
+}
+
+// decode converts v into dst through its json encoding.
+func decode(channelName string, v, dst interface{}) error {
+	c, err := json.Marshal(v)
+	if err != nil {
+		return fmt.Errorf("invalid json mashall for %s channel", channelName)
+	}
+	if err := json.Unmarshal(c, dst); err != nil {
+		return fmt.Errorf("invalid cast parse for %s channel", channelName)
+	}
+	return nil
+}
+
+func buildMQTT(channelName string, value interface{}, options map[string]interface{}, address string) (interface{}, error) {
+	var content pigeon.MQTTContent
+	if err := decode(channelName, value, &content); err != nil {
+		return nil, err
+	}
+
+	var opts pigeon.MQTTOptions
+	if err := decode(channelName, options, &opts); err != nil {
+		return nil, err
+	}
+
+	topic := opts.Topic
+	if address != "" {
+		topic = address
+	}
+
+	return pigeon.MQTT{
+		Topic:    topic,
+		Payload:  content.Payload,
+		Broker:   opts.Broker,
+		Username: opts.Username,
+		Password: opts.Password,
+		ClientID: opts.ClientID,
+		QoS:      opts.QoS,
+		Retain:   opts.Retain,
+	}, nil
+}
+
+func buildHTTP(channelName string, value interface{}, options map[string]interface{}, address string) (interface{}, error) {
+	var content pigeon.HTTPContent
+	if err := decode(channelName, value, &content); err != nil {
+		return nil, err
+	}
+
+	var opts pigeon.HTTPOptions
+	if err := decode(channelName, options, &opts); err != nil {
+		return nil, err
+	}
+
+	u := opts.URL
+	if address != "" {
+		var err error
+		if u, err = url.Parse(address); err != nil {
+			return nil, fmt.Errorf("invalid url for %s channel", channelName)
+		}
+	}
+
+	return pigeon.HTTP{
+		Headers: opts.Headers,
+		URL:     u,
+		Method:  opts.Method,
+		Body:    content.Body,
+		Timeout: opts.Timeout,
+		Secret:  opts.Secret,
+	}, nil
+}
+
+func buildEmail(channelName string, value interface{}, options map[string]interface{}, address string) (interface{}, error) {
+	var content pigeon.EmailContent
+	if err := decode(channelName, value, &content); err != nil {
+		return nil, err
+	}
+
+	var opts pigeon.EmailOptions
+	if err := decode(channelName, options, &opts); err != nil {
+		return nil, err
+	}
+
+	email := pigeon.Email{
+		From:        opts.From,
+		FromName:    opts.FromName,
+		To:          content.To,
+		Subject:     content.Subject,
+		HTML:        content.HTML,
+		Text:        content.Text,
+		Attachments: content.Attachments,
+	}
+
+	if opts.SMTPHost != "" {
+		email.SMTP = &pigeon.SMTPOptions{
+			Host:     opts.SMTPHost,
+			Port:     opts.SMTPPort,
+			Username: opts.SMTPUsername,
+			Password: opts.SMTPPassword,
+			StartTLS: opts.SMTPStartTLS,
+		}
+	}
+
+	return email, nil
+}
+
+func buildSMS(channelName string, value interface{}, options map[string]interface{}, address string) (interface{}, error) {
+	var content pigeon.SMSContent
+	if err := decode(channelName, value, &content); err != nil {
+		return nil, err
+	}
+
+	var opts pigeon.SMSOptions
+	if err := decode(channelName, options, &opts); err != nil {
+		return nil, err
+	}
+
+	return pigeon.SMS{
+		Phone: content.Phone,
+		Text:  content.Text,
+		From:  opts.SenderID,
+	}, nil
+}
+
+func buildPush(channelName string, value interface{}, options map[string]interface{}, address string) (interface{}, error) {
+	var content pigeon.PushContent
+	if err := decode(channelName, value, &content); err != nil {
+		return nil, err
+	}
+
+	var opts pigeon.PushOptions
+	if err := decode(channelName, options, &opts); err != nil {
+		return nil, err
+	}
+
+	tokens := content.Tokens
+	if content.Token != "" {
+		tokens = append(tokens, content.Token)
+	}
+
+	return pigeon.Push{
+		Title:    content.Title,
+		Body:     content.Body,
+		Data:     content.Data,
+		Tokens:   tokens,
+		Provider: opts.Provider,
+	}, nil
+}
+
+// buildChat builds the content of the telegram and slack channels, both
+// delivered by the chat backend.
+func buildChat(channelName string, value interface{}, options map[string]interface{}, address string) (interface{}, error) {
+	var content pigeon.ChatContent
+	if err := decode(channelName, value, &content); err != nil {
+		return nil, err
+	}
+
+	var opts pigeon.ChatOptions
+	if err := decode(channelName, options, &opts); err != nil {
+		return nil, err
+	}
+
+	format := content.Format
+	if format == "" {
+		format = opts.Format
+	}
+	chatID := opts.ChatID
+	webhookURL := opts.WebhookURL
+	if address != "" {
+		if channelName == pigeon.ServicePigeonSlack {
+			webhookURL = address
+		} else {
+			chatID = address
+		}
+	}
+
+	return pigeon.Chat{
+		Provider:   channelName,
+		Text:       content.Text,
+		Format:     format,
+		ChatID:     chatID,
+		BotToken:   opts.BotToken,
+		WebhookURL: webhookURL,
+	}, nil
+}
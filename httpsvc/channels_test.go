@@ -0,0 +1,124 @@
+package httpsvc
+
+import (
+	"encoding/json"
+	"net/url"
+	"reflect"
+	"testing"
+
+	"github.com/iampigeon/pigeon"
+)
+
+func buildContent(t *testing.T, channelName string, value interface{}, options map[string]interface{}, r *pigeon.Recipient) map[string]interface{} {
+	if r != nil {
+		var err error
+		if value, err = applyRecipient(channelName, value, r); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	b, _, err := buildChannelContent(channelName, value, &pigeon.SubjectChannel{Options: options}, r)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var content map[string]interface{}
+	if err := json.Unmarshal(b, &content); err != nil {
+		t.Fatal(err)
+	}
+	return content
+}
+
+// jsonURL returns the json value of the parsed rawURL, the way http options
+// hold their url.
+func jsonURL(t *testing.T, rawURL string) interface{} {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := json.Marshal(u)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var v interface{}
+	if err := json.Unmarshal(b, &v); err != nil {
+		t.Fatal(err)
+	}
+	return v
+}
+
+func TestBuildChannelContentEndpoints(t *testing.T) {
+	address := func(s string) interface{} { return s }
+
+	tests := []struct {
+		channel string
+		field   string
+		value   map[string]interface{}
+		options map[string]interface{}
+		address func(string) interface{}
+	}{
+		{
+			pigeon.ServicePigeonHTTP, "url",
+			map[string]interface{}{"body": "{}", "url": "http://169.254.169.254/latest/meta-data"},
+			map[string]interface{}{"url": jsonURL(t, "https://hooks.example.com/pigeon")},
+			func(s string) interface{} { return jsonURL(t, s) },
+		},
+		{
+			pigeon.ServicePigeonMQTT, "mqtt_topic",
+			map[string]interface{}{"mqtt_payload": map[string]interface{}{}, "mqtt_topic": "other/tenant"},
+			map[string]interface{}{"mqtt_topic": "devices/alerts"},
+			address,
+		},
+		{
+			pigeon.ServicePigeonTelegram, "chat_id",
+			map[string]interface{}{"text": "hi", "chat_id": "666"},
+			map[string]interface{}{"chat_id": "42"},
+			address,
+		},
+		{
+			pigeon.ServicePigeonSlack, "webhook_url",
+			map[string]interface{}{"text": "hi", "webhook_url": "http://10.0.0.1/"},
+			map[string]interface{}{"webhook_url": "https://hooks.slack.com/services/T/B/X"},
+			address,
+		},
+	}
+
+	for _, tt := range tests {
+		content := buildContent(t, tt.channel, tt.value, tt.options, nil)
+		if got, want := content[tt.field], tt.options[tt.field]; !reflect.DeepEqual(got, want) {
+			t.Errorf("%s: %s = %v, want the option %v", tt.channel, tt.field, got, want)
+		}
+
+		r := &pigeon.Recipient{
+			ID: "r1",
+			ContactPoints: []*pigeon.ContactPoint{
+				{Channel: tt.channel, Address: "https://recipient.example.com/", Verified: true},
+			},
+		}
+		content = buildContent(t, tt.channel, tt.value, tt.options, r)
+		if got := content[tt.field]; !reflect.DeepEqual(got, tt.address("https://recipient.example.com/")) {
+			t.Errorf("%s with recipient: %s = %v, want the recipient address", tt.channel, tt.field, got)
+		}
+	}
+}
+
+func TestBuildChannelContentRecipient(t *testing.T) {
+	r := &pigeon.Recipient{
+		ID: "r1",
+		ContactPoints: []*pigeon.ContactPoint{
+			{Channel: pigeon.ServicePigeonEmail, Address: "a@example.com", Verified: true},
+			{Channel: pigeon.ServicePigeonEmail, Address: "b@example.com", Verified: true},
+			{Channel: pigeon.ServicePigeonEmail, Address: "c@example.com"},
+		},
+	}
+
+	content := buildContent(t, pigeon.ServicePigeonEmail, map[string]interface{}{"subject": "s", "text": "t"}, map[string]interface{}{"from": "p@example.com"}, r)
+	if want := []interface{}{"a@example.com", "b@example.com"}; !reflect.DeepEqual(content["to"], want) {
+		t.Errorf("to = %v, want the verified addresses", content["to"])
+	}
+
+	if _, err := applyRecipient(pigeon.ServicePigeonSMS, nil, r); err == nil {
+		t.Error("applied a recipient without sms contact points")
+	}
+}
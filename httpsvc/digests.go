@@ -0,0 +1,176 @@
+package httpsvc
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/iampigeon/pigeon"
+	"github.com/iampigeon/pigeon/db"
+	"github.com/oklog/ulid"
+)
+
+var _ pigeon.DigestRenderer = (*DigestRenderer)(nil)
+
+// DigestRenderer renders the digests of the subject channels with their
+// templates, it is used by the scheduler when the digest windows close.
+type DigestRenderer struct {
+	SubjectStore   *db.SubjectStore
+	TemplateStore  *db.TemplateStore
+	RecipientStore *db.RecipientStore
+
+	// UnsubscribeSecret, AckSecret and PublicURL build the unsubscribe_url
+	// and ack_url variables of the digest templates.
+	UnsubscribeSecret []byte
+	AckSecret         []byte
+	PublicURL         string
+}
+
+// NewDigestRenderer ...
+func NewDigestRenderer(datastore *db.Datastore, config Config) (*DigestRenderer, error) {
+	tps, err := db.NewTemplateStore(datastore)
+	if err != nil {
+		return nil, err
+	}
+	rs, err := db.NewRecipientStore(datastore)
+	if err != nil {
+		return nil, err
+	}
+
+	return &DigestRenderer{
+		SubjectStore:      &db.SubjectStore{Dst: datastore},
+		TemplateStore:     tps,
+		RecipientStore:    rs,
+		UnsubscribeSecret: config.UnsubscribeSecret,
+		AckSecret:         config.AckSecret,
+		PublicURL:         config.PublicURL,
+	}, nil
+}
+
+// RenderDigest renders the digest fields of the template of the subject
+// channel of digest, with the variables of messages.
+func (dr *DigestRenderer) RenderDigest(digest *pigeon.Message, messages []*pigeon.Message) ([]byte, error) {
+	if digest.Digest == nil {
+		return nil, errors.New("not a digest message")
+	}
+
+	subject, err := dr.SubjectStore.GeSubjectByID(digest.SubjectID)
+	if err != nil {
+		return nil, err
+	}
+
+	var sc *pigeon.SubjectChannel
+	for _, c := range subject.Channels {
+		if c.ID == digest.Digest.SubjectChannelID {
+			sc = c
+		}
+	}
+	if sc == nil {
+		return nil, fmt.Errorf("subject channel %s not found", digest.Digest.SubjectChannelID)
+	}
+
+	t, err := dr.TemplateStore.GetTemplate(digest.UserID, sc.ID)
+	if err != nil {
+		return nil, err
+	}
+	if len(t.Digest) == 0 {
+		return nil, fmt.Errorf("template of subject channel %s has no digest fields", sc.ID)
+	}
+
+	items := make([]map[string]interface{}, 0, len(messages))
+	for _, m := range messages {
+		items = append(items, m.Variables)
+	}
+	vars := map[string]interface{}{
+		"messages": items,
+		"count":    len(items),
+	}
+	if len(dr.AckSecret) > 0 {
+		vars["ack_url"] = AckURL(dr.PublicURL, digest.ID.String(), SignAckToken(dr.AckSecret, digest.ID.String()))
+	}
+
+	// times are formatted in the timezone of the digest window.
+	var timezone string
+	if sc.Digest != nil {
+		timezone = sc.Digest.Timezone
+	}
+
+	var value interface{}
+	var recipient *pigeon.Recipient
+	if digest.Digest.RecipientID != "" {
+		recipient, err = dr.RecipientStore.GetRecipient(digest.UserID, digest.Digest.RecipientID)
+		if err != nil {
+			return nil, err
+		}
+
+		if len(dr.UnsubscribeSecret) > 0 {
+			token, err := SignUnsubscribeToken(dr.UnsubscribeSecret, digest.UserID, recipient.ID, subject.Name, digest.Channel)
+			if err != nil {
+				return nil, err
+			}
+			vars["unsubscribe_url"] = UnsubscribeURL(dr.PublicURL, token)
+		}
+
+		if recipient.Timezone != "" {
+			timezone = recipient.Timezone
+		}
+
+		if value, err = applyRecipient(digest.Channel, value, recipient); err != nil {
+			return nil, err
+		}
+	}
+
+	value, err = renderTemplate(&pigeon.Template{Fields: t.Digest, JSON: t.JSON}, digest.Digest.Locale, location(timezone), vars, value)
+	if err != nil {
+		return nil, err
+	}
+
+	content, _, err := buildChannelContent(digest.Channel, value, sc, recipient)
+	if err != nil {
+		return nil, err
+	}
+
+	return content, nil
+}
+
+// digestID returns the id of the digest of sc for recipient that contains
+// t, the same for every message of the window. It encodes the close of the
+// window, when the scheduler sends the digest.
+func digestID(sc *pigeon.SubjectChannel, subject *pigeon.Subject, recipient *pigeon.Recipient, channelName string, t time.Time) (string, error) {
+	d := *sc.Digest
+	var recipientID string
+	if recipient != nil {
+		recipientID = recipient.ID
+		if recipient.Timezone != "" {
+			d.Timezone = recipient.Timezone
+		}
+	}
+
+	close, err := d.Close(t)
+	if err != nil {
+		return "", err
+	}
+
+	// the entropy is derived from the digest key and its window.
+	key := fmt.Sprintf("%s:%s:%s:%s:%s:%d", subject.UserID, subject.ID, sc.ID, recipientID, channelName, close.Unix())
+	sum := sha256.Sum256([]byte(key))
+
+	id, err := ulid.New(ulid.Timestamp(close), bytes.NewReader(sum[:]))
+	if err != nil {
+		return "", err
+	}
+
+	return id.String(), nil
+}
+
+// digestVariables encodes the variables kept to render the digest of a
+// message.
+func digestVariables(vars map[string]interface{}) ([]byte, error) {
+	if vars == nil {
+		vars = make(map[string]interface{})
+	}
+	return json.Marshal(vars)
+}
@@ -13,8 +13,10 @@ import (
 
 	"github.com/WiseGrowth/go-wisebot/logger"
 	"github.com/iampigeon/pigeon"
+	"github.com/iampigeon/pigeon/connpool"
 	"github.com/iampigeon/pigeon/db"
 	"github.com/iampigeon/pigeon/proto"
+	"github.com/iampigeon/pigeon/tlsutil"
 	"github.com/julienschmidt/httprouter"
 	"github.com/oklog/ulid"
 	"github.com/urfave/negroni"
@@ -64,6 +66,34 @@ type MessageRequest struct {
 	Message *struct {
 		SubjectName string                 `json:"subject_name"`
 		Channels    map[string]interface{} `json:"channels"`
+
+		// Variables render the templates of the subject channels. When
+		// Channels is empty the message is sent to every subject channel
+		// with a template.
+		Variables map[string]interface{} `json:"variables,omitempty"`
+
+		// Locale selects the template variants, such as "es-CL". The locale
+		// of the recipient is used when empty.
+		Locale string `json:"locale,omitempty"`
+
+		// RecipientID and RecipientIDs send the message to recipients,
+		// setting their address in the content of each channel.
+		RecipientID  string   `json:"recipient_id,omitempty"`
+		RecipientIDs []string `json:"recipient_ids,omitempty"`
+
+		// DedupKey identifies the repetitions of the message within the
+		// dedup window of the subject, instead of its content.
+		DedupKey string `json:"dedup_key,omitempty"`
+
+		// Priority is critical, high, normal or bulk. Messages of critical
+		// subjects are critical by default, the others normal.
+		Priority string `json:"priority,omitempty"`
+
+		// ExpiresAt or TTL, in seconds from the request, expire the message
+		// when it could not be sent in time. Messages never expire when
+		// both are empty.
+		ExpiresAt *time.Time `json:"expires_at,omitempty"`
+		TTL       int64      `json:"ttl,omitempty"`
 	} `json:"message"`
 }
 
@@ -80,6 +110,17 @@ type MessageStatusResponse struct {
 // MessageByIDResponse ...
 type MessageByIDResponse struct {
 	Message *pigeon.Message `json:"message"`
+
+	// Chain are the steps of the escalation of the message.
+	Chain []*ChainMessage `json:"chain,omitempty"`
+}
+
+// ChainMessage is a step of an escalation chain.
+type ChainMessage struct {
+	ID      string `json:"id"`
+	Step    int    `json:"step"`
+	Channel string `json:"channel"`
+	Status  string `json:"status"`
 }
 
 // MessageCancelResponse ...
@@ -89,9 +130,42 @@ type MessageCancelResponse struct {
 
 // MessageResponse ...
 type MessageResponse struct {
-	ID      string `json:"id,omitempty"`
-	Channel string `json:"channel,omitempty"`
-	Error   string `json:"error,omitempty"`
+	ID          string `json:"id,omitempty"`
+	Channel     string `json:"channel,omitempty"`
+	RecipientID string `json:"recipient_id,omitempty"`
+	ChainID     string `json:"chain_id,omitempty"`
+
+	// DigestID is the digest the message accumulates in, when its subject
+	// channel has one.
+	DigestID string `json:"digest_id,omitempty"`
+
+	// Result is throttled or deduplicated when the message was dropped by
+	// the limits of the subject, instead of an ID.
+	Result string `json:"result,omitempty"`
+
+	Error string `json:"error,omitempty"`
+}
+
+// Config ...
+type Config struct {
+	// SchedulerTLS secures the connection to the scheduler grpc service.
+	SchedulerTLS *tlsutil.Credentials
+
+	// Conns holds the connection to the scheduler. When nil a pool using
+	// SchedulerTLS is created.
+	Conns *connpool.Pool
+
+	// UnsubscribeSecret signs the unsubscribe links, which are disabled
+	// when it is empty.
+	UnsubscribeSecret []byte
+
+	// AckSecret signs the acknowledgement links of the messages, which are
+	// disabled when it is empty.
+	AckSecret []byte
+
+	// PublicURL is the base URL of the unsubscribe and acknowledgement
+	// links.
+	PublicURL string
 }
 
 type getSubjectsContext struct {
@@ -107,16 +181,28 @@ type getMessageStatusContext struct {
 }
 
 type postMessageContext struct {
-	SubjectStore  *db.SubjectStore
-	UserStore     *db.UserStore
-	ChannelStore  *db.ChannelStore
-	CriteriaStore *db.CriteriaStore
+	SubjectStore   *db.SubjectStore
+	UserStore      *db.UserStore
+	ChannelStore   *db.ChannelStore
+	CriteriaStore  *db.CriteriaStore
+	TemplateStore  *db.TemplateStore
+	RecipientStore *db.RecipientStore
+
+	Conns *connpool.Pool
+
+	// UnsubscribeSecret, AckSecret and PublicURL build the unsubscribe_url
+	// and ack_url variables of the templates.
+	UnsubscribeSecret []byte
+	AckSecret         []byte
+	PublicURL         string
 }
 
 type postCancelMessageContext struct {
 	MessageStore *db.MessageStore
 	SubjectStore *db.SubjectStore
 	UserStore    *db.UserStore
+
+	Conns *connpool.Pool
 }
 
 type getMessageByIDContext struct {
@@ -132,8 +218,21 @@ type getMessageByIDContext struct {
 // GET /api/v1/messages/:id
 // GET /api/v1/messages/:id/status
 // POST /api/v1/messages/:id/cancel
+// GET /api/v1/subjects/:subject/channels/:channel/template
+// PUT /api/v1/subjects/:subject/channels/:channel/template
+// POST /api/v1/subjects/:subject/channels/:channel/template/preview
+// GET /api/v1/recipients
+// POST /api/v1/recipients
+// GET /api/v1/recipients/:id
+// PUT /api/v1/recipients/:id
+// DELETE /api/v1/recipients/:id
+// GET /api/v1/recipients/:id/unsubscribe_url
+// GET /unsubscribe/:token
+// POST /unsubscribe/:token
+// GET /api/v1/messages/:id/ack?token=
+// POST /api/v1/messages/:id/ack?token=
 //
-func NewHTTPServer(datastore *db.Datastore) *http.Server {
+func NewHTTPServer(datastore *db.Datastore, config Config) *http.Server {
 	router := httprouter.New()
 
 	// stores
@@ -145,12 +244,46 @@ func NewHTTPServer(datastore *db.Datastore) *http.Server {
 	if err != nil {
 		panic(err)
 	}
+	tps, err := db.NewTemplateStore(datastore)
+	if err != nil {
+		panic(err)
+	}
+	rs, err := db.NewRecipientStore(datastore)
+	if err != nil {
+		panic(err)
+	}
+
+	conns := config.Conns
+	if conns == nil {
+		conns = connpool.New(connpool.Config{Name: "scheduler", TLS: config.SchedulerTLS})
+	}
 
 	router.GET("/api/v1/subjects", getSubjectsHTTPHandler(getSubjectsContext{SubjectStore: ss, UserStore: us, ChannelStore: cs}))
 	router.GET("/api/v1/messages/:id", getMessageByIDHTTPHandler(getMessageByIDContext{UserStore: us, SubjectStore: ss, MessageStore: ms}))
-	router.POST("/api/v1/messages", postMessageHTTPHandler(postMessageContext{UserStore: us, SubjectStore: ss, ChannelStore: cs, CriteriaStore: ts}))
+	router.POST("/api/v1/messages", postMessageHTTPHandler(postMessageContext{UserStore: us, SubjectStore: ss, ChannelStore: cs, CriteriaStore: ts, TemplateStore: tps, RecipientStore: rs, Conns: conns, UnsubscribeSecret: config.UnsubscribeSecret, AckSecret: config.AckSecret, PublicURL: config.PublicURL}))
 	router.GET("/api/v1/messages/:id/status", getStatusMessageHTTPHandler(getMessageStatusContext{MessageStore: ms, UserStore: us}))
-	router.POST("/api/v1/messages/:id/cancel", postCancelMessageHTTPHandler(postCancelMessageContext{MessageStore: ms, UserStore: us, SubjectStore: ss}))
+	router.POST("/api/v1/messages/:id/cancel", postCancelMessageHTTPHandler(postCancelMessageContext{MessageStore: ms, UserStore: us, SubjectStore: ss, Conns: conns}))
+
+	tctx := templateContext{UserStore: us, SubjectStore: ss, ChannelStore: cs, TemplateStore: tps}
+	router.GET("/api/v1/subjects/:subject/channels/:channel/template", getTemplateHTTPHandler(tctx))
+	router.PUT("/api/v1/subjects/:subject/channels/:channel/template", putTemplateHTTPHandler(tctx))
+	router.POST("/api/v1/subjects/:subject/channels/:channel/template/preview", postPreviewTemplateHTTPHandler(tctx))
+
+	rctx := recipientContext{UserStore: us, RecipientStore: rs}
+	router.GET("/api/v1/recipients", getRecipientsHTTPHandler(rctx))
+	router.POST("/api/v1/recipients", postRecipientHTTPHandler(rctx))
+	router.GET("/api/v1/recipients/:id", getRecipientHTTPHandler(rctx))
+	router.PUT("/api/v1/recipients/:id", putRecipientHTTPHandler(rctx))
+	router.DELETE("/api/v1/recipients/:id", deleteRecipientHTTPHandler(rctx))
+
+	uctx := unsubscribeContext{UserStore: us, RecipientStore: rs, Secret: config.UnsubscribeSecret, PublicURL: config.PublicURL}
+	router.GET("/api/v1/recipients/:id/unsubscribe_url", getUnsubscribeURLHTTPHandler(uctx))
+	router.GET("/unsubscribe/:token", unsubscribeHTTPHandler(uctx))
+	router.POST("/unsubscribe/:token", unsubscribeHTTPHandler(uctx))
+
+	actx := ackContext{Conns: conns, Secret: config.AckSecret}
+	router.GET("/api/v1/messages/:id/ack", getAckMessageHTTPHandler(actx))
+	router.POST("/api/v1/messages/:id/ack", ackMessageHTTPHandler(actx))
 
 	addr := fmt.Sprintf(":%d", httpPort)
 	routes := negroni.Wrap(router)
@@ -266,6 +399,25 @@ func getMessageByIDHTTPHandler(ctx getMessageByIDContext) func(w http.ResponseWr
 		messageByIDResponse := new(MessageByIDResponse)
 		messageByIDResponse.Message = msg
 
+		// add the steps of the escalation
+		if msg.ChainID != "" {
+			chain, err := ctx.MessageStore.GetChain(msg.ChainID)
+			if err != nil {
+				getLogger(r).Error(err)
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+
+			for _, m := range chain {
+				messageByIDResponse.Chain = append(messageByIDResponse.Chain, &ChainMessage{
+					ID:      m.ID.String(),
+					Step:    m.ChainStep,
+					Channel: m.Channel,
+					Status:  string(m.Status),
+				})
+			}
+		}
+
 		response := new(Response)
 		response.Data = messageByIDResponse
 
@@ -319,17 +471,23 @@ func postMessageHTTPHandler(ctx postMessageContext) func(w http.ResponseWriter,
 			return
 		}
 
-		// TODO(ca): check this
-		addr := fmt.Sprintf("localhost:%d", grpcPort)
+		if !pigeon.ValidPriority(payload.Message.Priority) {
+			http.Error(w, fmt.Sprintf("invalid priority %s", payload.Message.Priority), http.StatusBadRequest)
+			return
+		}
+
+		if _, err := messageExpiry(payload, time.Now()); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
 
 		//grpc connection
-		conn, err := grpc.Dial(addr, grpc.WithInsecure())
+		conn, err := getSchedulerConn(ctx.Conns)
 		if err != nil {
 			getLogger(r).Error(err)
 			http.Error(w, err.Error(), http.StatusInternalServerError)
 			return
 		}
-		defer conn.Close()
 
 		// Define scheduler proto client
 		client := proto.NewSchedulerServiceClient(conn)
@@ -337,156 +495,379 @@ func postMessageHTTPHandler(ctx postMessageContext) func(w http.ResponseWriter,
 		// Prepare message array response
 		messagesResponses := new(MessagesResponse)
 
-		for channelName, channelValue := range payload.Message.Channels {
-			response := new(MessageResponse)
-			response.Channel = channelName
+		// resolve the recipients of the message, a nil recipient sends the
+		// channel values as they are.
+		recipients, err := getMessageRecipients(ctx.RecipientStore, user.ID, payload.Message.RecipientID, payload.Message.RecipientIDs)
+		if err != nil {
+			getLogger(r).Error(err)
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
 
-			// get subjectChannel according current channel name
-			subjectChannel, err := getSubjectChannelByName(channelName, subject, ctx.ChannelStore)
-			if err != nil {
-				response.Error = err.Error()
-				messagesResponses.Messages = append(messagesResponses.Messages, *response)
-				continue
+		if len(subject.Escalation) > 0 {
+			// escalate through the channels of the policy, in order
+			for _, recipient := range recipients {
+				messagesResponses.Messages = append(messagesResponses.Messages, putEscalation(ctx, client, user, subject, payload, recipient)...)
 			}
-
-			criteriaDelay, err := ctx.CriteriaStore.GetCriteriaDelay(subjectChannel.CriteriaID, subjectChannel.CriteriaCustom)
-			if err != nil {
-				response.Error = err.Error()
-				messagesResponses.Messages = append(messagesResponses.Messages, *response)
-				continue
+		} else {
+			channels := payload.Message.Channels
+			if len(channels) == 0 && payload.Message.Variables != nil {
+				channels = templateChannels(ctx.TemplateStore, ctx.ChannelStore, user.ID, subject)
 			}
 
-			// prepare and send pigeon-mqtt message
-			if channelName == pigeon.ServicePigeonMQTT {
-				// define mqtt content
-				var mqttContent *pigeon.MQTTContent
+			for channelName, channelValue := range channels {
+				response := new(MessageResponse)
+				response.Channel = channelName
 
-				c, err := json.Marshal(channelValue)
-				if err != nil {
-					response.Error = fmt.Sprintf("invalid json mashall for %s channel", channelName)
-					messagesResponses.Messages = append(messagesResponses.Messages, *response)
-					continue
-				}
-				err = json.Unmarshal(c, &mqttContent)
+				// get subjectChannel according current channel name
+				subjectChannel, err := getSubjectChannelByName(channelName, subject, ctx.ChannelStore)
 				if err != nil {
-					response.Error = fmt.Sprintf("invalid cast parse for %s channel", channelName)
+					response.Error = err.Error()
 					messagesResponses.Messages = append(messagesResponses.Messages, *response)
 					continue
 				}
 
-				//define mqtt options
-				var mqttOptions *pigeon.MQTTOptions
-
-				c, err = json.Marshal(subjectChannel.Options)
+				criteriaDelay, err := ctx.CriteriaStore.GetCriteriaDelay(subjectChannel.CriteriaID, subjectChannel.CriteriaCustom)
 				if err != nil {
-					response.Error = fmt.Sprintf("invalid json mashall for %s channel", channelName)
+					response.Error = err.Error()
 					messagesResponses.Messages = append(messagesResponses.Messages, *response)
 					continue
 				}
-				err = json.Unmarshal(c, &mqttOptions)
-				if err != nil {
-					response.Error = fmt.Sprintf("invalid cast parse for %s channel", channelName)
+
+				for _, recipient := range recipients {
+					response := putChannelMessage(ctx, client, user, subject, subjectChannel, channelName, channelValue, payload, recipient, putOptions{Delay: criteriaDelay})
 					messagesResponses.Messages = append(messagesResponses.Messages, *response)
-					continue
 				}
+			}
+		}
 
-				//define mqtt
-				mqtt := pigeon.MQTT{
-					Topic:   mqttOptions.Topic,
-					Payload: mqttContent.Payload,
-				}
+		response := new(Response)
+		response.Data = messagesResponses
 
-				content, err := json.Marshal(mqtt)
-				if err != nil {
-					response.Error = fmt.Sprintf("invalid json mashall for %s channel", channelName)
-					messagesResponses.Messages = append(messagesResponses.Messages, *response)
-					continue
-				}
+		if err := json.NewEncoder(w).Encode(response); err != nil {
+			getLogger(r).Error(err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+}
 
-				// 	Send MQTT message
-				id, err := sendMessage(client, string(content), pigeon.EndpointMQTT, subject.ID, criteriaDelay, user.ID)
-				if err != nil {
-					response.Error = err.Error()
-				} else {
-					// Save id inside message response
-					response.ID = id
-				}
+// putOptions are the scheduling options of a message.
+type putOptions struct {
+	// Delay is the time until the message is due.
+	Delay time.Duration
 
-				messagesResponses.Messages = append(messagesResponses.Messages, *response)
+	// ChainID and ChainStep place the message in an escalation chain.
+	ChainID   string
+	ChainStep int
+}
 
-				// prepare and send pigeon-http message
-			} else if channelName == pigeon.ServicePigeonHTTP {
-				// define http content
-				var httpContent *pigeon.HTTPContent
+// putEscalation puts the steps of the escalation policy of subject as a
+// chain of messages for recipient, each one due when the timeout of the
+// previous step expires. The chain starts after the criteria delay of its
+// first step.
+func putEscalation(ctx postMessageContext, client proto.SchedulerServiceClient, user *pigeon.User, subject *pigeon.Subject, payload *MessageRequest, recipient *pigeon.Recipient) []MessageResponse {
+	responses := make([]MessageResponse, 0, len(subject.Escalation))
 
-				c, err := json.Marshal(channelValue)
-				if err != nil {
-					response.Error = fmt.Sprintf("invalid json mashall for %s channel", channelName)
-					messagesResponses.Messages = append(messagesResponses.Messages, *response)
-					continue
-				}
-				err = json.Unmarshal(c, &httpContent)
-				if err != nil {
-					response.Error = fmt.Sprintf("invalid cast parse for %s channel", channelName)
-					messagesResponses.Messages = append(messagesResponses.Messages, *response)
-					continue
-				}
+	chainID, err := generateID(0)
+	if err != nil {
+		return append(responses, MessageResponse{Error: err.Error()})
+	}
 
-				//define http options
-				var httpOptions *pigeon.HTTPOptions
+	var delay time.Duration
+	step := 0
+	for _, es := range subject.Escalation {
+		response := new(MessageResponse)
+		response.Channel = es.Channel
 
-				c, err = json.Marshal(subjectChannel.Options)
-				if err != nil {
-					response.Error = fmt.Sprintf("invalid json mashall for %s channel", channelName)
-					messagesResponses.Messages = append(messagesResponses.Messages, *response)
-					continue
-				}
-				err = json.Unmarshal(c, &httpOptions)
-				if err != nil {
-					response.Error = fmt.Sprintf("invalid cast parse for %s channel", channelName)
-					messagesResponses.Messages = append(messagesResponses.Messages, *response)
-					continue
-				}
+		subjectChannel, err := getSubjectChannelByName(es.Channel, subject, ctx.ChannelStore)
+		if err != nil {
+			response.Error = err.Error()
+			responses = append(responses, *response)
+			continue
+		}
 
-				//define http
-				http := pigeon.HTTP{
-					Headers: httpOptions.Headers,
-					URL:     httpOptions.URL,
-					Body:    httpContent.Body,
-				}
+		if step == 0 {
+			delay, err = ctx.CriteriaStore.GetCriteriaDelay(subjectChannel.CriteriaID, subjectChannel.CriteriaCustom)
+			if err != nil {
+				response.Error = err.Error()
+				responses = append(responses, *response)
+				continue
+			}
+		}
 
-				content, err := json.Marshal(http)
-				if err != nil {
-					response.Error = fmt.Sprintf("invalid json mashall for %s channel", channelName)
-					messagesResponses.Messages = append(messagesResponses.Messages, *response)
-					continue
-				}
+		response = putChannelMessage(ctx, client, user, subject, subjectChannel, es.Channel, payload.Message.Channels[es.Channel], payload, recipient, putOptions{
+			Delay:     delay,
+			ChainID:   chainID,
+			ChainStep: step,
+		})
+		responses = append(responses, *response)
 
-				// 	Send MQTT message
-				id, err := sendMessage(client, string(content), pigeon.EndpointHTTP, subject.ID, criteriaDelay, user.ID)
-				if err != nil {
-					response.Error = err.Error()
-				} else {
-					// Save id inside message response
-					response.ID = id
-				}
+		// steps that were not put, such as suppressed channels, do not
+		// delay the chain.
+		if response.ID == "" {
+			continue
+		}
+		step++
+		delay += time.Duration(es.Timeout) * time.Second
+	}
 
-				messagesResponses.Messages = append(messagesResponses.Messages, *response)
-			} else {
-				response.Error = fmt.Sprintf("invalid channel name %s", channelName)
-				messagesResponses.Messages = append(messagesResponses.Messages, *response)
-			}
+	return responses
+}
+
+// putChannelMessage renders the content of a channel for recipient and puts
+// it in the scheduler.
+func putChannelMessage(ctx postMessageContext, client proto.SchedulerServiceClient, user *pigeon.User, subject *pigeon.Subject, subjectChannel *pigeon.SubjectChannel, channelName string, channelValue interface{}, payload *MessageRequest, recipient *pigeon.Recipient, opts putOptions) *MessageResponse {
+	response := new(MessageResponse)
+	response.Channel = channelName
+	response.ChainID = opts.ChainID
+
+	tag := payload.Message.Locale
+	vars := payload.Message.Variables
+
+	// the id is generated before rendering for the ack_url variable
+	id, err := generateID(opts.Delay)
+	if err != nil {
+		response.Error = err.Error()
+		return response
+	}
+	if len(ctx.AckSecret) > 0 {
+		vars = withVariable(vars, "ack_url", AckURL(ctx.PublicURL, id, SignAckToken(ctx.AckSecret, id)))
+	}
+
+	// the limits compare the request value, before the recipient address
+	// and the per message variables are set
+	limit, err := messageLimit(subject, recipient, channelName, channelValue, payload)
+	if err != nil {
+		response.Error = err.Error()
+		return response
+	}
+
+	// set the address of the recipient in the channel
+	if recipient != nil {
+		response.RecipientID = recipient.ID
+
+		// skip the channels suppressed by the recipient
+		if reason := checkPreference(recipient, subject, channelName); reason != "" {
+			response.Error = reason
+			return response
 		}
 
-		response := new(Response)
-		response.Data = messagesResponses
+		if tag == "" {
+			tag = recipient.Locale
+		}
+		vars = recipientVariables(ctx, user, subject, channelName, recipient, vars)
 
-		if err := json.NewEncoder(w).Encode(response); err != nil {
-			getLogger(r).Error(err)
-			http.Error(w, err.Error(), http.StatusInternalServerError)
-			return
+		channelValue, err = applyRecipient(channelName, channelValue, recipient)
+		if err != nil {
+			response.Error = err.Error()
+			return response
+		}
+	}
+
+	// render the template of the channel with the request variables
+	var loc *time.Location
+	if recipient != nil {
+		loc = location(recipient.Timezone)
+	}
+	channelValue, err = applyTemplate(ctx.TemplateStore, user.ID, subjectChannel, tag, loc, vars, channelValue)
+	if err != nil {
+		response.Error = err.Error()
+		return response
+	}
+
+	// build the backend content of the channel
+	content, endpoint, err := buildChannelContent(channelName, channelValue, subjectChannel, recipient)
+	if err != nil {
+		response.Error = err.Error()
+		return response
+	}
+
+	window, err := messageWindow(subjectChannel, subject, recipient)
+	if err != nil {
+		response.Error = err.Error()
+		return response
+	}
+
+	req := &proto.PutRequest{
+		Id:        id,
+		Content:   content,
+		Endpoint:  channelEndpoint(subjectChannel, endpoint),
+		Channel:   channelName,
+		SubjectId: subject.ID,
+		UserId:    user.ID,
+		ChainId:   opts.ChainID,
+		ChainStep: int32(opts.ChainStep),
+		Limit:     limit,
+		Priority:  messagePriority(payload, subject),
+	}
+
+	expiresAt, err := messageExpiry(payload, time.Now())
+	if err != nil {
+		response.Error = err.Error()
+		return response
+	}
+	if expiresAt != nil {
+		req.ExpiresAt = expiresAt.UnixNano() / int64(time.Millisecond)
+	}
+
+	// accumulate the message in the digest of its window, escalations are
+	// always sent at once
+	if subjectChannel.Digest != nil && opts.ChainID == "" {
+		digestID, err := digestID(subjectChannel, subject, recipient, channelName, time.Now().Add(opts.Delay))
+		if err != nil {
+			response.Error = err.Error()
+			return response
+		}
+
+		variables, err := digestVariables(payload.Message.Variables)
+		if err != nil {
+			response.Error = err.Error()
+			return response
+		}
+
+		req.DigestId = digestID
+		req.Digest = &proto.MessageDigest{SubjectChannelId: subjectChannel.ID, Locale: tag}
+		if recipient != nil {
+			req.Digest.RecipientId = recipient.ID
+		}
+		req.Variables = variables
+	}
+
+	if window != nil {
+		req.Window = &proto.DeliveryWindow{
+			Days:     window.Days,
+			Start:    window.Start,
+			End:      window.End,
+			Timezone: window.Timezone,
 		}
 	}
+
+	// send message
+	id, result, err := sendMessage(client, req, opts.Delay)
+	switch {
+	case err != nil:
+		response.Error = err.Error()
+	case result != "":
+		response.Result = result
+	default:
+		// Save id inside message response
+		response.ID = id
+		response.DigestID = req.DigestId
+	}
+
+	return response
+}
+
+// messagePriority returns the priority of the message request, critical
+// for critical subjects when it has none.
+func messagePriority(payload *MessageRequest, subject *pigeon.Subject) string {
+	if payload.Message.Priority != "" {
+		return payload.Message.Priority
+	}
+	if subject.Critical {
+		return pigeon.PriorityCritical
+	}
+	return pigeon.PriorityNormal
+}
+
+// messageExpiry returns when the message request expires, or nil when it
+// never does.
+func messageExpiry(payload *MessageRequest, now time.Time) (*time.Time, error) {
+	m := payload.Message
+	if m.ExpiresAt != nil && m.TTL != 0 {
+		return nil, errors.New("expires_at and ttl are exclusive")
+	}
+	if m.TTL < 0 {
+		return nil, fmt.Errorf("invalid ttl %d", m.TTL)
+	}
+
+	expiresAt := m.ExpiresAt
+	if m.TTL > 0 {
+		t := now.Add(time.Duration(m.TTL) * time.Second)
+		expiresAt = &t
+	}
+	if expiresAt != nil && !expiresAt.After(now) {
+		return nil, errors.New("message already expired")
+	}
+
+	return expiresAt, nil
+}
+
+// messageWindow returns the delivery window of a message in the timezone of
+// recipient, or nil when the subject channel has none or the subject
+// bypasses it.
+func messageWindow(sc *pigeon.SubjectChannel, subject *pigeon.Subject, recipient *pigeon.Recipient) (*pigeon.DeliveryWindow, error) {
+	if sc.Window == nil || (sc.Window.CriticalOverride && subject.Critical) {
+		return nil, nil
+	}
+
+	window := *sc.Window
+	if recipient != nil && recipient.Timezone != "" {
+		window.Timezone = recipient.Timezone
+	}
+
+	if err := window.Validate(); err != nil {
+		return nil, err
+	}
+
+	return &window, nil
+}
+
+// recipientVariables returns the template variables of a message sent to
+// recipient, adding its unsubscribe_url when links are enabled.
+func recipientVariables(ctx postMessageContext, user *pigeon.User, subject *pigeon.Subject, channelName string, recipient *pigeon.Recipient, vars map[string]interface{}) map[string]interface{} {
+	if len(ctx.UnsubscribeSecret) == 0 {
+		return vars
+	}
+
+	token, err := SignUnsubscribeToken(ctx.UnsubscribeSecret, user.ID, recipient.ID, subject.Name, channelName)
+	if err != nil {
+		log.Printf("Error: could not sign unsubscribe token, %v", err)
+		return vars
+	}
+
+	return withVariable(vars, "unsubscribe_url", UnsubscribeURL(ctx.PublicURL, token))
+}
+
+// withVariable returns a copy of vars with the variable key set.
+func withVariable(vars map[string]interface{}, key string, value interface{}) map[string]interface{} {
+	v := make(map[string]interface{}, len(vars)+1)
+	for k, value := range vars {
+		v[k] = value
+	}
+	v[key] = value
+
+	return v
+}
+
+// getMessageRecipients returns the recipients of a message request, or a
+// single nil recipient when the request has none.
+func getMessageRecipients(rs *db.RecipientStore, userID, recipientID string, recipientIDs []string) ([]*pigeon.Recipient, error) {
+	ids := recipientIDs
+	if recipientID != "" {
+		ids = append([]string{recipientID}, ids...)
+	}
+	if len(ids) == 0 {
+		return []*pigeon.Recipient{nil}, nil
+	}
+
+	seen := make(map[string]bool, len(ids))
+	recipients := make([]*pigeon.Recipient, 0, len(ids))
+	for _, id := range ids {
+		if seen[id] {
+			continue
+		}
+		seen[id] = true
+
+		r, err := rs.GetRecipient(userID, id)
+		if err != nil {
+			return nil, fmt.Errorf("recipient %s: %v", id, err)
+		}
+		recipients = append(recipients, r)
+	}
+
+	return recipients, nil
 }
 
 func getStatusMessageHTTPHandler(ctx getMessageStatusContext) func(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
@@ -596,17 +977,13 @@ func postCancelMessageHTTPHandler(ctx postCancelMessageContext) func(w http.Resp
 			return
 		}
 
-		// TODO(ca): check this
-		addr := fmt.Sprintf("localhost:%d", grpcPort)
-
 		// Grpc connection
-		conn, err := grpc.Dial(addr, grpc.WithInsecure())
+		conn, err := getSchedulerConn(ctx.Conns)
 		if err != nil {
 			getLogger(r).Error(err)
 			http.Error(w, err.Error(), http.StatusInternalServerError)
 			return
 		}
-		defer conn.Close()
 
 		// Define scheduler proto client
 		client := proto.NewSchedulerServiceClient(conn)
@@ -677,28 +1054,48 @@ func generateID(criteriaDelay time.Duration) (string, error) {
 	return id.String(), nil
 }
 
-func sendMessage(client proto.SchedulerServiceClient, content, endpoint, subjectID string, criteriaDelay time.Duration, userID string) (string, error) {
-	//generate uid
-	id, err := generateID(criteriaDelay)
-	if err != nil {
-		return "", err
+// sendMessage puts the message in the scheduler, the result is set instead
+// of the id when the limits of the message dropped it.
+func sendMessage(client proto.SchedulerServiceClient, req *proto.PutRequest, criteriaDelay time.Duration) (id, result string, err error) {
+	//generate uid, unless the request has one
+	if req.Id == "" {
+		id, err := generateID(criteriaDelay)
+		if err != nil {
+			return "", "", err
+		}
+		req.Id = id
 	}
 
 	// put message to scheduler
-	_, err = client.Put(context.Background(), &proto.PutRequest{
-		Id:        id,
-		Content:   []byte(content),
-		Endpoint:  endpoint,
-		SubjectId: subjectID,
-		UserId:    userID,
-	})
+	resp, err := client.Put(context.Background(), req)
 	if err != nil {
 		// TODO: move this error
 		log.Println("Put message failed, %v", err)
-		return "", err
+		return "", "", err
 	}
+	if resp.Result != "" {
+		return "", resp.Result, nil
+	}
+
+	return req.Id, "", nil
+}
+
+// getSchedulerConn returns the pooled connection to the scheduler grpc
+// service.
+func getSchedulerConn(conns *connpool.Pool) (*grpc.ClientConn, error) {
+	// TODO(ca): check this
+	addr := pigeon.NetAddr(fmt.Sprintf("localhost:%d", grpcPort))
 
-	return id, nil
+	return conns.Get(addr)
+}
+
+// channelEndpoint returns the host registered for the channel of sc, or
+// fallback when the channel has none.
+func channelEndpoint(sc *pigeon.SubjectChannel, fallback string) string {
+	if sc.Channel != nil && sc.Channel.Host != "" {
+		return sc.Channel.Host
+	}
+	return fallback
 }
 
 func getSubjectChannelByName(channelName string, subject *pigeon.Subject, cs *db.ChannelStore) (*pigeon.SubjectChannel, error) {
@@ -0,0 +1,78 @@
+package httpsvc
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"text/template"
+
+	"github.com/iampigeon/pigeon"
+	"github.com/iampigeon/pigeon/proto"
+)
+
+// messageLimit returns the throttle and deduplication limit of a message of
+// subject, or nil when the subject has none. The keys are scoped to the
+// subject, the recipient and the channel, and the deduplication key is the
+// explicit key of the request, the rendered Dedup.Key or a hash of the
+// request channel value and variables.
+func messageLimit(subject *pigeon.Subject, recipient *pigeon.Recipient, channelName string, channelValue interface{}, payload *MessageRequest) (*proto.MessageLimit, error) {
+	if subject.Throttle == nil && subject.Dedup == nil {
+		return nil, nil
+	}
+
+	var recipientID string
+	if recipient != nil {
+		recipientID = recipient.ID
+	}
+	scope := fmt.Sprintf("%s:%s:%s:%s", subject.UserID, subject.ID, recipientID, channelName)
+
+	limit := new(proto.MessageLimit)
+
+	if t := subject.Throttle; t != nil && t.Limit > 0 && t.Period > 0 {
+		limit.ThrottleKey = scope
+		limit.ThrottleLimit = int32(t.Limit)
+		limit.ThrottlePeriod = t.Period
+	}
+
+	if d := subject.Dedup; d != nil && d.Window > 0 {
+		key, err := dedupKey(d, channelValue, payload)
+		if err != nil {
+			return nil, err
+		}
+
+		sum := sha256.Sum256([]byte(key))
+		limit.DedupKey = scope + ":" + hex.EncodeToString(sum[:])
+		limit.DedupWindow = d.Window
+	}
+
+	return limit, nil
+}
+
+// dedupKey returns the value identifying the repetitions of a message.
+func dedupKey(d *pigeon.Dedup, channelValue interface{}, payload *MessageRequest) (string, error) {
+	if payload.Message.DedupKey != "" {
+		return payload.Message.DedupKey, nil
+	}
+
+	if d.Key != "" {
+		t, err := template.New("dedup").Option("missingkey=error").Parse(d.Key)
+		if err != nil {
+			return "", fmt.Errorf("invalid dedup key of subject, %v", err)
+		}
+
+		var buf bytes.Buffer
+		if err := t.Execute(&buf, payload.Message.Variables); err != nil {
+			return "", fmt.Errorf("could not render dedup key, %v", err)
+		}
+		return buf.String(), nil
+	}
+
+	// json encodes the keys of maps sorted, equal values hash the same.
+	b, err := json.Marshal([]interface{}{channelValue, payload.Message.Variables})
+	if err != nil {
+		return "", err
+	}
+	return string(b), nil
+}
@@ -0,0 +1,114 @@
+package httpsvc
+
+import (
+	"context"
+	"crypto/hmac"
+	"encoding/base64"
+	"fmt"
+	htmltemplate "html/template"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/iampigeon/pigeon"
+	"github.com/iampigeon/pigeon/connpool"
+	"github.com/iampigeon/pigeon/proto"
+	"github.com/julienschmidt/httprouter"
+	"github.com/oklog/ulid"
+)
+
+type ackContext struct {
+	Conns  *connpool.Pool
+	Secret []byte
+}
+
+// SignAckToken returns the token of the acknowledgement link of a message.
+func SignAckToken(secret []byte, id string) string {
+	return base64.RawURLEncoding.EncodeToString(sign(secret, "ack."+id))
+}
+
+// AckURL returns the public acknowledgement link of a message.
+func AckURL(publicURL, id, token string) string {
+	return fmt.Sprintf("%s/api/v1/messages/%s/ack?token=%s", strings.TrimSuffix(publicURL, "/"), id, url.QueryEscape(token))
+}
+
+// ackPage asks the recipient to confirm the acknowledgement, so link
+// scanners and previews that follow the link do not acknowledge the message.
+var ackPage = htmltemplate.Must(htmltemplate.New("ack").Parse(`<!DOCTYPE html>
+<html>
+<head><meta charset="utf-8"><title>Acknowledge message</title></head>
+<body>
+<form method="post">
+<input type="hidden" name="token" value="{{.}}">
+<button type="submit">Acknowledge message</button>
+</form>
+</body>
+</html>
+`))
+
+// verifyAck returns the id of the message of the acknowledgement request
+// when its token is valid, writing the error response otherwise.
+func verifyAck(ctx ackContext, w http.ResponseWriter, r *http.Request, ps httprouter.Params) (ulid.ULID, string, bool) {
+	id, err := ulid.Parse(ps.ByName("id"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return id, "", false
+	}
+
+	token := r.FormValue("token")
+	if len(ctx.Secret) == 0 || !hmac.Equal([]byte(token), []byte(SignAckToken(ctx.Secret, id.String()))) {
+		http.Error(w, "invalid ack token", http.StatusForbidden)
+		return id, "", false
+	}
+
+	return id, token, true
+}
+
+// getAckMessageHTTPHandler serves the page of an acknowledgement link,
+// which posts the acknowledgement once the recipient confirms it.
+func getAckMessageHTTPHandler(ctx ackContext) func(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	return func(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+		_, token, ok := verifyAck(ctx, w, r, ps)
+		if !ok {
+			return
+		}
+
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		if err := ackPage.Execute(w, token); err != nil {
+			getLogger(r).Error(err)
+		}
+	}
+}
+
+// ackMessageHTTPHandler records that the recipient acknowledged a message.
+// It is public, the token of the link authenticates the request.
+func ackMessageHTTPHandler(ctx ackContext) func(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	return func(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+		id, _, ok := verifyAck(ctx, w, r, ps)
+		if !ok {
+			return
+		}
+
+		conn, err := getSchedulerConn(ctx.Conns)
+		if err != nil {
+			getLogger(r).Error(err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		client := proto.NewSchedulerServiceClient(conn)
+		_, err = client.ReportReceipt(context.Background(), &proto.ReportReceiptRequest{
+			Id:     id.String(),
+			Status: string(pigeon.StatusAcknowledged),
+			Source: pigeon.SourceRecipient,
+		})
+		if err != nil {
+			getLogger(r).Error(err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		fmt.Fprintln(w, "Message acknowledged.")
+	}
+}
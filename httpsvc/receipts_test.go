@@ -0,0 +1,72 @@
+package httpsvc
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/julienschmidt/httprouter"
+	"github.com/oklog/ulid"
+)
+
+func TestAckPage(t *testing.T) {
+	secret := []byte("ack-secret")
+	id := ulid.MustParse("01CQ9Y2X3E2ABCDEFGHJKMNPQR").String()
+	token := SignAckToken(secret, id)
+
+	// the page is served without a scheduler, a GET never acknowledges.
+	ctx := ackContext{Secret: secret}
+	ps := httprouter.Params{{Key: "id", Value: id}}
+
+	link, err := url.Parse(AckURL("https://pigeon.example.com", id, token))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	w := httptest.NewRecorder()
+	getAckMessageHTTPHandler(ctx)(w, httptest.NewRequest(http.MethodGet, link.RequestURI(), nil), ps)
+	if w.Code != http.StatusOK {
+		t.Fatalf("status %d, want 200", w.Code)
+	}
+	if ct := w.Header().Get("Content-Type"); !strings.HasPrefix(ct, "text/html") {
+		t.Errorf("content type %s", ct)
+	}
+	body := w.Body.String()
+	if !strings.Contains(body, `<form method="post">`) || !strings.Contains(body, `value="`+token+`"`) {
+		t.Errorf("page without the confirmation form:\n%s", body)
+	}
+}
+
+func TestAckInvalidToken(t *testing.T) {
+	secret := []byte("ack-secret")
+	id := ulid.MustParse("01CQ9Y2X3E2ABCDEFGHJKMNPQR").String()
+	ps := httprouter.Params{{Key: "id", Value: id}}
+
+	tests := []struct {
+		name    string
+		secret  []byte
+		handler func(ackContext) func(http.ResponseWriter, *http.Request, httprouter.Params)
+		method  string
+		token   string
+	}{
+		{"get with another token", secret, getAckMessageHTTPHandler, http.MethodGet, SignAckToken(secret, "other")},
+		{"post with another token", secret, ackMessageHTTPHandler, http.MethodPost, SignAckToken(secret, "other")},
+		{"post without secret", nil, ackMessageHTTPHandler, http.MethodPost, ""},
+	}
+	for _, tt := range tests {
+		form := url.Values{"token": {tt.token}}
+		r := httptest.NewRequest(tt.method, "/api/v1/messages/"+id+"/ack", strings.NewReader(form.Encode()))
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		if tt.method == http.MethodGet {
+			r = httptest.NewRequest(tt.method, "/api/v1/messages/"+id+"/ack?"+form.Encode(), nil)
+		}
+
+		w := httptest.NewRecorder()
+		tt.handler(ackContext{Secret: tt.secret})(w, r, ps)
+		if w.Code != http.StatusForbidden {
+			t.Errorf("%s: status %d, want 403", tt.name, w.Code)
+		}
+	}
+}
@@ -0,0 +1,267 @@
+package httpsvc
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"time"
+
+	"github.com/iampigeon/pigeon"
+	"github.com/iampigeon/pigeon/db"
+	"github.com/iampigeon/pigeon/locale"
+	"github.com/julienschmidt/httprouter"
+)
+
+// RecipientRequest ...
+type RecipientRequest struct {
+	Recipient *pigeon.Recipient `json:"recipient"`
+}
+
+// RecipientResponse ...
+type RecipientResponse struct {
+	Recipient *pigeon.Recipient `json:"recipient"`
+}
+
+// RecipientsResponse ...
+type RecipientsResponse struct {
+	Recipients []*pigeon.Recipient `json:"recipients"`
+}
+
+type recipientContext struct {
+	UserStore      *db.UserStore
+	RecipientStore *db.RecipientStore
+}
+
+// validateRecipient checks the locale, timezone, contact points and
+// preferences of r.
+func validateRecipient(r *pigeon.Recipient) error {
+	if r.Locale != "" {
+		if !locale.Valid(r.Locale) {
+			return fmt.Errorf("invalid locale %s", r.Locale)
+		}
+		r.Locale = locale.Normalize(r.Locale)
+	}
+
+	if r.Timezone != "" {
+		if _, err := time.LoadLocation(r.Timezone); err != nil {
+			return fmt.Errorf("invalid timezone %s", r.Timezone)
+		}
+	}
+
+	if r.ContactPoints == nil {
+		r.ContactPoints = make([]*pigeon.ContactPoint, 0)
+	}
+	for _, cp := range r.ContactPoints {
+		if cp == nil {
+			return fmt.Errorf("invalid contact point")
+		}
+		if _, ok := recipientFields[cp.Channel]; !ok {
+			return fmt.Errorf("channel %s does not support recipients", cp.Channel)
+		}
+		if cp.Address == "" {
+			return fmt.Errorf("missing %s contact point address", cp.Channel)
+		}
+	}
+
+	for _, p := range r.Preferences {
+		if p == nil {
+			return fmt.Errorf("invalid preference")
+		}
+		if _, ok := recipientFields[p.Channel]; p.Channel != "" && !ok {
+			return fmt.Errorf("channel %s does not support recipients", p.Channel)
+		}
+	}
+
+	return nil
+}
+
+// readRecipient decodes the recipient of the request body.
+func readRecipient(r *http.Request) (*pigeon.Recipient, error) {
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Body.Close()
+
+	payload := new(RecipientRequest)
+	if err := json.Unmarshal(body, payload); err != nil || payload.Recipient == nil {
+		return nil, fmt.Errorf("invalid recipient request")
+	}
+
+	if err := validateRecipient(payload.Recipient); err != nil {
+		return nil, err
+	}
+
+	return payload.Recipient, nil
+}
+
+func getRecipientsHTTPHandler(ctx recipientContext) func(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	return func(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+		w.Header().Set("Content-Type", "application/json")
+
+		user, err := ctx.UserStore.GetUserByAPIKey(r.Header.Get("X-Api-Key"))
+		if err != nil {
+			getLogger(r).Error(err)
+			http.Error(w, err.Error(), http.StatusUnauthorized)
+			return
+		}
+
+		recipients, err := ctx.RecipientStore.GetRecipientsByUserID(user.ID)
+		if err != nil {
+			getLogger(r).Error(err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		response := new(Response)
+		response.Data = &RecipientsResponse{Recipients: recipients}
+
+		if err := json.NewEncoder(w).Encode(response); err != nil {
+			getLogger(r).Error(err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+}
+
+func postRecipientHTTPHandler(ctx recipientContext) func(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	return func(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+		w.Header().Set("Content-Type", "application/json")
+
+		user, err := ctx.UserStore.GetUserByAPIKey(r.Header.Get("X-Api-Key"))
+		if err != nil {
+			getLogger(r).Error(err)
+			http.Error(w, err.Error(), http.StatusUnauthorized)
+			return
+		}
+
+		recipient, err := readRecipient(r)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		id, err := generateID(0)
+		if err != nil {
+			getLogger(r).Error(err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		recipient.ID = id
+		recipient.UserID = user.ID
+
+		if err := ctx.RecipientStore.AddRecipient(recipient); err != nil {
+			getLogger(r).Error(err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		response := new(Response)
+		response.Data = &RecipientResponse{Recipient: recipient}
+
+		w.WriteHeader(http.StatusCreated)
+		if err := json.NewEncoder(w).Encode(response); err != nil {
+			getLogger(r).Error(err)
+			return
+		}
+	}
+}
+
+func getRecipientHTTPHandler(ctx recipientContext) func(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	return func(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+		w.Header().Set("Content-Type", "application/json")
+
+		user, err := ctx.UserStore.GetUserByAPIKey(r.Header.Get("X-Api-Key"))
+		if err != nil {
+			getLogger(r).Error(err)
+			http.Error(w, err.Error(), http.StatusUnauthorized)
+			return
+		}
+
+		recipient, err := ctx.RecipientStore.GetRecipient(user.ID, ps.ByName("id"))
+		if err == db.ErrRecipientNotFound {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+		if err != nil {
+			getLogger(r).Error(err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		response := new(Response)
+		response.Data = &RecipientResponse{Recipient: recipient}
+
+		if err := json.NewEncoder(w).Encode(response); err != nil {
+			getLogger(r).Error(err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+}
+
+func putRecipientHTTPHandler(ctx recipientContext) func(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	return func(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+		w.Header().Set("Content-Type", "application/json")
+
+		user, err := ctx.UserStore.GetUserByAPIKey(r.Header.Get("X-Api-Key"))
+		if err != nil {
+			getLogger(r).Error(err)
+			http.Error(w, err.Error(), http.StatusUnauthorized)
+			return
+		}
+
+		recipient, err := readRecipient(r)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		recipient.ID = ps.ByName("id")
+		recipient.UserID = user.ID
+
+		err = ctx.RecipientStore.UpdateRecipient(recipient)
+		if err == db.ErrRecipientNotFound {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+		if err != nil {
+			getLogger(r).Error(err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		response := new(Response)
+		response.Data = &RecipientResponse{Recipient: recipient}
+
+		if err := json.NewEncoder(w).Encode(response); err != nil {
+			getLogger(r).Error(err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+}
+
+func deleteRecipientHTTPHandler(ctx recipientContext) func(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	return func(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+		user, err := ctx.UserStore.GetUserByAPIKey(r.Header.Get("X-Api-Key"))
+		if err != nil {
+			getLogger(r).Error(err)
+			http.Error(w, err.Error(), http.StatusUnauthorized)
+			return
+		}
+
+		err = ctx.RecipientStore.DeleteRecipient(user.ID, ps.ByName("id"))
+		if err == db.ErrRecipientNotFound {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+		if err != nil {
+			getLogger(r).Error(err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
@@ -0,0 +1,429 @@
+package httpsvc
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	htmltemplate "html/template"
+	"io/ioutil"
+	"net/http"
+	texttemplate "text/template"
+	"time"
+
+	"github.com/iampigeon/pigeon"
+	"github.com/iampigeon/pigeon/db"
+	"github.com/iampigeon/pigeon/locale"
+	"github.com/julienschmidt/httprouter"
+)
+
+// TemplateRequest ...
+type TemplateRequest struct {
+	Template *struct {
+		Fields  map[string]string            `json:"fields"`
+		Locales map[string]map[string]string `json:"locales,omitempty"`
+		Digest  map[string]string            `json:"digest,omitempty"`
+		JSON    []string                     `json:"json,omitempty"`
+	} `json:"template"`
+}
+
+// TemplateResponse ...
+type TemplateResponse struct {
+	Template *pigeon.Template `json:"template"`
+}
+
+// PreviewRequest ...
+type PreviewRequest struct {
+	Variables map[string]interface{} `json:"variables"`
+	Locale    string                 `json:"locale,omitempty"`
+
+	// Timezone is the IANA timezone of the formatted times, UTC when
+	// empty.
+	Timezone string `json:"timezone,omitempty"`
+
+	// Value is merged with the rendered fields like the channel value of a
+	// message request.
+	Value map[string]interface{} `json:"value,omitempty"`
+}
+
+// PreviewResponse ...
+type PreviewResponse struct {
+	Content json.RawMessage `json:"content"`
+}
+
+type templateContext struct {
+	SubjectStore  *db.SubjectStore
+	UserStore     *db.UserStore
+	ChannelStore  *db.ChannelStore
+	TemplateStore *db.TemplateStore
+}
+
+// parseField parses the template of a content field, html/template for the
+// "html" field and text/template for the others, with the formatting
+// functions of the locale, which format times in loc. Missing variables fail
+// the rendering instead of printing "<no value>".
+func parseField(name, text, tag string, loc *time.Location) (func(vars map[string]interface{}) (string, error), error) {
+	var execute func(buf *bytes.Buffer, vars map[string]interface{}) error
+
+	funcs := locale.Lookup(tag).Funcs(loc)
+
+	if name == "html" {
+		t, err := htmltemplate.New(name).Funcs(funcs).Option("missingkey=error").Parse(text)
+		if err != nil {
+			return nil, err
+		}
+		execute = func(buf *bytes.Buffer, vars map[string]interface{}) error { return t.Execute(buf, vars) }
+	} else {
+		t, err := texttemplate.New(name).Funcs(funcs).Option("missingkey=error").Parse(text)
+		if err != nil {
+			return nil, err
+		}
+		execute = func(buf *bytes.Buffer, vars map[string]interface{}) error { return t.Execute(buf, vars) }
+	}
+
+	return func(vars map[string]interface{}) (string, error) {
+		var buf bytes.Buffer
+		if err := execute(&buf, vars); err != nil {
+			return "", err
+		}
+		return buf.String(), nil
+	}, nil
+}
+
+// validateTemplate checks the locale tags and the syntax of all the fields
+// of t.
+func validateTemplate(t *pigeon.Template) error {
+	if len(t.Fields) == 0 {
+		return fmt.Errorf("missing template fields")
+	}
+	for name, text := range t.Fields {
+		if _, err := parseField(name, text, "", nil); err != nil {
+			return fmt.Errorf("invalid template for field %s, %v", name, err)
+		}
+	}
+
+	for name, text := range t.Digest {
+		if _, err := parseField(name, text, "", nil); err != nil {
+			return fmt.Errorf("invalid digest template for field %s, %v", name, err)
+		}
+	}
+
+	locales := make(map[string]map[string]string, len(t.Locales))
+	for tag, fields := range t.Locales {
+		if !locale.Valid(tag) {
+			return fmt.Errorf("invalid locale %s", tag)
+		}
+		for name, text := range fields {
+			if _, err := parseField(name, text, tag, nil); err != nil {
+				return fmt.Errorf("invalid %s template for field %s, %v", tag, name, err)
+			}
+		}
+		locales[locale.Normalize(tag)] = fields
+	}
+	t.Locales = locales
+
+	for _, name := range t.JSON {
+		_, field := t.Fields[name]
+		_, digest := t.Digest[name]
+		if !field && !digest {
+			return fmt.Errorf("json field %s is not a template field", name)
+		}
+	}
+
+	return nil
+}
+
+// localizedFields returns the fields of t for tag, each taken from the most
+// specific locale of the fallback chain of tag that defines it.
+func localizedFields(t *pigeon.Template, tag string) map[string]string {
+	fields := make(map[string]string, len(t.Fields))
+	for name, text := range t.Fields {
+		fields[name] = text
+	}
+
+	chain := locale.Chain(tag)
+	for i := len(chain) - 1; i >= 0; i-- {
+		for name, text := range t.Locales[chain[i]] {
+			fields[name] = text
+		}
+	}
+
+	return fields
+}
+
+// renderTemplate renders the fields of t for the locale tag and the times in
+// loc with vars, and merges them into the channel value of the request, whose
+// fields take precedence. The rendered values of the json fields of t are
+// decoded, so fields such as email "to" or "mqtt_payload" can be templated
+// too.
+func renderTemplate(t *pigeon.Template, tag string, loc *time.Location, vars map[string]interface{}, value interface{}) (map[string]interface{}, error) {
+	content := make(map[string]interface{})
+	if value != nil {
+		if err := decode("template", value, &content); err != nil {
+			return nil, err
+		}
+	}
+
+	jsonFields := make(map[string]bool, len(t.JSON))
+	for _, name := range t.JSON {
+		jsonFields[name] = true
+	}
+
+	for name, text := range localizedFields(t, tag) {
+		if _, ok := content[name]; ok {
+			continue
+		}
+
+		render, err := parseField(name, text, tag, loc)
+		if err != nil {
+			return nil, fmt.Errorf("invalid template for field %s, %v", name, err)
+		}
+
+		out, err := render(vars)
+		if err != nil {
+			return nil, fmt.Errorf("could not render field %s, %v", name, err)
+		}
+
+		var v interface{} = out
+		if jsonFields[name] {
+			if err := json.Unmarshal([]byte(out), &v); err != nil {
+				return nil, fmt.Errorf("field %s is not valid json, %v", name, err)
+			}
+		}
+		content[name] = v
+	}
+
+	return content, nil
+}
+
+// applyTemplate renders the template of sc for the locale tag and the times
+// in loc when it has one, otherwise value is returned as is.
+func applyTemplate(ts *db.TemplateStore, userID string, sc *pigeon.SubjectChannel, tag string, loc *time.Location, vars map[string]interface{}, value interface{}) (interface{}, error) {
+	t, err := ts.GetTemplate(userID, sc.ID)
+	if err == db.ErrTemplateNotFound {
+		return value, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return renderTemplate(t, tag, loc, vars, value)
+}
+
+// location returns the location of the IANA timezone tz, nil for UTC when it
+// is empty or unknown.
+func location(tz string) *time.Location {
+	if tz == "" {
+		return nil
+	}
+	loc, err := time.LoadLocation(tz)
+	if err != nil {
+		return nil
+	}
+	return loc
+}
+
+// templateChannels returns the channels of subject that have a template,
+// with no request value.
+func templateChannels(ts *db.TemplateStore, cs *db.ChannelStore, userID string, subject *pigeon.Subject) map[string]interface{} {
+	channels := make(map[string]interface{})
+	for _, sc := range subject.Channels {
+		if _, err := ts.GetTemplate(userID, sc.ID); err != nil {
+			continue
+		}
+
+		ch, err := cs.GetChannelById(sc.ChannelID)
+		if err != nil {
+			continue
+		}
+		channels[ch.Name] = nil
+	}
+	return channels
+}
+
+// getTemplateSubjectChannel returns the user subject channel of the route
+// parameters.
+func getTemplateSubjectChannel(ctx templateContext, r *http.Request, ps httprouter.Params) (*pigeon.User, *pigeon.SubjectChannel, int, error) {
+	user, err := ctx.UserStore.GetUserByAPIKey(r.Header.Get("X-Api-Key"))
+	if err != nil {
+		return nil, nil, http.StatusUnauthorized, err
+	}
+
+	subject, err := ctx.SubjectStore.GetUserSubjectByName(user.ID, ps.ByName("subject"))
+	if err != nil {
+		return nil, nil, http.StatusNotFound, err
+	}
+
+	sc, err := getSubjectChannelByName(ps.ByName("channel"), subject, ctx.ChannelStore)
+	if err != nil {
+		return nil, nil, http.StatusNotFound, err
+	}
+
+	return user, sc, http.StatusOK, nil
+}
+
+func putTemplateHTTPHandler(ctx templateContext) func(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	return func(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+		w.Header().Set("Content-Type", "application/json")
+
+		user, sc, code, err := getTemplateSubjectChannel(ctx, r, ps)
+		if err != nil {
+			getLogger(r).Error(err)
+			http.Error(w, err.Error(), code)
+			return
+		}
+
+		body, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			getLogger(r).Error(err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		defer r.Body.Close()
+
+		payload := new(TemplateRequest)
+		if err := json.Unmarshal(body, payload); err != nil || payload.Template == nil {
+			http.Error(w, "invalid template request", http.StatusBadRequest)
+			return
+		}
+
+		id, err := generateID(0)
+		if err != nil {
+			getLogger(r).Error(err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		t := &pigeon.Template{
+			ID:               id,
+			UserID:           user.ID,
+			SubjectChannelID: sc.ID,
+			Fields:           payload.Template.Fields,
+			Locales:          payload.Template.Locales,
+			Digest:           payload.Template.Digest,
+			JSON:             payload.Template.JSON,
+		}
+
+		// reject templates that would fail on every message.
+		if err := validateTemplate(t); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		if err := ctx.TemplateStore.SaveTemplate(t); err != nil {
+			getLogger(r).Error(err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		response := new(Response)
+		response.Data = &TemplateResponse{Template: t}
+
+		if err := json.NewEncoder(w).Encode(response); err != nil {
+			getLogger(r).Error(err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+}
+
+func getTemplateHTTPHandler(ctx templateContext) func(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	return func(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+		w.Header().Set("Content-Type", "application/json")
+
+		user, sc, code, err := getTemplateSubjectChannel(ctx, r, ps)
+		if err != nil {
+			getLogger(r).Error(err)
+			http.Error(w, err.Error(), code)
+			return
+		}
+
+		t, err := ctx.TemplateStore.GetTemplate(user.ID, sc.ID)
+		if err == db.ErrTemplateNotFound {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+		if err != nil {
+			getLogger(r).Error(err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		response := new(Response)
+		response.Data = &TemplateResponse{Template: t}
+
+		if err := json.NewEncoder(w).Encode(response); err != nil {
+			getLogger(r).Error(err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+}
+
+// postPreviewTemplateHTTPHandler renders the template of a subject channel
+// and returns the content that would be sent to its backend, without
+// sending it.
+func postPreviewTemplateHTTPHandler(ctx templateContext) func(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	return func(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+		w.Header().Set("Content-Type", "application/json")
+
+		user, sc, code, err := getTemplateSubjectChannel(ctx, r, ps)
+		if err != nil {
+			getLogger(r).Error(err)
+			http.Error(w, err.Error(), code)
+			return
+		}
+
+		body, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			getLogger(r).Error(err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		defer r.Body.Close()
+
+		payload := new(PreviewRequest)
+		if err := json.Unmarshal(body, payload); err != nil {
+			http.Error(w, "invalid preview request", http.StatusBadRequest)
+			return
+		}
+
+		t, err := ctx.TemplateStore.GetTemplate(user.ID, sc.ID)
+		if err == db.ErrTemplateNotFound {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+		if err != nil {
+			getLogger(r).Error(err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		if payload.Timezone != "" {
+			if _, err := time.LoadLocation(payload.Timezone); err != nil {
+				http.Error(w, fmt.Sprintf("invalid timezone %s", payload.Timezone), http.StatusBadRequest)
+				return
+			}
+		}
+
+		value, err := renderTemplate(t, payload.Locale, location(payload.Timezone), payload.Variables, payload.Value)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		content, _, err := buildChannelContent(sc.Channel.Name, value, sc, nil)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		response := new(Response)
+		response.Data = &PreviewResponse{Content: content}
+
+		if err := json.NewEncoder(w).Encode(response); err != nil {
+			getLogger(r).Error(err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+}
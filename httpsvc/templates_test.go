@@ -0,0 +1,126 @@
+package httpsvc
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/iampigeon/pigeon"
+)
+
+func TestRenderTemplateLocation(t *testing.T) {
+	tmpl := &pigeon.Template{Fields: map[string]string{"text": "{{datetime .at}}"}}
+	vars := map[string]interface{}{"at": "2018-12-31T23:30:00Z"}
+
+	tests := []struct {
+		tag      string
+		timezone string
+		want     string
+	}{
+		{"", "", "2018-12-31 23:30"},
+		{"es-CL", "America/Santiago", "31-12-2018 20:30"},
+		{"en-US", "America/New_York", "12/31/2018 6:30 PM"},
+		{"", "Nowhere/Unknown", "2018-12-31 23:30"},
+	}
+	for _, tt := range tests {
+		content, err := renderTemplate(tmpl, tt.tag, location(tt.timezone), vars, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if content["text"] != tt.want {
+			t.Errorf("%s in %q: %q, want %q", tt.tag, tt.timezone, content["text"], tt.want)
+		}
+	}
+}
+
+func TestRenderTemplateJSON(t *testing.T) {
+	tmpl := &pigeon.Template{
+		Fields: map[string]string{
+			"to":   `["{{.email}}"]`,
+			"text": `{"not": "decoded"}`,
+		},
+		JSON: []string{"to"},
+	}
+
+	content, err := renderTemplate(tmpl, "", nil, map[string]interface{}{"email": "ada@example.com"}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []interface{}{"ada@example.com"}; !reflect.DeepEqual(content["to"], want) {
+		t.Errorf("to = %#v, want %#v", content["to"], want)
+	}
+	if content["text"] != `{"not": "decoded"}` {
+		t.Errorf("text = %#v, want the rendered string", content["text"])
+	}
+
+	// a json field that does not render json fails the message.
+	tmpl.Fields["to"] = "{{.email}}"
+	if _, err := renderTemplate(tmpl, "", nil, map[string]interface{}{"email": "ada@example.com"}, nil); err == nil {
+		t.Error("rendered an invalid json field")
+	}
+}
+
+func TestRenderTemplateLocales(t *testing.T) {
+	tmpl := &pigeon.Template{
+		Fields: map[string]string{"subject": "Alert", "text": "temperature is {{number .t 1}}"},
+		Locales: map[string]map[string]string{
+			"es":    {"subject": "Alerta", "text": "la temperatura es {{number .t 1}}"},
+			"es-CL": {"subject": "Alerta CL"},
+		},
+	}
+	vars := map[string]interface{}{"t": 1234.5}
+
+	content, err := renderTemplate(tmpl, "es-cl", nil, vars, map[string]interface{}{"phone": "+56912345678"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]interface{}{
+		"subject": "Alerta CL",
+		"text":    "la temperatura es 1.234,5",
+		"phone":   "+56912345678",
+	}
+	if !reflect.DeepEqual(content, want) {
+		t.Errorf("content = %v, want %v", content, want)
+	}
+
+	// fields of the request value take precedence.
+	content, err = renderTemplate(tmpl, "", nil, vars, map[string]interface{}{"subject": "Custom"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if content["subject"] != "Custom" {
+		t.Errorf("subject = %v, want the request value", content["subject"])
+	}
+
+	if _, err := renderTemplate(tmpl, "", nil, map[string]interface{}{}, nil); err == nil {
+		t.Error("rendered with a missing variable")
+	}
+}
+
+func TestValidateTemplate(t *testing.T) {
+	tests := []struct {
+		name string
+		tmpl pigeon.Template
+	}{
+		{"without fields", pigeon.Template{}},
+		{"syntax", pigeon.Template{Fields: map[string]string{"text": "{{.a"}}},
+		{"locale", pigeon.Template{Fields: map[string]string{"text": "a"}, Locales: map[string]map[string]string{"not a locale": {"text": "b"}}}},
+		{"json field", pigeon.Template{Fields: map[string]string{"text": "a"}, JSON: []string{"to"}}},
+	}
+	for _, tt := range tests {
+		if err := validateTemplate(&tt.tmpl); err == nil {
+			t.Errorf("invalid %s validated", tt.name)
+		}
+	}
+
+	tmpl := pigeon.Template{
+		Fields:  map[string]string{"to": `["{{.email}}"]`},
+		Locales: map[string]map[string]string{"es_cl": {"to": `["{{.email}}"]`}},
+		JSON:    []string{"to"},
+	}
+	if err := validateTemplate(&tmpl); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := tmpl.Locales["es-CL"]; !ok {
+		t.Errorf("locales not normalized: %v", tmpl.Locales)
+	}
+}
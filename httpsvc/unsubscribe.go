@@ -0,0 +1,184 @@
+package httpsvc
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/iampigeon/pigeon"
+	"github.com/iampigeon/pigeon/db"
+	"github.com/julienschmidt/httprouter"
+)
+
+// unsubscribeClaims are the signed fields of an unsubscribe token. An empty
+// Subject or Channel opts out of all of them.
+type unsubscribeClaims struct {
+	UserID      string `json:"u"`
+	RecipientID string `json:"r"`
+	Subject     string `json:"s,omitempty"`
+	Channel     string `json:"c,omitempty"`
+}
+
+// UnsubscribeResponse ...
+type UnsubscribeResponse struct {
+	URL string `json:"url"`
+}
+
+type unsubscribeContext struct {
+	UserStore      *db.UserStore
+	RecipientStore *db.RecipientStore
+
+	Secret    []byte
+	PublicURL string
+}
+
+// SignUnsubscribeToken returns a token that opts the recipient out of the
+// messages of subject in channel, signed with HMAC-SHA256.
+func SignUnsubscribeToken(secret []byte, userID, recipientID, subject, channel string) (string, error) {
+	if len(secret) == 0 {
+		return "", errors.New("missing unsubscribe secret")
+	}
+
+	payload, err := json.Marshal(unsubscribeClaims{
+		UserID:      userID,
+		RecipientID: recipientID,
+		Subject:     subject,
+		Channel:     channel,
+	})
+	if err != nil {
+		return "", err
+	}
+
+	p := base64.RawURLEncoding.EncodeToString(payload)
+	return p + "." + base64.RawURLEncoding.EncodeToString(sign(secret, p)), nil
+}
+
+// UnsubscribeURL returns the public unsubscribe link of a token.
+func UnsubscribeURL(publicURL, token string) string {
+	return strings.TrimSuffix(publicURL, "/") + "/unsubscribe/" + url.PathEscape(token)
+}
+
+func verifyUnsubscribeToken(secret []byte, token string) (*unsubscribeClaims, error) {
+	parts := strings.Split(token, ".")
+	if len(secret) == 0 || len(parts) != 2 {
+		return nil, errors.New("invalid unsubscribe token")
+	}
+
+	mac, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil || !hmac.Equal(mac, sign(secret, parts[0])) {
+		return nil, errors.New("invalid unsubscribe token")
+	}
+
+	payload, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil {
+		return nil, errors.New("invalid unsubscribe token")
+	}
+
+	claims := new(unsubscribeClaims)
+	if err := json.Unmarshal(payload, claims); err != nil {
+		return nil, errors.New("invalid unsubscribe token")
+	}
+
+	return claims, nil
+}
+
+func sign(secret []byte, payload string) []byte {
+	h := hmac.New(sha256.New, secret)
+	h.Write([]byte(payload))
+	return h.Sum(nil)
+}
+
+// checkPreference returns the reason why recipient does not receive the
+// messages of subject in channel, or an empty string.
+func checkPreference(recipient *pigeon.Recipient, subject *pigeon.Subject, channel string) string {
+	p := recipient.Preference(subject.Name, channel)
+	switch {
+	case p == nil:
+		return ""
+	case p.OptOut:
+		return fmt.Sprintf("recipient %s opted out of %s messages of %s", recipient.ID, channel, subject.Name)
+	case p.CriticalOnly && !subject.Critical:
+		return fmt.Sprintf("recipient %s only receives critical %s messages", recipient.ID, channel)
+	}
+	return ""
+}
+
+// getUnsubscribeURLHTTPHandler returns the unsubscribe link of a recipient
+// for the subject and channel query parameters.
+func getUnsubscribeURLHTTPHandler(ctx unsubscribeContext) func(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	return func(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+		w.Header().Set("Content-Type", "application/json")
+
+		user, err := ctx.UserStore.GetUserByAPIKey(r.Header.Get("X-Api-Key"))
+		if err != nil {
+			getLogger(r).Error(err)
+			http.Error(w, err.Error(), http.StatusUnauthorized)
+			return
+		}
+
+		recipient, err := ctx.RecipientStore.GetRecipient(user.ID, ps.ByName("id"))
+		if err == db.ErrRecipientNotFound {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+		if err != nil {
+			getLogger(r).Error(err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		q := r.URL.Query()
+		token, err := SignUnsubscribeToken(ctx.Secret, user.ID, recipient.ID, q.Get("subject"), q.Get("channel"))
+		if err != nil {
+			getLogger(r).Error(err)
+			http.Error(w, err.Error(), http.StatusNotImplemented)
+			return
+		}
+
+		response := new(Response)
+		response.Data = &UnsubscribeResponse{URL: UnsubscribeURL(ctx.PublicURL, token)}
+
+		if err := json.NewEncoder(w).Encode(response); err != nil {
+			getLogger(r).Error(err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+}
+
+// unsubscribeHTTPHandler records the opt-out of a signed unsubscribe link.
+// It is public, the token authenticates the request. Both GET, for links,
+// and POST, for one-click List-Unsubscribe, are accepted.
+func unsubscribeHTTPHandler(ctx unsubscribeContext) func(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	return func(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+		claims, err := verifyUnsubscribeToken(ctx.Secret, ps.ByName("token"))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		err = ctx.RecipientStore.SetPreference(claims.UserID, claims.RecipientID, &pigeon.Preference{
+			Subject: claims.Subject,
+			Channel: claims.Channel,
+			OptOut:  true,
+		})
+		if err == db.ErrRecipientNotFound {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+		if err != nil {
+			getLogger(r).Error(err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		fmt.Fprintln(w, "You have been unsubscribed.")
+	}
+}
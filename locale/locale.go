@@ -0,0 +1,193 @@
+/*
+Package locale resolves locale tags such as "es-CL" and formats numbers,
+dates and times with the conventions of a locale.
+
+Tags follow BCP 47 loosely: a language optionally followed by a region,
+separated by "-" or "_". A tag falls back to its language and then to the
+default locale, so "es-CL" is looked up as "es-CL", "es" and "".
+*/
+package locale
+
+import (
+	"bytes"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Format holds the conventions of a locale.
+type Format struct {
+	Decimal   string // decimal separator
+	Thousands string // thousands separator
+
+	Date string // time layout of dates
+	Time string // time layout of times
+}
+
+// formats are the known locales, "" is the default.
+var formats = map[string]Format{
+	"":      {".", ",", "2006-01-02", "15:04"},
+	"en":    {".", ",", "Jan 2, 2006", "3:04 PM"},
+	"en-US": {".", ",", "01/02/2006", "3:04 PM"},
+	"en-GB": {".", ",", "02/01/2006", "15:04"},
+	"es":    {",", ".", "02/01/2006", "15:04"},
+	"es-CL": {",", ".", "02-01-2006", "15:04"},
+	"pt":    {",", ".", "02/01/2006", "15:04"},
+}
+
+// Normalize returns tag with a lower case language and an upper case
+// region, "es_cl" is "es-CL".
+func Normalize(tag string) string {
+	tag = strings.Replace(strings.TrimSpace(tag), "_", "-", -1)
+	parts := strings.SplitN(tag, "-", 2)
+
+	lang := strings.ToLower(parts[0])
+	if len(parts) == 1 {
+		return lang
+	}
+	return lang + "-" + strings.ToUpper(parts[1])
+}
+
+// Valid reports whether tag is well formed.
+func Valid(tag string) bool {
+	parts := strings.Split(Normalize(tag), "-")
+	if len(parts) > 2 {
+		return false
+	}
+	for i, p := range parts {
+		if len(p) < 2 || len(p) > 3 || (i == 0 && strings.ToLower(p) != p) {
+			return false
+		}
+		for _, r := range p {
+			if !(r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9') {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// Chain returns the fallback chain of tag, from the most to the least
+// specific, without the default locale. "es-CL" is ["es-CL", "es"].
+func Chain(tag string) []string {
+	if tag = Normalize(tag); tag == "" {
+		return nil
+	}
+
+	chain := []string{tag}
+	if i := strings.Index(tag, "-"); i > 0 {
+		chain = append(chain, tag[:i])
+	}
+	return chain
+}
+
+// Lookup returns the format of the first known locale of the chain of tag,
+// or the default format.
+func Lookup(tag string) Format {
+	for _, t := range Chain(tag) {
+		if f, ok := formats[t]; ok {
+			return f
+		}
+	}
+	return formats[""]
+}
+
+// Number formats v with the given number of decimals.
+func (f Format) Number(v float64, decimals int) string {
+	s := strconv.FormatFloat(math.Abs(v), 'f', decimals, 64)
+
+	intPart, fracPart := s, ""
+	if i := strings.Index(s, "."); i >= 0 {
+		intPart, fracPart = s[:i], s[i+1:]
+	}
+
+	var b bytes.Buffer
+	if v < 0 && strings.Trim(s, "0.") != "" {
+		b.WriteByte('-')
+	}
+	for i, r := range intPart {
+		if i > 0 && (len(intPart)-i)%3 == 0 {
+			b.WriteString(f.Thousands)
+		}
+		b.WriteRune(r)
+	}
+	if fracPart != "" {
+		b.WriteString(f.Decimal)
+		b.WriteString(fracPart)
+	}
+	return b.String()
+}
+
+// Funcs returns the template functions of the locale:
+//
+//	number VALUE [DECIMALS]  formats a number, with 0 decimals by default
+//	date VALUE               formats the date of a time
+//	time VALUE               formats the time of day of a time
+//	datetime VALUE           formats the date and time of a time
+//
+// Times are RFC 3339 strings or unix seconds, in loc.
+func (f Format) Funcs(loc *time.Location) map[string]interface{} {
+	if loc == nil {
+		loc = time.UTC
+	}
+
+	layout := func(layout string) func(v interface{}) (string, error) {
+		return func(v interface{}) (string, error) {
+			t, err := toTime(v)
+			if err != nil {
+				return "", err
+			}
+			return t.In(loc).Format(layout), nil
+		}
+	}
+
+	return map[string]interface{}{
+		"number": func(v interface{}, decimals ...int) (string, error) {
+			n, err := toFloat(v)
+			if err != nil {
+				return "", err
+			}
+			d := 0
+			if len(decimals) > 0 {
+				d = decimals[0]
+			}
+			return f.Number(n, d), nil
+		},
+		"date":     layout(f.Date),
+		"time":     layout(f.Time),
+		"datetime": layout(f.Date + " " + f.Time),
+	}
+}
+
+func toFloat(v interface{}) (float64, error) {
+	switch n := v.(type) {
+	case float64:
+		return n, nil
+	case float32:
+		return float64(n), nil
+	case int:
+		return float64(n), nil
+	case int64:
+		return float64(n), nil
+	case string:
+		return strconv.ParseFloat(n, 64)
+	}
+	return 0, fmt.Errorf("invalid number %v", v)
+}
+
+func toTime(v interface{}) (time.Time, error) {
+	switch t := v.(type) {
+	case time.Time:
+		return t, nil
+	case string:
+		return time.Parse(time.RFC3339, t)
+	}
+
+	secs, err := toFloat(v)
+	if err != nil {
+		return time.Time{}, err
+	}
+	return time.Unix(int64(secs), 0), nil
+}
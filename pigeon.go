@@ -1,7 +1,10 @@
 package pigeon
 
 import (
+	"errors"
+	"fmt"
 	"net/url"
+	"time"
 
 	"github.com/oklog/ulid"
 )
@@ -22,11 +25,33 @@ const (
 	StatusCrashedDeliver = "crashed-deliver"
 	// StatusCancelled ...
 	StatusCancelled = "cancelled"
+	// StatusDelivered is reported when the message reached the device,
+	// phone or inbox of the recipient.
+	StatusDelivered = "delivered"
+	// StatusRead is reported when the recipient opened the message.
+	StatusRead = "read"
+	// StatusAcknowledged is reported when the recipient acknowledged the
+	// message.
+	StatusAcknowledged = "acknowledged"
+	// StatusMerged is set to the messages accumulated in a digest when the
+	// digest is rendered, their DigestID is the id of the digest.
+	StatusMerged = "merged"
+	// StatusExpired is set to the messages not sent before their
+	// ExpiresAt.
+	StatusExpired = "expired"
 
 	// EndpointMQTT ...
 	EndpointMQTT = "pigeon-mqtt:9010"
 	// EndpointHTTP ...
 	EndpointHTTP = "pigeon-http:9020"
+	// EndpointEmail ...
+	EndpointEmail = "pigeon-email:9030"
+	// EndpointSMS ...
+	EndpointSMS = "pigeon-sms:9040"
+	// EndpointPush ...
+	EndpointPush = "pigeon-push:9050"
+	// EndpointChat ...
+	EndpointChat = "pigeon-chat:9060"
 
 	// ServicePigeonMQTT ...
 	ServicePigeonMQTT = "mqtt"
@@ -34,6 +59,14 @@ const (
 	ServicePigeonSMS = "sms"
 	// ServicePigeonHTTP ...
 	ServicePigeonHTTP = "http"
+	// ServicePigeonEmail ...
+	ServicePigeonEmail = "email"
+	// ServicePigeonPush ...
+	ServicePigeonPush = "push"
+	// ServicePigeonTelegram ...
+	ServicePigeonTelegram = "telegram"
+	// ServicePigeonSlack ...
+	ServicePigeonSlack = "slack"
 )
 
 // NetAddr is the network address of the Backend service where to validate and
@@ -43,6 +76,43 @@ type NetAddr string
 // MessageStatus ...
 type MessageStatus string
 
+// receiptReplaces are the statuses that each receipt status replaces, a
+// receipt never moves a message back.
+var receiptReplaces = map[MessageStatus][]MessageStatus{
+	StatusDelivered:    {StatusPending, StatusSent},
+	StatusRead:         {StatusPending, StatusSent, StatusDelivered},
+	StatusAcknowledged: {StatusPending, StatusSent, StatusDelivered, StatusRead},
+}
+
+// IsReceipt reports whether s is reported by a receipt.
+func (s MessageStatus) IsReceipt() bool {
+	_, ok := receiptReplaces[s]
+	return ok
+}
+
+// Replaces returns the statuses that the receipt status s replaces.
+func (s MessageStatus) Replaces() []MessageStatus {
+	return receiptReplaces[s]
+}
+
+// Event is an entry of the history of a message.
+type Event struct {
+	Status MessageStatus `json:"status"`
+	Time   time.Time     `json:"time"`
+
+	// Source is who reported the event, the scheduler, a backend or the
+	// recipient.
+	Source string `json:"source,omitempty"`
+	Detail string `json:"detail,omitempty"`
+}
+
+// Sources of the events of a message.
+const (
+	SourceScheduler = "scheduler"
+	SourceBackend   = "backend"
+	SourceRecipient = "recipient"
+)
+
 // Message describes a message that needs to be delivered by the system.
 type Message struct {
 	// ID is an ULID that uniquely identifies (https://github.com/alizain/ulid)
@@ -60,21 +130,71 @@ type Message struct {
 	// Endpoint identifies the Backend service used to send the message.
 	Endpoint NetAddr `json:"-", arango:"endpoint"`
 
+	// Channel is the name of the channel of the message. When backends of
+	// the channel are registered in the scheduler the message is sent
+	// through one of them instead of Endpoint.
+	Channel string `json:"channel,omitempty" arango:"channel"`
+
 	// Status ...
 	Status MessageStatus `json:"status", arango:"status"`
 
 	SubjectID string `json:"subject_id", arango:"subject_id"`
 	UserID    string `json:"-", arango:"user_id"`
 
+	// InvalidRecipients are the recipients reported as invalid by the
+	// backend on delivery.
+	InvalidRecipients []string `json:"invalid_recipients,omitempty" arango:"invalid_recipients"`
+
+	// Attempts is the number of deliveries that failed with a temporary
+	// error.
+	Attempts int `json:"attempts,omitempty" arango:"attempts"`
+
+	// Window defers the delivery of the message to the next opening of the
+	// window, its Timezone is the one of the recipient.
+	Window *DeliveryWindow `json:"window,omitempty" arango:"window"`
+
+	// ChainID groups the messages of the steps of an escalation, ChainStep
+	// is the position of the message in the chain.
+	ChainID   string `json:"chain_id,omitempty" arango:"chain_id"`
+	ChainStep int    `json:"chain_step,omitempty" arango:"chain_step"`
+
+	// Events is the history of the status of the message.
+	Events []*Event `json:"events,omitempty" arango:"events"`
+
+	// ExpiresAt is when the message becomes stale, it is expired instead
+	// of sent after it. It never expires when nil.
+	ExpiresAt *time.Time `json:"expires_at,omitempty" arango:"expires_at"`
+
+	// Priority orders the message among the messages due at the same
+	// time, normal when empty.
+	Priority string `json:"priority,omitempty" arango:"priority"`
+
+	// Limit throttles and deduplicates the message when it is put in the
+	// scheduler, it is not stored.
+	Limit *MessageLimit `json:"-"`
+
+	// DigestID is the id of the digest the message accumulates in, it is
+	// merged into the digest when its window closes.
+	DigestID string `json:"digest_id,omitempty" arango:"digest_id"`
+
+	// Digest is set on digest messages, which are queued for the close of
+	// their window and rendered from the messages merged into them.
+	Digest *MessageDigest `json:"digest,omitempty" arango:"digest"`
+
+	// Variables are the template variables of the message request, kept
+	// to render its digest.
+	Variables map[string]interface{} `json:"-" arango:"variables"`
+
 	// Subject virtual reference to subject
 	Subject *Subject `json:"-"`
 }
 
 // SchedulerService stores and keep track of the statuses of messages.
 type SchedulerService interface {
-	// Put stores a message content and schedule the delivery on t time.
+	// Put stores a message and schedule the delivery on the time encoded in
+	// its ID.
 	// TODO(ca): change subjectID params to ulid.ULID type
-	Put(id ulid.ULID, content []byte, endpoint NetAddr, status MessageStatus, subjectID, userID string) error
+	Put(m Message) error
 
 	// Get retrieves the message with the given id.
 	//
@@ -87,6 +207,119 @@ type SchedulerService interface {
 
 	// Cancel cancel the message with the given id.
 	Cancel(id ulid.ULID) error
+
+	// Register adds a backend instance serving channel at addr. The
+	// instance is removed if it does not send a heartbeat within the
+	// returned TTL.
+	Register(channel string, addr NetAddr) (ttl time.Duration, err error)
+
+	// Heartbeat renews the registration of a backend instance.
+	Heartbeat(channel string, addr NetAddr) error
+
+	// ReportReceipt records that the message with the given id was
+	// delivered, read or acknowledged.
+	ReportReceipt(id ulid.ULID, status MessageStatus, source, detail string) error
+}
+
+// InvalidRecipientsError is returned by Backend.Deliver when some
+// recipients of a message, such as device tokens, are invalid or expired
+// and should not be used again.
+type InvalidRecipientsError struct {
+	Recipients []string
+
+	// Delivered is the number of recipients that received the message.
+	Delivered int
+
+	// Err is the reason the other recipients did not receive the message,
+	// nil when they all did.
+	Err error
+}
+
+func (e *InvalidRecipientsError) Error() string {
+	return fmt.Sprintf("%d invalid recipients, %d delivered", len(e.Recipients), e.Delivered)
+}
+
+// MessageBackend is a Backend that receives the ID of the delivered message,
+// to report its receipts later through the ReportReceipt RPC of the
+// scheduler.
+type MessageBackend interface {
+	Backend
+
+	// DeliverMessage sends the message with the given id and content.
+	DeliverMessage(id string, content []byte) error
+}
+
+// DeliveryBackend is a Backend that receives the delivery ID of each attempt
+// to deliver a message. The scheduler delivers messages at least once, an
+// attempt is repeated with the same delivery ID when the scheduler stops
+// before storing its outcome, so the backend can skip the deliveries it
+// already made.
+type DeliveryBackend interface {
+	Backend
+
+	// DeliverOnce sends the message with the given id and content unless
+	// deliveryID was already delivered.
+	DeliverOnce(deliveryID, id string, content []byte) error
+}
+
+// TemporaryError is returned by Backend.Deliver when the delivery failed
+// for a reason that may go away, such as a rate limit. The scheduler
+// retries the message after RetryAfter, or after a backoff when it is zero.
+type TemporaryError struct {
+	Err        error
+	RetryAfter time.Duration
+}
+
+func (e *TemporaryError) Error() string {
+	return e.Err.Error()
+}
+
+// Temporary reports that the error is temporary.
+func (e *TemporaryError) Temporary() bool {
+	return true
+}
+
+// Priorities of the messages, in precedence order. Due messages of higher
+// priorities are sent first.
+const (
+	PriorityCritical = "critical"
+	PriorityHigh     = "high"
+	PriorityNormal   = "normal"
+	PriorityBulk     = "bulk"
+)
+
+// ValidPriority reports whether p is a priority, empty is normal.
+func ValidPriority(p string) bool {
+	switch p {
+	case "", PriorityCritical, PriorityHigh, PriorityNormal, PriorityBulk:
+		return true
+	}
+	return false
+}
+
+// Expired reports whether m is stale at t.
+func (m *Message) Expired(t time.Time) bool {
+	return m.ExpiresAt != nil && !t.Before(*m.ExpiresAt)
+}
+
+// Errors returned by SchedulerService.Put for messages dropped by their
+// limit, the message is not stored nor sent.
+var (
+	ErrThrottled    = errors.New("throttled")
+	ErrDeduplicated = errors.New("deduplicated")
+)
+
+// MessageLimit limits the messages sharing its keys. Messages exceeding
+// ThrottleLimit within ThrottlePeriod are throttled, and messages repeating
+// DedupKey within DedupWindow are deduplicated. Empty keys disable each
+// limit.
+type MessageLimit struct {
+	ThrottleKey    string
+	ThrottleLimit  int
+	ThrottlePeriod time.Duration
+
+	DedupKey    string
+	DedupWindow time.Duration
 }
 
 // Backend manages the approval and delivery of messages.
@@ -108,9 +341,48 @@ type Subject struct {
 	Name     string            `json:"name"`
 	Channels []*SubjectChannel `json:"channels"`
 
+	// Critical subjects are delivered to recipients that only accept
+	// critical messages in a channel.
+	Critical bool `json:"critical,omitempty"`
+
+	// Escalation sends the message through its steps in order, each one
+	// when the previous fails or is not acknowledged within its timeout,
+	// instead of through all the channels at once.
+	Escalation []*EscalationStep `json:"escalation,omitempty"`
+
+	// Throttle and Dedup limit the messages of the subject sent to each
+	// recipient through each channel.
+	Throttle *Throttle `json:"throttle,omitempty"`
+	Dedup    *Dedup    `json:"dedup,omitempty"`
+
 	User *User `json:"-"`
 }
 
+// Throttle allows up to Limit messages every Period seconds.
+type Throttle struct {
+	Limit  int   `json:"limit"`
+	Period int64 `json:"period"`
+}
+
+// Dedup drops the messages repeated within Window seconds. Messages repeat
+// when they render the same Key, a template of the request variables, or
+// when Key is empty when they have the same content and variables.
+type Dedup struct {
+	Window int64  `json:"window"`
+	Key    string `json:"key,omitempty"`
+}
+
+// EscalationStep is a channel of an escalation policy.
+type EscalationStep struct {
+	Channel string `json:"channel"`
+
+	// Timeout is how long to wait for the message of the step to be
+	// acknowledged, in seconds, before sending the next step. Only a
+	// receipt resolves a step, a step sent through a backend that reports
+	// no receipts escalates after Timeout.
+	Timeout int64 `json:"timeout"`
+}
+
 // SubjectChannel ...
 type SubjectChannel struct {
 	ID             string                 `json:"id"`
@@ -119,10 +391,44 @@ type SubjectChannel struct {
 	CriteriaID     string                 `json:"criteria_id"`
 	CriteriaCustom int64                  `json:"criteria_custom"`
 
+	// Window restricts the hours in which the messages are delivered.
+	Window *DeliveryWindow `json:"window,omitempty"`
+
+	// Digest coalesces the messages of the subject channel into one
+	// message per window.
+	Digest *Digest `json:"digest,omitempty"`
+
 	Channel  *Channel  `json:"-"`
 	Criteria *Criteria `json:"-"`
 }
 
+// Template renders the content of a subject channel from the variables of
+// a message request.
+type Template struct {
+	ID               string `json:"id"`
+	UserID           string `json:"user_id"`
+	SubjectChannelID string `json:"subject_channel_id"`
+
+	// Fields are the templates of the channel content fields, keyed by
+	// field name. The "html" field uses html/template, the others
+	// text/template.
+	Fields map[string]string `json:"fields"`
+
+	// Locales are variants of the fields keyed by locale tag, such as "es"
+	// or "es-CL". A field missing in a variant falls back to the less
+	// specific locales and then to Fields.
+	Locales map[string]map[string]string `json:"locales,omitempty"`
+
+	// Digest are the fields of the digests of the channel, rendered with
+	// the variables of the merged messages in "messages" and their number
+	// in "count".
+	Digest map[string]string `json:"digest,omitempty"`
+
+	// JSON are the names of the fields whose rendered value is decoded as
+	// json, such as the email "to" or the "mqtt_payload".
+	JSON []string `json:"json,omitempty"`
+}
+
 // TODO: move to respective pigeon repository and get from package
 // MQTTContent ...
 type MQTTContent struct {
@@ -132,20 +438,44 @@ type MQTTContent struct {
 // MQTTOptions ...
 type MQTTOptions struct {
 	Topic string `json:"mqtt_topic"`
+
+	Broker   string `json:"mqtt_broker,omitempty"`
+	Username string `json:"mqtt_username,omitempty"`
+	Password string `json:"mqtt_password,omitempty"`
+	ClientID string `json:"mqtt_client_id,omitempty"`
+	QoS      byte   `json:"mqtt_qos,omitempty"`
+	Retain   bool   `json:"mqtt_retain,omitempty"`
 }
 
 // MQTT ...
 type MQTT struct {
 	Topic   string                 `json:"mqtt_topic"`
 	Payload map[string]interface{} `json:"mqtt_payload"`
+
+	// Broker is the URL of the broker, for example tcp://localhost:1883.
+	// The backend default is used when empty.
+	Broker   string `json:"mqtt_broker,omitempty"`
+	Username string `json:"mqtt_username,omitempty"`
+	Password string `json:"mqtt_password,omitempty"`
+	ClientID string `json:"mqtt_client_id,omitempty"`
+	QoS      byte   `json:"mqtt_qos,omitempty"`
+	Retain   bool   `json:"mqtt_retain,omitempty"`
 }
 
 // Message message struct
 // HTTP ...
 type HTTP struct {
 	URL     *url.URL               `json:"url"`
+	Method  string                 `json:"method,omitempty"`
 	Body    string                 `json:"body,omitempty"`
 	Headers map[string]interface{} `json:"headers,omitempty"`
+
+	// Timeout of each request in seconds, the backend default is used when
+	// zero.
+	Timeout int64 `json:"timeout,omitempty"`
+
+	// Secret signs the requests with HMAC-SHA256 when set.
+	Secret string `json:"secret,omitempty"`
 }
 
 // HTTPContent ...
@@ -156,7 +486,10 @@ type HTTPContent struct {
 // HTTPOptions ...
 type HTTPOptions struct {
 	URL     *url.URL               `json:"url"`
+	Method  string                 `json:"method,omitempty"`
 	Headers map[string]interface{} `json:"headers,omitempty"`
+	Timeout int64                  `json:"timeout,omitempty"`
+	Secret  string                 `json:"secret,omitempty"`
 }
 
 // TODO: move to respective pigeon repository and get from package
@@ -164,24 +497,137 @@ type HTTPOptions struct {
 type SMS struct {
 	Phone string `json:"phone"`
 	Text  string `json:"text"`
+
+	// From is the sender ID, an E.164 number or up to 11 alphanumeric
+	// characters. The backend default is used when empty.
+	From string `json:"from,omitempty"`
+}
+
+// SMSContent ...
+type SMSContent struct {
+	Phone string `json:"phone"`
+	Text  string `json:"text"`
+}
+
+// SMSOptions ...
+type SMSOptions struct {
+	SenderID string `json:"sender_id,omitempty"`
 }
 
 // Push ...
 type Push struct {
-	Title string `json:"title"`
-	Body  string `json:"body"`
-	Token string `json:"token"`
+	Title  string                 `json:"title"`
+	Body   string                 `json:"body"`
+	Tokens []string               `json:"tokens"`
+	Data   map[string]interface{} `json:"data,omitempty"`
+
+	// Provider is the push service of the tokens, "fcm" or "apns".
+	Provider string `json:"provider"`
 }
 
 // PushContent ...
 type PushContent struct {
-	Title string `json:"title"`
-	Body  string `json:"body"`
-	Token string `json:"token"`
+	Title  string                 `json:"title"`
+	Body   string                 `json:"body"`
+	Data   map[string]interface{} `json:"data,omitempty"`
+	Tokens []string               `json:"tokens"`
+
+	// Token is kept for clients sending a single token.
+	Token string `json:"token,omitempty"`
 }
 
 // PushOptions ...
-type PushOptions struct{}
+type PushOptions struct {
+	Provider string `json:"provider"`
+}
+
+// Email is the content delivered by the email backend.
+type Email struct {
+	From        string        `json:"from"`
+	FromName    string        `json:"from_name,omitempty"`
+	To          []string      `json:"to"`
+	Subject     string        `json:"subject"`
+	HTML        string        `json:"html,omitempty"`
+	Text        string        `json:"text,omitempty"`
+	Attachments []*Attachment `json:"attachments,omitempty"`
+
+	// SMTP overrides the default server of the backend.
+	SMTP *SMTPOptions `json:"smtp,omitempty"`
+}
+
+// EmailContent ...
+type EmailContent struct {
+	To          []string      `json:"to"`
+	Subject     string        `json:"subject"`
+	HTML        string        `json:"html,omitempty"`
+	Text        string        `json:"text,omitempty"`
+	Attachments []*Attachment `json:"attachments,omitempty"`
+}
+
+// EmailOptions ...
+type EmailOptions struct {
+	From     string `json:"from"`
+	FromName string `json:"from_name,omitempty"`
+
+	SMTPHost     string `json:"smtp_host,omitempty"`
+	SMTPPort     int    `json:"smtp_port,omitempty"`
+	SMTPUsername string `json:"smtp_username,omitempty"`
+	SMTPPassword string `json:"smtp_password,omitempty"`
+	SMTPStartTLS string `json:"smtp_starttls,omitempty"`
+}
+
+// SMTPOptions are the SMTP server settings of an email.
+type SMTPOptions struct {
+	Host     string `json:"host"`
+	Port     int    `json:"port,omitempty"`
+	Username string `json:"username,omitempty"`
+	Password string `json:"password,omitempty"`
+
+	// StartTLS is one of "opportunistic" (default), "required" or
+	// "disabled".
+	StartTLS string `json:"starttls,omitempty"`
+}
+
+// Attachment is a file attached to an email. Content is base64 encoded in
+// JSON.
+type Attachment struct {
+	Filename    string `json:"filename"`
+	ContentType string `json:"content_type,omitempty"`
+	Content     []byte `json:"content"`
+}
+
+// Chat is the content delivered by the chat backend.
+type Chat struct {
+	// Provider is "telegram" or "slack".
+	Provider string `json:"provider"`
+	Text     string `json:"text"`
+
+	// Format is "markdown", "html" (telegram only) or empty for plain
+	// text.
+	Format string `json:"format,omitempty"`
+
+	// ChatID and BotToken are used by telegram. The backend default bot is
+	// used when BotToken is empty.
+	ChatID   string `json:"chat_id,omitempty"`
+	BotToken string `json:"bot_token,omitempty"`
+
+	// WebhookURL is the incoming webhook used by slack.
+	WebhookURL string `json:"webhook_url,omitempty"`
+}
+
+// ChatContent ...
+type ChatContent struct {
+	Text   string `json:"text"`
+	Format string `json:"format,omitempty"`
+}
+
+// ChatOptions ...
+type ChatOptions struct {
+	ChatID     string `json:"chat_id,omitempty"`
+	BotToken   string `json:"bot_token,omitempty"`
+	WebhookURL string `json:"webhook_url,omitempty"`
+	Format     string `json:"format,omitempty"`
+}
 
 // Channel ...
 type Channel struct {
@@ -198,6 +644,88 @@ type User struct {
 	APIKey   string `json:"api_key"`
 }
 
+// Recipient is a person or system that receives the messages of a user
+// through its contact points.
+type Recipient struct {
+	ID     string `json:"id"`
+	UserID string `json:"user_id"`
+	Name   string `json:"name,omitempty"`
+
+	// Locale selects the template variants of the messages sent to the
+	// recipient when the request has no locale.
+	Locale string `json:"locale,omitempty"`
+
+	// Timezone is the IANA timezone of the recipient, such as
+	// "America/Santiago", used by delivery windows.
+	Timezone string `json:"timezone,omitempty"`
+
+	ContactPoints []*ContactPoint `json:"contact_points"`
+
+	Preferences []*Preference `json:"preferences,omitempty"`
+}
+
+// Preference is the choice of a recipient for the messages of a subject in a
+// channel. An empty Subject or Channel matches any.
+type Preference struct {
+	Subject string `json:"subject,omitempty"`
+	Channel string `json:"channel,omitempty"`
+
+	// OptOut suppresses the messages.
+	OptOut bool `json:"opt_out,omitempty"`
+
+	// CriticalOnly suppresses the messages of subjects that are not
+	// critical.
+	CriticalOnly bool `json:"critical_only,omitempty"`
+}
+
+// Preference returns the most specific preference of r for subject and
+// channel, or nil when there is none. A preference for the subject and the
+// channel wins over one for the subject, which wins over one for the
+// channel, which wins over one for everything.
+func (r *Recipient) Preference(subject, channel string) *Preference {
+	var best *Preference
+	bestScore := -1
+	for _, p := range r.Preferences {
+		if (p.Subject != "" && p.Subject != subject) || (p.Channel != "" && p.Channel != channel) {
+			continue
+		}
+
+		score := 0
+		if p.Subject != "" {
+			score += 2
+		}
+		if p.Channel != "" {
+			score++
+		}
+		if score > bestScore {
+			best, bestScore = p, score
+		}
+	}
+	return best
+}
+
+// ContactPoint is the address of a recipient in a channel, such as a phone
+// for sms or a device token for push.
+type ContactPoint struct {
+	Channel string `json:"channel"`
+	Address string `json:"address"`
+
+	// Verified is set once the recipient confirmed the address. Unverified
+	// contact points are not used.
+	Verified bool `json:"verified"`
+}
+
+// Addresses returns the verified addresses of r in channel.
+func (r *Recipient) Addresses(channel string) []string {
+	var addrs []string
+	for _, cp := range r.ContactPoints {
+		if cp.Channel == channel && cp.Verified {
+			addrs = append(addrs, cp.Address)
+		}
+	}
+	return addrs
+}
+
 // Criteria ...
 type Criteria struct {
 	ID    string `json:"id"`
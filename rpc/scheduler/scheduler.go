@@ -1,6 +1,9 @@
 package schedulersvc
 
 import (
+	"encoding/json"
+	"time"
+
 	"golang.org/x/net/context"
 
 	"github.com/iampigeon/pigeon"
@@ -30,7 +33,62 @@ func (s *Service) Put(ctx context.Context, r *pb.PutRequest) (*pb.PutResponse, e
 		return nil, err
 	}
 
-	if err := s.schedulerSvc.Put(id, r.Content, pigeon.NetAddr(r.Endpoint), pigeon.StatusPending, r.SubjectId, r.UserId); err != nil {
+	var window *pigeon.DeliveryWindow
+	if w := r.Window; w != nil {
+		window = &pigeon.DeliveryWindow{Days: w.Days, Start: w.Start, End: w.End, Timezone: w.Timezone}
+	}
+
+	var limit *pigeon.MessageLimit
+	if l := r.Limit; l != nil {
+		limit = &pigeon.MessageLimit{
+			ThrottleKey:    l.ThrottleKey,
+			ThrottleLimit:  int(l.ThrottleLimit),
+			ThrottlePeriod: time.Duration(l.ThrottlePeriod) * time.Second,
+			DedupKey:       l.DedupKey,
+			DedupWindow:    time.Duration(l.DedupWindow) * time.Second,
+		}
+	}
+
+	var digest *pigeon.MessageDigest
+	if d := r.Digest; d != nil {
+		digest = &pigeon.MessageDigest{SubjectChannelID: d.SubjectChannelId, RecipientID: d.RecipientId, Locale: d.Locale}
+	}
+
+	var variables map[string]interface{}
+	if len(r.Variables) > 0 {
+		if err := json.Unmarshal(r.Variables, &variables); err != nil {
+			return nil, err
+		}
+	}
+
+	var expiresAt *time.Time
+	if r.ExpiresAt != 0 {
+		t := time.Unix(0, r.ExpiresAt*int64(time.Millisecond))
+		expiresAt = &t
+	}
+
+	err = s.schedulerSvc.Put(pigeon.Message{
+		ID:        id,
+		Content:   r.Content,
+		Endpoint:  pigeon.NetAddr(r.Endpoint),
+		Channel:   r.Channel,
+		Status:    pigeon.StatusPending,
+		SubjectID: r.SubjectId,
+		UserID:    r.UserId,
+		Window:    window,
+		ChainID:   r.ChainId,
+		ChainStep: int(r.ChainStep),
+		Limit:     limit,
+		DigestID:  r.DigestId,
+		Digest:    digest,
+		Variables: variables,
+		Priority:  r.Priority,
+		ExpiresAt: expiresAt,
+	})
+	if err == pigeon.ErrThrottled || err == pigeon.ErrDeduplicated {
+		return &pb.PutResponse{Result: err.Error()}, nil
+	}
+	if err != nil {
 		return nil, err
 	}
 
@@ -48,14 +106,24 @@ func (s *Service) Get(ctx context.Context, r *pb.GetRequest) (*pb.GetResponse, e
 		return nil, err
 	}
 
+	m := &pb.Message{
+		Id:        r.Id,
+		Content:   msg.Content,
+		Endpoint:  string(msg.Endpoint),
+		Status:    string(msg.Status),
+		SubjectId: string(msg.SubjectID),
+		Channel:   msg.Channel,
+		ChainId:   msg.ChainID,
+		ChainStep: int32(msg.ChainStep),
+		DigestId:  msg.DigestID,
+		Priority:  msg.Priority,
+	}
+	if msg.ExpiresAt != nil {
+		m.ExpiresAt = msg.ExpiresAt.UnixNano() / int64(time.Millisecond)
+	}
+
 	return &pb.GetResponse{
-		Message: &pb.Message{
-			Id:        r.Id,
-			Content:   msg.Content,
-			Endpoint:  string(msg.Endpoint),
-			Status:    string(msg.Status),
-			SubjectId: string(msg.SubjectID),
-		},
+		Message: m,
 	}, nil
 }
 func (s *Service) Update(ctx context.Context, r *pb.UpdateRequest) (*pb.UpdateResponse, error) {
@@ -83,3 +151,41 @@ func (s *Service) Cancel(ctx context.Context, r *pb.CancelRequest) (*pb.CancelRe
 	}
 	return &pb.CancelResponse{}, nil
 }
+
+// Register ...
+func (s *Service) Register(ctx context.Context, r *pb.RegisterRequest) (*pb.RegisterResponse, error) {
+	ttl, err := s.schedulerSvc.Register(r.Channel, pigeon.NetAddr(r.Addr))
+	if err != nil {
+		return nil, err
+	}
+
+	return &pb.RegisterResponse{TtlSeconds: int64(ttl / time.Second)}, nil
+}
+
+// Heartbeat ...
+func (s *Service) Heartbeat(ctx context.Context, r *pb.HeartbeatRequest) (*pb.HeartbeatResponse, error) {
+	if err := s.schedulerSvc.Heartbeat(r.Channel, pigeon.NetAddr(r.Addr)); err != nil {
+		return nil, err
+	}
+
+	return &pb.HeartbeatResponse{}, nil
+}
+
+// ReportReceipt ...
+func (s *Service) ReportReceipt(ctx context.Context, r *pb.ReportReceiptRequest) (*pb.ReportReceiptResponse, error) {
+	id, err := ulid.Parse(r.Id)
+	if err != nil {
+		return nil, err
+	}
+
+	source := r.Source
+	if source == "" {
+		source = pigeon.SourceBackend
+	}
+
+	if err := s.schedulerSvc.ReportReceipt(id, pigeon.MessageStatus(r.Status), source, r.Detail); err != nil {
+		return nil, err
+	}
+
+	return &pb.ReportReceiptResponse{}, nil
+}
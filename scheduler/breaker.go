@@ -0,0 +1,202 @@
+package scheduler
+
+import (
+	"encoding/json"
+	"expvar"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/iampigeon/pigeon"
+)
+
+// States of a circuit breaker.
+const (
+	BreakerClosed   = "closed"
+	BreakerOpen     = "open"
+	BreakerHalfOpen = "half-open"
+)
+
+const (
+	// DefaultBreakerFailures is the number of consecutive failures that
+	// open a circuit when BreakerConfig.Failures is zero.
+	DefaultBreakerFailures = 5
+
+	// DefaultBreakerCooldown is how long a circuit stays open when
+	// BreakerConfig.Cooldown is zero.
+	DefaultBreakerCooldown = 30 * time.Second
+
+	// probeRetry is the wait before retrying a message held back while the
+	// circuit is half open and probing.
+	probeRetry = time.Second
+)
+
+// BreakerConfig configures the circuit breakers of the backends. Zero
+// values use the package defaults.
+type BreakerConfig struct {
+	// Failures is the number of consecutive failed calls to a backend that
+	// open its circuit.
+	Failures int
+
+	// Cooldown is how long a circuit stays open before a probe call is
+	// let through, half opening it.
+	Cooldown time.Duration
+}
+
+// BreakerState is the state of the circuit of a backend.
+type BreakerState struct {
+	State    string     `json:"state"`
+	Failures int        `json:"failures"`
+	OpenedAt *time.Time `json:"opened_at,omitempty"`
+}
+
+// Breakers are the circuit breakers of the backends keyed by address. Calls
+// to a backend with an open circuit are not made, the messages are deferred
+// in the queue until the cooldown lets a probe call through. It is safe for
+// concurrent use and serves the states of the circuits over http:
+//
+//	GET /debug/scheduler/breakers
+type Breakers struct {
+	config BreakerConfig
+
+	mu       sync.Mutex
+	breakers map[pigeon.NetAddr]*breaker
+}
+
+type breaker struct {
+	state    string
+	failures int
+	openedAt time.Time
+
+	// probing is set while the probe call of a half open circuit is in
+	// flight.
+	probing bool
+}
+
+// NewBreakers returns the circuit breakers and publishes their states
+// through expvar.
+func NewBreakers(config BreakerConfig) *Breakers {
+	if config.Failures == 0 {
+		config.Failures = DefaultBreakerFailures
+	}
+	if config.Cooldown == 0 {
+		config.Cooldown = DefaultBreakerCooldown
+	}
+
+	b := &Breakers{
+		config:   config,
+		breakers: make(map[pigeon.NetAddr]*breaker),
+	}
+	metrics.Set("breakers", expvar.Func(func() interface{} {
+		return b.States()
+	}))
+
+	return b
+}
+
+// allow reports whether a call to addr can be made, otherwise how long to
+// wait before trying again. Allowed calls must be followed by success or
+// failure.
+func (b *Breakers) allow(addr pigeon.NetAddr, now time.Time) (time.Duration, bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	br, ok := b.breakers[addr]
+	if !ok {
+		return 0, true
+	}
+
+	switch br.state {
+	case BreakerOpen:
+		if reopen := br.openedAt.Add(b.config.Cooldown); now.Before(reopen) {
+			metrics.Add("deferred", 1)
+			return reopen.Sub(now), false
+		}
+		br.state = BreakerHalfOpen
+		br.probing = true
+		return 0, true
+	case BreakerHalfOpen:
+		if br.probing {
+			metrics.Add("deferred", 1)
+			return probeRetry, false
+		}
+		br.probing = true
+		return 0, true
+	}
+
+	return 0, true
+}
+
+// open reports whether the circuit of addr is open.
+func (b *Breakers) open(addr pigeon.NetAddr) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	br, ok := b.breakers[addr]
+	return ok && br.state == BreakerOpen
+}
+
+// success records a call that reached addr, closing its circuit.
+func (b *Breakers) success(addr pigeon.NetAddr) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	delete(b.breakers, addr)
+}
+
+// failure records a call that could not reach addr, and reports whether its
+// circuit is open.
+func (b *Breakers) failure(addr pigeon.NetAddr, now time.Time) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	br, ok := b.breakers[addr]
+	if !ok {
+		br = &breaker{state: BreakerClosed}
+		b.breakers[addr] = br
+	}
+
+	br.failures++
+	br.probing = false
+	if br.state == BreakerHalfOpen || br.failures >= b.config.Failures {
+		if br.state != BreakerOpen {
+			metrics.Add("breaker_opened", 1)
+		}
+		br.state = BreakerOpen
+		br.openedAt = now
+	}
+
+	return br.state == BreakerOpen
+}
+
+// States returns the state of the circuits with failures, the others are
+// closed.
+func (b *Breakers) States() map[string]BreakerState {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	states := make(map[string]BreakerState, len(b.breakers))
+	for addr, br := range b.breakers {
+		state := BreakerState{
+			State:    br.state,
+			Failures: br.failures,
+		}
+		if !br.openedAt.IsZero() {
+			openedAt := br.openedAt
+			state.OpenedAt = &openedAt
+		}
+		states[string(addr)] = state
+	}
+	return states
+}
+
+// ServeHTTP returns the states of the circuits.
+func (b *Breakers) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(b.States())
+}
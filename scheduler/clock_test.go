@@ -0,0 +1,111 @@
+package scheduler
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+// fakeClock is a Clock whose time only changes with Advance, firing the
+// timers due by then. It is safe for concurrent use.
+type fakeClock struct {
+	mu     sync.Mutex
+	armed  *sync.Cond
+	now    time.Time
+	timers []*fakeTimer
+}
+
+func newFakeClock(now time.Time) *fakeClock {
+	c := &fakeClock{now: now}
+	c.armed = sync.NewCond(&c.mu)
+	return c
+}
+
+// Now returns the time of the clock.
+func (c *fakeClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.now
+}
+
+// NewTimer returns a timer firing when the clock is advanced by d, or at
+// once when d is not positive.
+func (c *fakeClock) NewTimer(d time.Duration) Timer {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	t := &fakeTimer{
+		clock: c,
+		at:    c.now.Add(d),
+		c:     make(chan time.Time, 1),
+	}
+	if d <= 0 {
+		t.c <- c.now
+		return t
+	}
+	c.timers = append(c.timers, t)
+	c.armed.Broadcast()
+
+	return t
+}
+
+// Advance moves the clock forward by d and fires the timers due, in the
+// order they are due.
+func (c *fakeClock) Advance(d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.now = c.now.Add(d)
+
+	sort.SliceStable(c.timers, func(i, j int) bool {
+		return c.timers[i].at.Before(c.timers[j].at)
+	})
+
+	pending := c.timers[:0]
+	for _, t := range c.timers {
+		if t.at.After(c.now) {
+			pending = append(pending, t)
+			continue
+		}
+		t.c <- t.at
+	}
+	c.timers = pending
+}
+
+// waitTimers waits for n timers waiting to fire, used to wait for the
+// scheduler to arm its timer before advancing the clock.
+func (c *fakeClock) waitTimers(n int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for len(c.timers) < n {
+		c.armed.Wait()
+	}
+}
+
+type fakeTimer struct {
+	clock *fakeClock
+	at    time.Time
+	c     chan time.Time
+}
+
+func (t *fakeTimer) C() <-chan time.Time {
+	return t.c
+}
+
+// Stop removes the timer from its clock, it reports false when the timer
+// already fired.
+func (t *fakeTimer) Stop() bool {
+	c := t.clock
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for i, other := range c.timers {
+		if other == t {
+			c.timers = append(c.timers[:i], c.timers[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
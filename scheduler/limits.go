@@ -0,0 +1,257 @@
+package scheduler
+
+import (
+	"encoding/json"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/iampigeon/pigeon"
+)
+
+// heldRetry is the wait before retrying a message held back by the in-flight
+// cap of its backend.
+const heldRetry = 500 * time.Millisecond
+
+// DefaultLimits are the limits used when StorageConfig.Limits is nil. They
+// give bulk and normal messages their own in-flight budgets, so a burst of
+// them can't take every delivery from the critical and high ones.
+var DefaultLimits = map[string]Limit{
+	priorityKey(pigeon.PriorityNormal): {MaxInFlight: 64},
+	priorityKey(pigeon.PriorityBulk):   {MaxInFlight: 16},
+}
+
+// priorityKey returns the key of the limits of the messages of priority,
+// such as "priority:bulk".
+func priorityKey(priority string) string {
+	if priority == "" {
+		priority = pigeon.PriorityNormal
+	}
+	return "priority:" + priority
+}
+
+// Limit caps the deliveries to a backend address, channel or priority.
+type Limit struct {
+	// Rate is the sustained number of deliveries per second, unlimited
+	// when zero.
+	Rate float64 `json:"rate,omitempty"`
+
+	// Burst is the number of deliveries allowed at once above Rate, one
+	// when zero.
+	Burst int `json:"burst,omitempty"`
+
+	// MaxInFlight is the number of concurrent deliveries, unlimited when
+	// zero.
+	MaxInFlight int `json:"max_in_flight,omitempty"`
+
+	// CriticalReserve is the part of MaxInFlight only critical messages
+	// can take, so the other priorities can't starve them at a backend or
+	// channel. A tenth of MaxInFlight, at least one, when zero. Nothing is
+	// reserved when MaxInFlight is one.
+	CriticalReserve int `json:"critical_reserve,omitempty"`
+}
+
+// reserve returns the deliveries in flight of the limit kept for critical
+// messages.
+func (limit Limit) reserve() int {
+	if limit.MaxInFlight <= 1 {
+		return 0
+	}
+
+	r := limit.CriticalReserve
+	if r == 0 {
+		r = limit.MaxInFlight / 10
+	}
+	if r < 1 {
+		r = 1
+	}
+	if r >= limit.MaxInFlight {
+		r = limit.MaxInFlight - 1
+	}
+	return r
+}
+
+// Limits are the delivery limits of the scheduler keyed by backend address,
+// channel name or priority, such as "priority:bulk". They can be changed at
+// runtime, it is safe for concurrent use and serves its configuration over
+// http:
+//
+//	GET /debug/scheduler/limits
+//	PUT /debug/scheduler/limits
+type Limits struct {
+	mu       sync.Mutex
+	limits   map[string]Limit
+	buckets  map[string]*bucket
+	inFlight map[string]int
+
+	// others are the deliveries in flight of the messages that are not
+	// critical, by backend address or channel.
+	others map[string]int
+}
+
+// bucket is a token bucket, refilled at the rate of its limit.
+type bucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// NewLimits returns the limits with the initial configuration limits.
+func NewLimits(limits map[string]Limit) *Limits {
+	l := &Limits{
+		buckets:  make(map[string]*bucket),
+		inFlight: make(map[string]int),
+		others:   make(map[string]int),
+	}
+	l.Set(limits)
+	return l
+}
+
+// Set replaces the configuration of the limits, the in-flight deliveries
+// are kept.
+func (l *Limits) Set(limits map[string]Limit) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.limits = make(map[string]Limit, len(limits))
+	for key, limit := range limits {
+		l.limits[key] = limit
+	}
+	l.buckets = make(map[string]*bucket)
+}
+
+// Get returns the configuration of the limits.
+func (l *Limits) Get() map[string]Limit {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	limits := make(map[string]Limit, len(l.limits))
+	for key, limit := range l.limits {
+		limits[key] = limit
+	}
+	return limits
+}
+
+// acquire takes a delivery of the budget of priority and of every key, a
+// backend address or channel, or none of them. Messages that are not
+// critical leave the reserve of the keys to critical ones. When a limit is
+// reached it reports false and how long to wait before trying again.
+func (l *Limits) acquire(priority string, keys []string, now time.Time) (time.Duration, bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	// the budget of the priority, the first key, has no reserve.
+	keys = append([]string{priorityKey(priority)}, keys...)
+	shared := func(i int) bool { return i > 0 && priority != pigeon.PriorityCritical }
+
+	var wait time.Duration
+	for i, key := range keys {
+		limit, ok := l.limits[key]
+		if !ok {
+			continue
+		}
+
+		if limit.MaxInFlight > 0 && wait < heldRetry {
+			if l.inFlight[key] >= limit.MaxInFlight || shared(i) && l.others[key] >= limit.MaxInFlight-limit.reserve() {
+				wait = heldRetry
+			}
+		}
+
+		if limit.Rate > 0 {
+			b := l.refill(key, limit, now)
+			if b.tokens < 1 {
+				if w := time.Duration((1 - b.tokens) / limit.Rate * float64(time.Second)); w > wait {
+					wait = w
+				}
+			}
+		}
+	}
+	if wait > 0 {
+		metrics.Add("held", 1)
+		return wait, false
+	}
+
+	for i, key := range keys {
+		limit, ok := l.limits[key]
+		if !ok {
+			continue
+		}
+		if limit.Rate > 0 {
+			l.buckets[key].tokens--
+		}
+		l.inFlight[key]++
+		if shared(i) {
+			l.others[key]++
+		}
+	}
+
+	return 0, true
+}
+
+// release ends a delivery taken with acquire.
+func (l *Limits) release(priority string, keys []string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	for _, key := range keys {
+		if priority != pigeon.PriorityCritical {
+			decrement(l.others, key)
+		}
+	}
+	for _, key := range append([]string{priorityKey(priority)}, keys...) {
+		decrement(l.inFlight, key)
+	}
+}
+
+// decrement takes one from the count of key, the key is deleted at zero.
+func decrement(counts map[string]int, key string) {
+	if counts[key] > 0 {
+		counts[key]--
+	}
+	if counts[key] == 0 {
+		delete(counts, key)
+	}
+}
+
+// refill returns the bucket of key with the tokens earned since its last
+// use.
+func (l *Limits) refill(key string, limit Limit, now time.Time) *bucket {
+	burst := float64(limit.Burst)
+	if burst < 1 {
+		burst = 1
+	}
+
+	b, ok := l.buckets[key]
+	if !ok {
+		b = &bucket{tokens: burst, last: now}
+		l.buckets[key] = b
+	}
+
+	b.tokens += now.Sub(b.last).Seconds() * limit.Rate
+	if b.tokens > burst {
+		b.tokens = burst
+	}
+	b.last = now
+
+	return b
+}
+
+// ServeHTTP returns the configuration of the limits on GET and replaces it
+// with the json body on PUT.
+func (l *Limits) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPut:
+		var limits map[string]Limit
+		if err := json.NewDecoder(r.Body).Decode(&limits); err != nil {
+			http.Error(w, "invalid limits", http.StatusBadRequest)
+			return
+		}
+		l.Set(limits)
+	default:
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(l.Get())
+}
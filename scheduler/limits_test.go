@@ -0,0 +1,62 @@
+package scheduler
+
+import (
+	"testing"
+	"time"
+
+	"github.com/iampigeon/pigeon"
+)
+
+func TestLimitsCriticalReserve(t *testing.T) {
+	now := time.Unix(1500000000, 0)
+	l := NewLimits(map[string]Limit{
+		"backend:9000": {MaxInFlight: 4, CriticalReserve: 2},
+	})
+	keys := []string{"backend:9000"}
+
+	for i := 0; i < 2; i++ {
+		if _, ok := l.acquire(pigeon.PriorityBulk, keys, now); !ok {
+			t.Fatalf("bulk delivery %d held", i)
+		}
+	}
+	if _, ok := l.acquire(pigeon.PriorityHigh, keys, now); ok {
+		t.Fatal("high delivery took the critical reserve")
+	}
+	for i := 0; i < 2; i++ {
+		if _, ok := l.acquire(pigeon.PriorityCritical, keys, now); !ok {
+			t.Fatalf("critical delivery %d held", i)
+		}
+	}
+	if wait, ok := l.acquire(pigeon.PriorityCritical, keys, now); ok || wait != heldRetry {
+		t.Fatalf("critical delivery over the cap: %t, wait %s", ok, wait)
+	}
+
+	// a released critical delivery is not given to the other priorities.
+	l.release(pigeon.PriorityCritical, keys)
+	if _, ok := l.acquire(pigeon.PriorityBulk, keys, now); ok {
+		t.Error("bulk delivery took the released critical reserve")
+	}
+	l.release(pigeon.PriorityBulk, keys)
+	if _, ok := l.acquire(pigeon.PriorityNormal, keys, now); !ok {
+		t.Error("normal delivery held under the cap")
+	}
+}
+
+func TestLimitReserve(t *testing.T) {
+	tests := []struct {
+		limit Limit
+		want  int
+	}{
+		{Limit{}, 0},
+		{Limit{MaxInFlight: 1}, 0},
+		{Limit{MaxInFlight: 2}, 1},
+		{Limit{MaxInFlight: 64}, 6},
+		{Limit{MaxInFlight: 8, CriticalReserve: 3}, 3},
+		{Limit{MaxInFlight: 8, CriticalReserve: 8}, 7},
+	}
+	for _, tt := range tests {
+		if got := tt.limit.reserve(); got != tt.want {
+			t.Errorf("reserve of %+v is %d, want %d", tt.limit, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,213 @@
+package scheduler
+
+import (
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/oklog/ulid"
+)
+
+// Queue holds the ids of the messages to send at their due time. The
+// scheduler uses a redis queue unless one is injected through
+// StorageConfig.Queue, such as a NewMemoryQueue.
+type Queue interface {
+	PushAt(id ulid.ULID, at uint64, priority string)
+	Peek() (*ulid.ULID, uint64)
+	Pop(now uint64) (*lease, error)
+	Done(l lease) error
+	Reclaim(now uint64) (int, error)
+	Recover(now uint64, dead []string) (int, error)
+	Subscribe(wake chan<- struct{})
+	DeleteByID(id ulid.ULID) (bool, error)
+}
+
+var (
+	_ Queue = (*priorityQueue)(nil)
+	_ Queue = (*memoryQueue)(nil)
+)
+
+// memoryQueue is a queue kept in memory. It behaves like the redis queue for
+// a single scheduler, its messages are lost when the scheduler stops.
+type memoryQueue struct {
+	leaseTTL time.Duration
+
+	mu      sync.Mutex
+	queues  map[string]map[ulid.ULID]uint64
+	leases  map[ulid.ULID]memoryLease
+	wakes   []chan<- struct{}
+	counter uint64
+}
+
+type memoryLease struct {
+	token    string
+	queue    string
+	deadline uint64
+}
+
+// NewMemoryQueue returns a Queue kept in memory for a single scheduler,
+// leasing its messages for leaseTTL, which should be the
+// StorageConfig.LeaseTTL of the scheduler. DefaultLeaseTTL is used when
+// zero.
+func NewMemoryQueue(leaseTTL time.Duration) Queue {
+	return newMemoryQueue(leaseTTL)
+}
+
+func newMemoryQueue(leaseTTL time.Duration) *memoryQueue {
+	if leaseTTL == 0 {
+		leaseTTL = DefaultLeaseTTL
+	}
+
+	q := &memoryQueue{
+		leaseTTL: leaseTTL,
+		queues:   make(map[string]map[ulid.ULID]uint64),
+		leases:   make(map[ulid.ULID]memoryLease),
+	}
+	for _, p := range queues {
+		q.queues[p.key] = make(map[ulid.ULID]uint64)
+	}
+	return q
+}
+
+// PushAt queues id with priority to be popped at the ulid timestamp at.
+func (q *memoryQueue) PushAt(id ulid.ULID, at uint64, priority string) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	q.queues[queueKey(priority)][id] = at
+	delete(q.leases, id)
+	q.notify()
+}
+
+// Peek returns the first id to be due among the queues of every priority and
+// the time it is due.
+func (q *memoryQueue) Peek() (*ulid.ULID, uint64) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	var (
+		first *ulid.ULID
+		at    uint64
+	)
+	for _, p := range queues {
+		id, t, ok := q.head(p.key)
+		if ok && (first == nil || t < at) {
+			first, at = &id, t
+		}
+	}
+	return first, at
+}
+
+// Pop leases the id due at the ulid timestamp now with the highest priority,
+// it returns nil when no id is due.
+func (q *memoryQueue) Pop(now uint64) (*lease, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	for _, p := range queues {
+		id, t, ok := q.head(p.key)
+		if !ok || t > now {
+			continue
+		}
+
+		q.counter++
+		l := lease{id, strconv.FormatUint(q.counter, 10)}
+		delete(q.queues[p.key], id)
+		q.leases[id] = memoryLease{
+			token:    l.token,
+			queue:    p.key,
+			deadline: now + uint64(q.leaseTTL/time.Millisecond),
+		}
+		return &l, nil
+	}
+
+	return nil, nil
+}
+
+// Done releases a lease once its message was sent, failed or queued again.
+func (q *memoryQueue) Done(l lease) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if ml, ok := q.leases[l.id]; ok && ml.token == l.token {
+		delete(q.leases, l.id)
+	}
+	return nil
+}
+
+// Reclaim queues again the ids whose lease expired at the ulid timestamp
+// now.
+func (q *memoryQueue) Reclaim(now uint64) (int, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	var n int
+	for id, ml := range q.leases {
+		if ml.deadline > now {
+			continue
+		}
+		q.queues[ml.queue][id] = now
+		delete(q.leases, id)
+		n++
+	}
+	if n > 0 {
+		q.notify()
+	}
+	return n, nil
+}
+
+// Recover is Reclaim, the leases of a memory queue don't outlive the
+// scheduler.
+func (q *memoryQueue) Recover(now uint64, dead []string) (int, error) {
+	return q.Reclaim(now)
+}
+
+// Subscribe signals wake on every push to the queue.
+func (q *memoryQueue) Subscribe(wake chan<- struct{}) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	q.wakes = append(q.wakes, wake)
+}
+
+// DeleteByID removes id from the queues, it reports whether it was queued.
+func (q *memoryQueue) DeleteByID(id ulid.ULID) (bool, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	var removed bool
+	for _, ids := range q.queues {
+		if _, ok := ids[id]; ok {
+			delete(ids, id)
+			removed = true
+		}
+	}
+	return removed, nil
+}
+
+// head returns the first id of the queue key, ordered by time and then id
+// like the sorted sets of the redis queue.
+func (q *memoryQueue) head(key string) (ulid.ULID, uint64, bool) {
+	var (
+		first ulid.ULID
+		at    uint64
+		found bool
+	)
+	for id, t := range q.queues[key] {
+		if !found || t < at || (t == at && id.Compare(first) < 0) {
+			first, at, found = id, t, true
+		}
+	}
+	return first, at, found
+}
+
+// notify signals the subscribers without blocking, a pending signal is
+// enough to re-arm their timers.
+func (q *memoryQueue) notify() {
+	for _, wake := range q.wakes {
+		select {
+		case wake <- struct{}{}:
+		default:
+		}
+	}
+}
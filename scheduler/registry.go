@@ -0,0 +1,173 @@
+package scheduler
+
+import (
+	"log"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/garyburd/redigo/redis"
+	"github.com/iampigeon/pigeon"
+	"github.com/oklog/ulid"
+)
+
+// DefaultRegistryTTL is how long a backend registration lasts without
+// heartbeats when StorageConfig.RegistryTTL is zero.
+const DefaultRegistryTTL = 30 * time.Second
+
+// registry keeps the backend instances registered for each channel in a
+// registryStore, shared by the schedulers when it is kept in redis, and
+// balances between them.
+type registry struct {
+	ttl   time.Duration
+	store registryStore
+
+	mu   sync.Mutex
+	next map[string]int
+}
+
+// registryStore keeps the registered addresses of each channel until they
+// expire.
+type registryStore interface {
+	// add registers addr for channel until expires.
+	add(channel string, addr pigeon.NetAddr, expires time.Time) error
+
+	// live returns the addresses of channel that did not expire at now,
+	// sorted.
+	live(channel string, now time.Time) ([]pigeon.NetAddr, error)
+}
+
+func newRegistry(ttl time.Duration, store registryStore) *registry {
+	if ttl == 0 {
+		ttl = DefaultRegistryTTL
+	}
+
+	return &registry{
+		ttl:   ttl,
+		store: store,
+		next:  make(map[string]int),
+	}
+}
+
+// register adds or renews the instance of channel at addr.
+func (r *registry) register(channel string, addr pigeon.NetAddr, now time.Time) error {
+	return r.store.add(channel, addr, now.Add(r.ttl))
+}
+
+// pick returns the next live instance of channel in round robin order,
+// skipping the ones for which healthy reports false. When no instance is
+// healthy any live instance is returned.
+func (r *registry) pick(channel string, now time.Time, healthy func(pigeon.NetAddr) bool) (pigeon.NetAddr, bool) {
+	live, err := r.store.live(channel, now)
+	if err != nil {
+		log.Printf("Error: could not get the %s backends, %v", channel, err)
+		return "", false
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if len(live) == 0 {
+		delete(r.next, channel)
+		return "", false
+	}
+
+	start := r.next[channel] % len(live)
+	for i := 0; i < len(live); i++ {
+		addr := live[(start+i)%len(live)]
+		if healthy == nil || healthy(addr) {
+			r.next[channel] = (start + i + 1) % len(live)
+			return addr, true
+		}
+	}
+
+	r.next[channel] = (start + 1) % len(live)
+	return live[start], true
+}
+
+// memoryRegistry is a registryStore of a single scheduler.
+type memoryRegistry struct {
+	mu        sync.Mutex
+	instances map[string]map[pigeon.NetAddr]time.Time
+}
+
+func newMemoryRegistry() *memoryRegistry {
+	return &memoryRegistry{instances: make(map[string]map[pigeon.NetAddr]time.Time)}
+}
+
+func (m *memoryRegistry) add(channel string, addr pigeon.NetAddr, expires time.Time) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.instances[channel] == nil {
+		m.instances[channel] = make(map[pigeon.NetAddr]time.Time)
+	}
+	m.instances[channel][addr] = expires
+	return nil
+}
+
+func (m *memoryRegistry) live(channel string, now time.Time) ([]pigeon.NetAddr, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var live []pigeon.NetAddr
+	for addr, expires := range m.instances[channel] {
+		if !expires.After(now) {
+			delete(m.instances[channel], addr)
+			continue
+		}
+		live = append(live, addr)
+	}
+	if len(live) == 0 {
+		delete(m.instances, channel)
+	}
+
+	sort.Slice(live, func(i, j int) bool { return live[i] < live[j] })
+	return live, nil
+}
+
+// redisRegistry is a registryStore shared by the schedulers of a redis
+// queue. The addresses of each channel are kept in the sorted set
+// registry:<channel>, scored by their expiry in unix milliseconds.
+type redisRegistry struct {
+	pool interface {
+		Get() redis.Conn
+	}
+}
+
+func registryKey(channel string) string {
+	return "registry:" + channel
+}
+
+func (rr *redisRegistry) add(channel string, addr pigeon.NetAddr, expires time.Time) error {
+	conn := rr.pool.Get()
+	defer conn.Close()
+
+	_, err := conn.Do("ZADD", registryKey(channel), ulid.Timestamp(expires), string(addr))
+	return err
+}
+
+func (rr *redisRegistry) live(channel string, now time.Time) ([]pigeon.NetAddr, error) {
+	conn := rr.pool.Get()
+	defer conn.Close()
+
+	key := registryKey(channel)
+	ms := ulid.Timestamp(now)
+
+	// the set is deleted by redis once its last address expires.
+	if _, err := conn.Do("ZREMRANGEBYSCORE", key, "-inf", ms); err != nil {
+		return nil, err
+	}
+	addrs, err := redis.Strings(conn.Do("ZRANGEBYSCORE", key, "("+strconv.FormatUint(ms, 10), "+inf"))
+	if err != nil {
+		return nil, err
+	}
+
+	live := make([]pigeon.NetAddr, 0, len(addrs))
+	for _, addr := range addrs {
+		live = append(live, pigeon.NetAddr(addr))
+	}
+	sort.Slice(live, func(i, j int) bool { return live[i] < live[j] })
+	return live, nil
+}
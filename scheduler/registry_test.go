@@ -0,0 +1,94 @@
+package scheduler
+
+import (
+	"testing"
+	"time"
+
+	"github.com/iampigeon/pigeon"
+)
+
+func TestRegistryRoundRobin(t *testing.T) {
+	r := newRegistry(time.Minute, newMemoryRegistry())
+	now := time.Unix(1500000000, 0)
+
+	for _, addr := range []pigeon.NetAddr{"b:9000", "a:9000", "c:9000"} {
+		if err := r.register("sms", addr, now); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var got []pigeon.NetAddr
+	for i := 0; i < 4; i++ {
+		addr, ok := r.pick("sms", now, nil)
+		if !ok {
+			t.Fatal("no backend picked")
+		}
+		got = append(got, addr)
+	}
+	want := []pigeon.NetAddr{"a:9000", "b:9000", "c:9000", "a:9000"}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Fatalf("picked %v, want %v", got, want)
+		}
+	}
+
+	if _, ok := r.pick("email", now, nil); ok {
+		t.Error("picked a backend of a channel without registrations")
+	}
+}
+
+func TestRegistryHealthy(t *testing.T) {
+	r := newRegistry(time.Minute, newMemoryRegistry())
+	now := time.Unix(1500000000, 0)
+	r.register("sms", "a:9000", now)
+	r.register("sms", "b:9000", now)
+
+	for i := 0; i < 3; i++ {
+		addr, _ := r.pick("sms", now, func(addr pigeon.NetAddr) bool { return addr != "a:9000" })
+		if addr != "b:9000" {
+			t.Fatalf("picked the unhealthy %s", addr)
+		}
+	}
+
+	// with no healthy backend one is still picked.
+	if _, ok := r.pick("sms", now, func(pigeon.NetAddr) bool { return false }); !ok {
+		t.Error("no backend picked when all are unhealthy")
+	}
+}
+
+func TestRegistryExpiry(t *testing.T) {
+	r := newRegistry(time.Minute, newMemoryRegistry())
+	now := time.Unix(1500000000, 0)
+	r.register("sms", "a:9000", now)
+	r.register("sms", "b:9000", now)
+
+	// a heartbeat renews the registration of a.
+	r.register("sms", "a:9000", now.Add(40*time.Second))
+
+	for i := 0; i < 3; i++ {
+		if addr, _ := r.pick("sms", now.Add(time.Minute), nil); addr != "a:9000" {
+			t.Fatalf("picked the expired %s", addr)
+		}
+	}
+	if _, ok := r.pick("sms", now.Add(100*time.Second), nil); ok {
+		t.Error("picked an expired backend")
+	}
+}
+
+func TestRegisterAddress(t *testing.T) {
+	s := &service{
+		registry: newRegistry(time.Minute, newMemoryRegistry()),
+		clock:    newFakeClock(time.Unix(1500000000, 0)),
+	}
+
+	for _, addr := range []pigeon.NetAddr{":9010", "0.0.0.0:9010", "[::]:9010", "sms"} {
+		if _, err := s.Register("sms", addr); err == nil {
+			t.Errorf("registered %q", addr)
+		}
+	}
+	for _, addr := range []pigeon.NetAddr{"sms-1.internal:9010", "10.0.0.7:9010"} {
+		if _, err := s.Register("sms", addr); err != nil {
+			t.Errorf("%q: %v", addr, err)
+		}
+	}
+}
@@ -3,17 +3,20 @@ package scheduler
 import (
 	"context"
 	"encoding/json"
+	"expvar"
+	"fmt"
 	"log"
 	"math/rand"
 	"net"
 	"time"
 
 	"github.com/iampigeon/pigeon"
-	"github.com/iampigeon/pigeon/db"
+	"github.com/iampigeon/pigeon/backend"
+	"github.com/iampigeon/pigeon/connpool"
 	pb "github.com/iampigeon/pigeon/proto"
+	"github.com/iampigeon/pigeon/tlsutil"
 	"github.com/oklog/ulid"
 	"github.com/pkg/errors"
-	"google.golang.org/grpc"
 )
 
 // TODO(ja): remove this struct.
@@ -21,26 +24,137 @@ import (
 // StorageConfig is a struct that will be deleted.
 type StorageConfig struct {
 	// BoltDatabase     string        // File to use as bolt database.
-	RedisURL         string        // URL of the redis server
+	RedisURL         string        // URL of the redis server, required unless Queue is set
 	RedisLog         bool          // log database commands
 	RedisMaxIdle     int           // maximum number of idle connections in the pool
 	RedisDatabase    int           // redis database to use
 	RedisIdleTimeout time.Duration // timeout for idle connections
 
-	MessageStore *db.MessageStore
+	MessageStore MessageStore
+
+	// Queue holds the messages of the scheduler instead of redis, such as a
+	// NewMemoryQueue for a single scheduler. When set the backend
+	// registrations and the message limits are kept in memory too.
+	Queue Queue
+
+	// BackendTLS secures the connections to the backends. The backend
+	// certificate must be valid for the host of the message endpoint.
+	BackendTLS *tlsutil.Credentials
+
+	// Conns holds the connections to the backends. When nil a pool using
+	// BackendTLS is created.
+	Conns *connpool.Pool
+
+	// RegistryTTL is how long a backend registration lasts without
+	// heartbeats.
+	RegistryTTL time.Duration
+
+	// Digests renders the digest messages when their window closes.
+	Digests pigeon.DigestRenderer
+
+	// Limits caps the deliveries to each backend address, channel or
+	// priority, DefaultLimits are used when nil.
+	Limits *Limits
+
+	// Breakers are the circuit breakers of the backends, created with the
+	// default configuration when nil.
+	Breakers *Breakers
+
+	// LeaseTTL is how long a popped message is leased to the scheduler
+	// sending it. Messages of schedulers that stop while sending them are
+	// queued again once their lease expires. A delivery is canceled after
+	// half of it, so a lease does not expire while its message is sent.
+	LeaseTTL time.Duration
+
+	// InstanceID identifies the leases of the scheduler among the ones
+	// sharing the queue. An id unique to the process, from its hostname and
+	// pid, is used when empty.
+	InstanceID string
+
+	// DeadInstanceIDs are the instance ids of schedulers known to be
+	// stopped. The messages they were sending are queued again when this
+	// scheduler starts, instead of once their leases expire.
+	DeadInstanceIDs []string
+
+	// Clock tells the time of the scheduler, the system clock is used when
+	// nil.
+	Clock Clock
 }
 
 // New builds a new pigeon.Store backed by bolt DB.
 //
 // In case of any error it panics.
 func New(config StorageConfig) pigeon.SchedulerService {
+	conns := config.Conns
+	if conns == nil {
+		conns = connpool.New(connpool.Config{Name: "backends", TLS: config.BackendTLS})
+	}
+
+	limits := config.Limits
+	if limits == nil {
+		limits = NewLimits(DefaultLimits)
+	}
+
+	breakers := config.Breakers
+	if breakers == nil {
+		breakers = NewBreakers(BreakerConfig{})
+	}
+
+	clock := config.Clock
+	if clock == nil {
+		clock = systemClock{}
+	}
+
+	leaseTTL := config.LeaseTTL
+	if leaseTTL == 0 {
+		leaseTTL = DefaultLeaseTTL
+	}
+
+	// an injected queue is not shared through redis, neither are the
+	// registry and the limits.
+	var (
+		pq    Queue
+		l     *limiter
+		store registryStore
+	)
+	if config.Queue != nil {
+		pq, l, store = config.Queue, newMemoryLimiter(clock), newMemoryRegistry()
+	} else {
+		if config.RedisURL == "" {
+			panic(errors.New("scheduler: RedisURL or Queue required"))
+		}
+		rq := newPriorityQueue(config)
+		pq, l, store = rq, &limiter{pool: rq.pool}, &redisRegistry{rq.pool}
+	}
+
 	s := &service{
-		pq:  newPriorityQueue(config),
-		idc: make(chan ulid.ULID),
+		pq:       pq,
+		idc:      make(chan entry),
+		wake:     make(chan struct{}, 1),
+		limiter:  l,
+		clock:    clock,
+		leaseTTL: leaseTTL,
+
+		ms:       config.MessageStore,
+		conns:    conns,
+		registry: newRegistry(config.RegistryTTL, store),
+		digests:  config.Digests,
+		limits:   limits,
+		breakers: breakers,
+	}
 
-		ms: config.MessageStore,
+	// messages in flight when the dead schedulers stopped are sent again,
+	// backends tell the repeated deliveries by their delivery id.
+	n, err := pq.Recover(ulid.Timestamp(s.clock.Now()), config.DeadInstanceIDs)
+	if err != nil {
+		log.Printf("Error: could not recover messages in flight, %v", err)
+	}
+	if n > 0 {
+		log.Printf("recovered %d messages in flight", n)
+		metrics.Add("recovered", int64(n))
 	}
 
+	go s.pq.Subscribe(s.wake)
 	go s.run()
 
 	return s
@@ -48,43 +162,98 @@ func New(config StorageConfig) pigeon.SchedulerService {
 
 var msgBucket = []byte("messages")
 
+// metrics counts the recovered, reclaimed, held and deferred messages and
+// the opened breakers of the schedulers of the process.
+var metrics = expvar.NewMap("scheduler")
+
+const (
+	// maxAttempts is the number of temporary delivery failures after which
+	// a message is failed.
+	maxAttempts = 5
+
+	// retryBackoff is the delay before the first retry of a temporary
+	// failure without a retry after hint, doubled on each attempt.
+	retryBackoff = 10 * time.Second
+)
+
+// entry is a message id to be queued at a ulid timestamp with its priority.
+type entry struct {
+	id       ulid.ULID
+	at       uint64
+	priority string
+}
+
 type service struct {
 	// db *bolt.DB
-	pq *priorityQueue
+	pq Queue
+
+	idc     chan entry
+	limiter *limiter
+	clock   Clock
+
+	// leaseTTL is how long a popped message is leased to this scheduler.
+	leaseTTL time.Duration
 
-	idc chan ulid.ULID
+	// wake is signaled when any scheduler sharing the queue pushes, the
+	// pushed id may be due before the current head.
+	wake chan struct{}
 
-	ms *db.MessageStore
+	ms       MessageStore
+	conns    *connpool.Pool
+	registry *registry
+	digests  pigeon.DigestRenderer
+	limits   *Limits
+	breakers *Breakers
 }
 
-func (s *service) Put(id ulid.ULID, content []byte, endpoint pigeon.NetAddr, status pigeon.MessageStatus, subjectID, userID string) error {
-	// TODO(ja): use secure connections
+func (s *service) Put(m pigeon.Message) error {
+	// drop the messages over their limit before the approval
+	if err := s.limiter.Allow(m.Limit); err != nil {
+		if err == pigeon.ErrThrottled || err == pigeon.ErrDeduplicated {
+			log.Printf("dropping message %s of subject %s, %v", m.ID, m.SubjectID, err)
+		}
+		return err
+	}
+
+	// the message only uses its throttle budget and starts its
+	// deduplication window once it is queued
+	queued := false
+	defer func() {
+		if !queued {
+			s.limiter.Release(m.Limit)
+		}
+	}()
 
-	host, port, err := net.SplitHostPort(string(endpoint))
+	endpoint, err := s.resolve(m)
 	if err != nil {
 		return err
 	}
 
-	endpoint = pigeon.NetAddr(net.JoinHostPort(host, port))
-	log.Println(endpoint)
+	// fail fast while the backend is down, which also stops the callback
+	// messages of its failures
+	if _, ok := s.breakers.allow(endpoint, s.clock.Now()); !ok {
+		return errors.Errorf("backend %s unavailable, circuit open", endpoint)
+	}
 
-	conn, err := grpc.Dial(string(endpoint), grpc.WithInsecure())
+	conn, err := s.conns.Get(endpoint)
 	if err != nil {
+		s.breakers.failure(endpoint, s.clock.Now())
 		return err
 	}
-	defer conn.Close()
 
 	client := pb.NewBackendServiceClient(conn)
-	resp, err := client.Approve(context.Background(), &pb.ApproveRequest{Content: content})
+	resp, err := client.Approve(context.Background(), &pb.ApproveRequest{Content: m.Content})
 	if err != nil {
+		s.breakers.failure(endpoint, s.clock.Now())
+
 		// update status to crashed-approve
-		e := s.ms.UpdateStatus(id, pigeon.StatusCrashedApprove)
+		e := s.ms.UpdateStatus(m.ID, pigeon.StatusCrashedApprove)
 		if e != nil {
 			return e
 		}
 
 		// send http error through pigeon-htpp
-		err := s.sendCallbackHTTPMessage(subjectID, "could not deliver message", userID)
+		err := s.sendCallbackHTTPMessage(m.SubjectID, "could not deliver message", m.UserID)
 		if err != nil {
 			// TODO(ca): check this error
 			log.Printf("Error: could not send callback http message %v", err)
@@ -93,15 +262,17 @@ func (s *service) Put(id ulid.ULID, content []byte, endpoint pigeon.NetAddr, sta
 
 		return err
 	}
+	s.breakers.success(endpoint)
+
 	if !resp.Valid {
 		// update status to failed-approve
-		err := s.ms.UpdateStatus(id, pigeon.StatusFailedApprove)
+		err := s.ms.UpdateStatus(m.ID, pigeon.StatusFailedApprove)
 		if err != nil {
 			return err
 		}
 
 		// send http error through pigeon-htpp
-		err = s.sendCallbackHTTPMessage(subjectID, "could not deliver message", userID)
+		err = s.sendCallbackHTTPMessage(m.SubjectID, "could not deliver message", m.UserID)
 		if err != nil {
 			return err
 		}
@@ -112,13 +283,12 @@ func (s *service) Put(id ulid.ULID, content []byte, endpoint pigeon.NetAddr, sta
 		return errors.New("invalid message")
 	}
 
-	m := pigeon.Message{
-		ID:        id,
-		Content:   content,
-		Status:    status,
-		Endpoint:  endpoint,
-		SubjectID: subjectID,
-		UserID:    userID,
+	if m.DigestID != "" {
+		if err := s.accumulate(m); err != nil {
+			return err
+		}
+		queued = true
+		return nil
 	}
 
 	err = s.ms.AddMessage(m)
@@ -126,7 +296,73 @@ func (s *service) Put(id ulid.ULID, content []byte, endpoint pigeon.NetAddr, sta
 		return err
 	}
 
-	s.idc <- id
+	s.push(m)
+	queued = true
+
+	return nil
+}
+
+// push queues m at the time of its id, deferred to the next opening of its
+// delivery window.
+func (s *service) push(m pigeon.Message) {
+	at := m.ID.Time()
+	if m.Window != nil {
+		next, err := m.Window.Next(time.Unix(0, int64(at)*int64(time.Millisecond)))
+		if err != nil {
+			log.Printf("Error: invalid delivery window of message %s, %v", m.ID, err)
+		} else {
+			at = ulid.Timestamp(next)
+		}
+	}
+
+	s.idc <- entry{m.ID, at, m.Priority}
+}
+
+// requeue queues msg again to be sent at t.
+func (s *service) requeue(msg *pigeon.Message, t time.Time) {
+	// pushed before the lease of the message is released, the push is
+	// announced to re-arm the timer.
+	s.pq.PushAt(msg.ID, ulid.Timestamp(t), msg.Priority)
+}
+
+// accumulate stores m in its digest instead of queuing it. The digest
+// message, described by m.Digest, is created with the first message of its
+// window and queued for the time of its id, when the window closes. A
+// message arriving after its digest was sent is queued on its own.
+func (s *service) accumulate(m pigeon.Message) error {
+	digestID, err := ulid.Parse(m.DigestID)
+	if err != nil {
+		return errors.Wrap(err, "invalid digest id")
+	}
+
+	digest := pigeon.Message{
+		ID:        digestID,
+		Endpoint:  m.Endpoint,
+		Channel:   m.Channel,
+		Status:    pigeon.StatusPending,
+		SubjectID: m.SubjectID,
+		UserID:    m.UserID,
+		Window:    m.Window,
+		Digest:    m.Digest,
+		Priority:  m.Priority,
+	}
+	m.Digest = nil
+
+	if err := s.ms.AddMessage(m); err != nil {
+		return err
+	}
+
+	status, err := s.ms.AddDigest(digest)
+	if err != nil {
+		return err
+	}
+	if status != pigeon.StatusPending {
+		log.Printf("digest %s already %s, sending message %s", digestID, status, m.ID)
+		s.push(m)
+		return nil
+	}
+
+	s.idc <- entry{digestID, digestID.Time(), digest.Priority}
 
 	return nil
 }
@@ -159,7 +395,7 @@ func (s *service) Update(id ulid.ULID, content []byte) error {
 }
 
 func (s *service) Cancel(id ulid.ULID) error {
-	ok, err := s.pq.DeleteByID(id)
+	ok, err := s.cancel(id)
 	if err != nil {
 		return err
 	}
@@ -169,103 +405,369 @@ func (s *service) Cancel(id ulid.ULID) error {
 		return nil
 	}
 
+	// cancelling a step of an escalation cancels the steps after it.
+	msg, err := s.ms.GetMessageByID(id)
+	if err != nil {
+		return err
+	}
+	if msg.ChainID != "" {
+		s.cancelChain(msg.ChainID, msg.ChainStep)
+	}
+
+	return nil
+}
+
+// cancel removes a queued message, it reports false when the message was
+// not queued.
+func (s *service) cancel(id ulid.ULID) (bool, error) {
+	ok, err := s.pq.DeleteByID(id)
+	if err != nil || !ok {
+		return false, err
+	}
+
 	err = s.ms.UpdateStatus(id, pigeon.StatusCancelled)
+	if err != nil {
+		return false, err
+	}
+
+	return true, nil
+}
+
+// cancelChain cancels the pending steps of an escalation chain after step.
+func (s *service) cancelChain(chainID string, step int) {
+	chain, err := s.ms.GetChain(chainID)
+	if err != nil {
+		log.Printf("Error: could not get escalation chain %s, %v", chainID, err)
+		return
+	}
+
+	for _, m := range chain {
+		if m.ChainStep <= step || m.Status != pigeon.StatusPending {
+			continue
+		}
+		if _, err := s.cancel(m.ID); err != nil {
+			log.Printf("Error: could not cancel escalation step %s, %v", m.ID, err)
+		}
+	}
+}
+
+// escalate sends now the next pending step of the escalation chain of msg,
+// instead of waiting for the timeout of the failed step.
+func (s *service) escalate(msg *pigeon.Message) {
+	if msg.ChainID == "" {
+		return
+	}
+
+	chain, err := s.ms.GetChain(msg.ChainID)
+	if err != nil {
+		log.Printf("Error: could not get escalation chain %s, %v", msg.ChainID, err)
+		return
+	}
+
+	for _, m := range chain {
+		if m.ChainStep > msg.ChainStep && m.Status == pigeon.StatusPending {
+			log.Printf("escalating message %s to %s step %s", msg.ID, m.Channel, m.ID)
+			s.requeue(m, s.clock.Now())
+			return
+		}
+	}
+}
+
+func (s *service) Register(channel string, addr pigeon.NetAddr) (time.Duration, error) {
+	if channel == "" {
+		return 0, errors.New("missing channel name")
+	}
+	host, _, err := net.SplitHostPort(string(addr))
+	if err != nil {
+		return 0, err
+	}
+	if ip := net.ParseIP(host); host == "" || ip != nil && ip.IsUnspecified() {
+		return 0, errors.Errorf("backend address %s has no host to dial, set its advertise address", addr)
+	}
+
+	if err := s.registry.register(channel, addr, s.clock.Now()); err != nil {
+		return 0, err
+	}
+	log.Printf("registered %s backend at %s", channel, addr)
+
+	return s.registry.ttl, nil
+}
+
+func (s *service) Heartbeat(channel string, addr pigeon.NetAddr) error {
+	_, err := s.Register(channel, addr)
+	return err
+}
+
+func (s *service) ReportReceipt(id ulid.ULID, status pigeon.MessageStatus, source, detail string) error {
+	if !status.IsReceipt() {
+		return errors.Errorf("invalid receipt status %s", status)
+	}
+
+	if err := s.ms.AddReceipt(id, status, source, detail); err != nil {
+		return err
+	}
+
+	// a delivered step resolves its escalation.
+	msg, err := s.ms.GetMessageByID(id)
 	if err != nil {
 		return err
 	}
+	if msg.ChainID != "" {
+		s.cancelChain(msg.ChainID, msg.ChainStep)
+	}
 
 	return nil
 }
 
+// resolve returns the address of the backend that handles m, balancing
+// between the registered instances of its channel and falling back to
+// m.Endpoint when there are none.
+func (s *service) resolve(m pigeon.Message) (pigeon.NetAddr, error) {
+	if m.Channel != "" {
+		addr, ok := s.registry.pick(m.Channel, s.clock.Now(), func(addr pigeon.NetAddr) bool {
+			return !s.conns.Failing(addr) && !s.breakers.open(addr)
+		})
+		if ok {
+			return addr, nil
+		}
+	}
+
+	host, port, err := net.SplitHostPort(string(m.Endpoint))
+	if err != nil {
+		return "", err
+	}
+
+	return pigeon.NetAddr(net.JoinHostPort(host, port)), nil
+}
+
+// deliverTimeout is how long a backend may take to deliver a message, half
+// its lease so the status is stored before the lease expires.
+func (s *service) deliverTimeout() time.Duration {
+	return s.leaseTTL / 2
+}
+
 // Run in its goroutine
+//
+// Several schedulers can share the queue. Each popped id is leased to the
+// scheduler that popped it, pushes from any of them re-arm the timers of all
+// through pub/sub, and expired leases are reclaimed periodically.
 func (s *service) run() {
 	var next uint64
-	var timer *time.Timer
+	var timer Timer
+
+	reclaimEvery := s.leaseTTL / 4
+	if reclaimEvery < time.Second {
+		reclaimEvery = time.Second
+	}
+	reclaim := s.clock.NewTimer(reclaimEvery)
 
 	pq := s.pq
 	for {
 		var tick <-chan time.Time
 
-		top := pq.Peek()
+		top, t := pq.Peek()
 		if top != nil {
-			if t := top.Time(); t < next || next == 0 {
+			if t < next || next == 0 {
 				var delay int64
-				now := ulid.Timestamp(time.Now())
+				now := ulid.Timestamp(s.clock.Now())
 				if t >= now {
 					delay = int64(t - now)
 				}
 
 				if timer == nil {
-					timer = time.NewTimer(time.Duration(delay) * time.Millisecond)
+					timer = s.clock.NewTimer(time.Duration(delay) * time.Millisecond)
 				} else {
 					if !timer.Stop() {
 						select {
-						case <-timer.C:
+						case <-timer.C():
 						default:
 						}
 					}
-					timer = time.NewTimer(time.Duration(delay) * time.Millisecond)
+					timer = s.clock.NewTimer(time.Duration(delay) * time.Millisecond)
 				}
 			}
 		}
 
 		if timer != nil && top != nil {
-			tick = timer.C
+			tick = timer.C()
 		}
 
 		select {
 		case <-tick:
-			id, err := pq.Pop()
+			// among the due messages the highest priority goes first.
+			l, err := pq.Pop(ulid.Timestamp(s.clock.Now()))
 			if err != nil {
 				log.Printf(err.Error())
 			}
 
-			if id != nil {
-				go s.send(*id)
+			if l != nil {
+				go s.dispatch(*l)
 			}
 			next = 0
-		case id := <-s.idc:
-			pq.Push(id)
+		case e := <-s.idc:
+			pq.PushAt(e.id, e.at, e.priority)
+		case <-s.wake:
+		case <-reclaim.C():
+			reclaim = s.clock.NewTimer(reclaimEvery)
+			n, err := pq.Reclaim(ulid.Timestamp(s.clock.Now()))
+			if err != nil {
+				log.Printf("Error: could not reclaim expired leases, %v", err)
+			}
+			if n > 0 {
+				log.Printf("reclaimed %d messages with expired leases", n)
+				metrics.Add("reclaimed", int64(n))
+			}
 		}
 	}
 }
 
-func (s *service) send(id ulid.ULID) {
+// dispatch sends the message of a lease and releases it once its status is
+// stored. Messages queued again by send already released their lease, and
+// the lease of a message whose status could not be stored is kept, so the
+// message is sent again when it is reclaimed.
+func (s *service) dispatch(l lease) {
+	if err := s.send(l.id); err != nil {
+		log.Printf("Error: message %s left in flight, %v", l.id, err)
+		return
+	}
+
+	if err := s.pq.Done(l); err != nil {
+		log.Printf("Error: could not release lease of message %s, %v", l.id, err)
+	}
+}
+
+// send delivers the message id. It returns an error when the message or its
+// status could not be read or stored.
+func (s *service) send(id ulid.ULID) error {
 	msg, err := s.GetMessageByID(id)
 	if err != nil {
-		log.Printf("Error: could not get message %s, %v", id, err)
-		return
+		return errors.Wrap(err, "could not get message")
+	}
+
+	if msg.Status == pigeon.StatusCancelled || msg.Status == pigeon.StatusMerged {
+		return nil
+	}
+
+	// stale messages are not worth sending, including retries and
+	// deferred messages
+	if msg.Expired(s.clock.Now()) {
+		return s.expire(msg)
+	}
+
+	// retries may fall outside the delivery window, wait for its opening.
+	if msg.Window != nil {
+		now := s.clock.Now()
+		next, err := msg.Window.Next(now)
+		if err == nil && next.After(now) {
+			log.Printf("deferring message %s to %s, outside its delivery window", id, next)
+			s.requeue(msg, next)
+			return nil
+		}
+	}
+
+	// digests are rendered once, when first sent
+	if msg.Digest != nil && len(msg.Content) == 0 {
+		ok, err := s.renderDigest(msg)
+		if err != nil {
+			log.Printf("Error: could not render digest %s, %v", id, err)
+
+			if e := s.ms.UpdateStatus(id, pigeon.StatusFailedDeliver); e != nil {
+				return errors.Wrap(e, "could not update message status")
+			}
+			return nil
+		}
+		if !ok {
+			return nil
+		}
 	}
 
-	// TODO(ja): use secure connections
-	conn, err := grpc.Dial(string(msg.Endpoint), grpc.WithInsecure())
+	endpoint, err := s.resolve(*msg)
 	if err != nil {
-		log.Printf("Error: could not connect to backend at %s, %v", msg.Endpoint, err)
-		return
+		log.Printf("Error: invalid backend address %s, %v", msg.Endpoint, err)
+
+		if e := s.ms.UpdateStatus(id, pigeon.StatusFailedDeliver); e != nil {
+			return errors.Wrap(e, "could not update message status")
+		}
+		return nil
+	}
+
+	// hold the message in the queue while its backend or the budget of its
+	// priority is at its limit
+	keys := []string{string(endpoint)}
+	if msg.Channel != "" {
+		keys = append(keys, msg.Channel)
 	}
-	defer conn.Close()
+	if wait, ok := s.limits.acquire(msg.Priority, keys, s.clock.Now()); !ok {
+		s.requeue(msg, s.clock.Now().Add(wait))
+		return nil
+	}
+	defer s.limits.release(msg.Priority, keys)
+
+	// defer the message while the circuit of its backend is open
+	if wait, ok := s.breakers.allow(endpoint, s.clock.Now()); !ok {
+		s.requeue(msg, s.clock.Now().Add(wait))
+		return nil
+	}
+
+	conn, err := s.conns.Get(endpoint)
+	if err != nil {
+		log.Printf("Error: could not connect to backend at %s, %v", endpoint, err)
+		s.breakers.failure(endpoint, s.clock.Now())
+		s.requeue(msg, s.clock.Now().Add(probeRetry))
+		return nil
+	}
+
+	// the lease must outlive the delivery, or another scheduler sends the
+	// message again while this one waits for the backend.
+	ctx, cancel := context.WithTimeout(context.Background(), s.deliverTimeout())
+	defer cancel()
 
 	client := pb.NewBackendServiceClient(conn)
-	resp, err := client.Deliver(context.Background(), &pb.DeliverRequest{Content: msg.Content})
+	resp, err := client.Deliver(ctx, &pb.DeliverRequest{
+		Content:    msg.Content,
+		MessageId:  msg.ID.String(),
+		DeliveryId: deliveryID(msg),
+	})
 	if err != nil {
 		log.Printf("Error: could not deliver message %s, %v", msg.ID, err)
 
+		// the failure opened the circuit, wait for the backend instead of
+		// failing the message
+		if s.breakers.failure(endpoint, s.clock.Now()) {
+			log.Printf("circuit of backend %s open, deferring message %s", endpoint, msg.ID)
+			s.requeue(msg, s.clock.Now().Add(s.breakers.config.Cooldown))
+			return nil
+		}
+
 		// update status to crashed-deliver
 		e := s.ms.UpdateStatus(id, pigeon.StatusCrashedDeliver)
 		if e != nil {
-			log.Printf("Error: could not update message status %s, %v", msg.ID, err)
-			return
+			return errors.Wrap(e, "could not update message status")
 		}
 
+		// try the next step of the escalation
+		s.escalate(msg)
+
 		// send http error through pigeon-htpp
 		err := s.sendCallbackHTTPMessage(msg.SubjectID, "could not deliver message", msg.UserID)
 		if err != nil {
 			// TODO(ca): check this error
 			log.Printf("Error: could not send callback http message %v", err)
-			return
 		}
 
-		return
+		return nil
+	}
+	s.breakers.success(endpoint)
+
+	if len(resp.InvalidRecipients) > 0 {
+		log.Printf("message %s has %d invalid recipients", msg.ID, len(resp.InvalidRecipients))
+
+		if err := s.ms.UpdateInvalidRecipients(id, resp.InvalidRecipients); err != nil {
+			log.Printf("Error: could not update message invalid recipients %s, %v", msg.ID, err)
+		}
+	}
+	if resp.Error != nil && resp.Error.Code == backend.CodeTemporary && msg.Attempts+1 < maxAttempts {
+		return s.retry(msg, time.Duration(resp.Error.RetryAfter)*time.Second)
 	}
 	if resp.Error != nil {
 		log.Printf("Error: failed to deliver message %s, %v", msg.ID, resp.Error.Message)
@@ -273,31 +775,131 @@ func (s *service) send(id ulid.ULID) {
 		// update status to failed-deliver
 		e := s.ms.UpdateStatus(id, pigeon.StatusFailedDeliver)
 		if e != nil {
-			// TODO(ca): check this error
-			log.Printf("Error: could not update message status %s, %v", msg.ID, err)
-			return
+			return errors.Wrap(e, "could not update message status")
 		}
 
+		// try the next step of the escalation
+		s.escalate(msg)
+
 		// send http error through pigeon-htpp
 		err := s.sendCallbackHTTPMessage(msg.SubjectID, "failed to deliver message", msg.UserID)
 		if err != nil {
 			// TODO(ca): check this error
 			log.Printf("Error: could not send callback http message %v", err)
-			return
 		}
 
-		return
+		return nil
 	}
 
+	// a sent step does not resolve its escalation, only a receipt does
 	e := s.ms.UpdateStatus(id, pigeon.StatusSent)
 	if e != nil {
-		log.Printf("Error: could not update message status %s, %v", msg.ID, err)
-		return
+		return errors.Wrap(e, "could not update message status")
+	}
+
+	return nil
+}
+
+// deliveryID returns the id of the delivery of the current attempt of msg,
+// the same when the attempt is repeated after the scheduler stopped.
+func deliveryID(msg *pigeon.Message) string {
+	return fmt.Sprintf("%s:%d", msg.ID, msg.Attempts)
+}
+
+// renderDigest renders the content of a digest from the messages
+// accumulated in it and merges them into it. It reports false when the
+// digest is empty, which is cancelled.
+func (s *service) renderDigest(msg *pigeon.Message) (bool, error) {
+	messages, err := s.ms.GetDigestMessages(msg.ID)
+	if err != nil {
+		return false, err
+	}
+
+	// expired messages are left out of the digest
+	now := s.clock.Now()
+	current := messages[:0]
+	for _, m := range messages {
+		if m.Expired(now) {
+			s.expire(m)
+			continue
+		}
+		current = append(current, m)
+	}
+	messages = current
+
+	if len(messages) == 0 {
+		return false, s.ms.UpdateStatus(msg.ID, pigeon.StatusCancelled)
 	}
+
+	if s.digests == nil {
+		return false, errors.New("missing digest renderer")
+	}
+
+	content, err := s.digests.RenderDigest(msg, messages)
+	if err != nil {
+		return false, err
+	}
+
+	if err := s.ms.UpdateContent(msg.ID, content); err != nil {
+		return false, err
+	}
+	msg.Content = content
+
+	ids := make([]ulid.ULID, 0, len(messages))
+	for _, m := range messages {
+		ids = append(ids, m.ID)
+	}
+	if err := s.ms.MergeDigest(msg.ID, ids); err != nil {
+		return false, err
+	}
+
+	log.Printf("merged %d messages into digest %s", len(ids), msg.ID)
+
+	return true, nil
+}
+
+// retry queues again a message that failed with a temporary error, after
+// retryAfter or an exponential backoff when it is zero. The message expires
+// instead when the retry would be after its expiry. It returns an error when
+// the attempts or the status could not be stored.
+func (s *service) retry(msg *pigeon.Message, retryAfter time.Duration) error {
+	attempts := msg.Attempts + 1
+	if retryAfter <= 0 {
+		retryAfter = retryBackoff << uint(attempts-1)
+	}
+
+	if msg.Expired(s.clock.Now().Add(retryAfter)) {
+		return s.expire(msg)
+	}
+
+	if err := s.ms.UpdateAttempts(msg.ID, attempts); err != nil {
+		return errors.Wrap(err, "could not update message attempts")
+	}
+
+	log.Printf("retrying message %s in %s, attempt %d", msg.ID, retryAfter, attempts)
+	s.requeue(msg, s.clock.Now().Add(retryAfter))
+	return nil
+}
+
+// expire sets the status of a stale message to expired and reports it
+// through the status callback. It returns an error when the status could not
+// be stored.
+func (s *service) expire(msg *pigeon.Message) error {
+	log.Printf("message %s expired at %s", msg.ID, msg.ExpiresAt)
+
+	if err := s.ms.UpdateStatus(msg.ID, pigeon.StatusExpired); err != nil {
+		return errors.Wrap(err, "could not update message status")
+	}
+
+	err := s.sendCallbackHTTPMessage(msg.SubjectID, fmt.Sprintf("message %s expired", msg.ID), msg.UserID)
+	if err != nil {
+		log.Printf("Error: could not send callback http message %v", err)
+	}
+	return nil
 }
 
 func (s *service) sendCallbackHTTPMessage(subjectID, messageError, userID string) error {
-	id, err := generateID(0)
+	id, err := generateID(s.clock.Now(), 0)
 	if err != nil {
 		return err
 	}
@@ -312,7 +914,15 @@ func (s *service) sendCallbackHTTPMessage(subjectID, messageError, userID string
 	}
 
 	// TODO(ca): use callback_post_url as a new HTTP message
-	err = s.Put(*id, c, pigeon.ServicePigeonHTTP, pigeon.StatusPending, subjectID, userID)
+	err = s.Put(pigeon.Message{
+		ID:        *id,
+		Content:   c,
+		Endpoint:  pigeon.EndpointHTTP,
+		Channel:   pigeon.ServicePigeonHTTP,
+		Status:    pigeon.StatusPending,
+		SubjectID: subjectID,
+		UserID:    userID,
+	})
 	if err != nil {
 		return err
 	}
@@ -321,12 +931,12 @@ func (s *service) sendCallbackHTTPMessage(subjectID, messageError, userID string
 }
 
 // TODO(ca): move this to other site.
-func generateID(criteriaDelay time.Duration) (*ulid.ULID, error) {
+func generateID(now time.Time, criteriaDelay time.Duration) (*ulid.ULID, error) {
 	delay := criteriaDelay
 
 	entropy := rand.New(rand.NewSource(time.Now().UnixNano()))
 	id, err := ulid.New(
-		ulid.Timestamp(time.Now().Add(delay)),
+		ulid.Timestamp(now.Add(delay)),
 		entropy,
 	)
 	if err != nil {
@@ -0,0 +1,486 @@
+package scheduler
+
+import (
+	"crypto/rand"
+	"errors"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/iampigeon/pigeon"
+	"github.com/iampigeon/pigeon/backend"
+	"github.com/iampigeon/pigeon/connpool"
+	"github.com/oklog/ulid"
+)
+
+// testScheduler is a scheduler on a fake clock, a memory queue and a fake
+// store, delivering to a fake backend.
+type testScheduler struct {
+	*service
+	clock   *fakeClock
+	queue   *testQueue
+	store   *fakeMessageStore
+	backend *backend.Fake
+	addr    pigeon.NetAddr
+}
+
+func newTestScheduler(t *testing.T, limits map[string]Limit) *testScheduler {
+	f := &backend.Fake{Delivered: make(chan backend.Delivery, 256)}
+
+	// the listener accepts the connections of the scheduler before the
+	// backend serves them.
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go backend.ServeListener(lis, backend.Config{}, f)
+
+	clock := newFakeClock(time.Unix(1500000000, 0))
+	queue := newTestQueue()
+	store := newFakeMessageStore()
+	s := New(StorageConfig{
+		Queue:        queue,
+		MessageStore: store,
+		Clock:        clock,
+		Limits:       NewLimits(limits),
+		Conns:        connpool.New(connpool.Config{}),
+	}).(*service)
+
+	return &testScheduler{s, clock, queue, store, f, pigeon.NetAddr(lis.Addr().String())}
+}
+
+// put sends a message to the scheduler due after d, and waits for it to be
+// queued.
+func (ts *testScheduler) put(t *testing.T, d time.Duration) pigeon.Message {
+	m := ts.message(t, d)
+	if err := ts.Put(m); err != nil {
+		t.Fatal(err)
+	}
+	ts.queue.waitQueued(m.ID)
+	return m
+}
+
+func (ts *testScheduler) message(t *testing.T, d time.Duration) pigeon.Message {
+	id, err := ulid.New(ulid.Timestamp(ts.clock.Now().Add(d)), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return pigeon.Message{
+		ID:       id,
+		Content:  []byte(`{"text": "hi"}`),
+		Endpoint: ts.addr,
+		Status:   pigeon.StatusPending,
+	}
+}
+
+// advance moves the clock forward by d and returns the ids of the messages
+// delivered once the scheduler settles.
+func (ts *testScheduler) advance(d time.Duration) []string {
+	ts.clock.Advance(d)
+	ts.queue.settle(ts.clock.Now())
+
+	var ids []string
+	for {
+		select {
+		case d := <-ts.backend.Delivered:
+			ids = append(ids, d.MessageID)
+		default:
+			return ids
+		}
+	}
+}
+
+// status returns the stored status of the message id.
+func (ts *testScheduler) status(t *testing.T, id ulid.ULID) pigeon.MessageStatus {
+	m, err := ts.store.GetMessageByID(id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return m.Status
+}
+
+// testQueue is a memory queue signalling its changes, so tests can wait for
+// the scheduler to queue or send its messages.
+type testQueue struct {
+	*memoryQueue
+
+	mu      sync.Mutex
+	changed *sync.Cond
+}
+
+func newTestQueue() *testQueue {
+	q := &testQueue{memoryQueue: newMemoryQueue(0)}
+	q.changed = sync.NewCond(&q.mu)
+	return q
+}
+
+func (q *testQueue) PushAt(id ulid.ULID, at uint64, priority string) {
+	q.memoryQueue.PushAt(id, at, priority)
+	q.signal()
+}
+
+func (q *testQueue) Pop(now uint64) (*lease, error) {
+	defer q.signal()
+	return q.memoryQueue.Pop(now)
+}
+
+func (q *testQueue) Done(l lease) error {
+	defer q.signal()
+	return q.memoryQueue.Done(l)
+}
+
+func (q *testQueue) Reclaim(now uint64) (int, error) {
+	defer q.signal()
+	return q.memoryQueue.Reclaim(now)
+}
+
+func (q *testQueue) DeleteByID(id ulid.ULID) (bool, error) {
+	defer q.signal()
+	return q.memoryQueue.DeleteByID(id)
+}
+
+func (q *testQueue) signal() {
+	q.mu.Lock()
+	q.changed.Broadcast()
+	q.mu.Unlock()
+}
+
+// wait waits for ready to report true, it is called with the memory queue
+// locked on each change.
+func (q *testQueue) wait(ready func() bool) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	for {
+		q.memoryQueue.mu.Lock()
+		ok := ready()
+		q.memoryQueue.mu.Unlock()
+		if ok {
+			return
+		}
+		q.changed.Wait()
+	}
+}
+
+// waitQueued waits for id to be queued.
+func (q *testQueue) waitQueued(id ulid.ULID) {
+	q.wait(func() bool {
+		for _, ids := range q.queues {
+			if _, ok := ids[id]; ok {
+				return true
+			}
+		}
+		return false
+	})
+}
+
+// settle waits for no message to be leased nor due at now. The messages
+// popped by then are delivered and their status stored.
+func (q *testQueue) settle(now time.Time) {
+	q.wait(func() bool {
+		if len(q.leases) > 0 {
+			return false
+		}
+		for _, p := range queues {
+			if _, at, ok := q.head(p.key); ok && at <= ulid.Timestamp(now) {
+				return false
+			}
+		}
+		return true
+	})
+}
+
+// failingStore is a fakeMessageStore failing to store statuses and attempts.
+type failingStore struct {
+	*fakeMessageStore
+}
+
+var errStoreDown = errors.New("store down")
+
+func (failingStore) UpdateStatus(ulid.ULID, pigeon.MessageStatus) error { return errStoreDown }
+func (failingStore) UpdateAttempts(ulid.ULID, int) error                { return errStoreDown }
+
+func TestDispatchStoreFailure(t *testing.T) {
+	clock := newFakeClock(time.Unix(1500000000, 0))
+	now := clock.Now()
+
+	tests := []struct {
+		name      string
+		msg       pigeon.Message
+		store     MessageStore
+		status    pigeon.MessageStatus
+		leaseKept bool
+	}{
+		{
+			name:      "expired",
+			msg:       pigeon.Message{Endpoint: "localhost:9000", ExpiresAt: &now},
+			store:     failingStore{newFakeMessageStore()},
+			status:    pigeon.StatusPending,
+			leaseKept: true,
+		},
+		{
+			name:   "invalid endpoint",
+			msg:    pigeon.Message{Endpoint: "nowhere"},
+			store:  newFakeMessageStore(),
+			status: pigeon.StatusFailedDeliver,
+		},
+		{
+			name:      "invalid endpoint, store down",
+			msg:       pigeon.Message{Endpoint: "nowhere"},
+			store:     failingStore{newFakeMessageStore()},
+			status:    pigeon.StatusPending,
+			leaseKept: true,
+		},
+	}
+
+	for _, tt := range tests {
+		q := newMemoryQueue(time.Minute)
+		s := &service{pq: q, ms: tt.store, clock: clock}
+
+		m := tt.msg
+		m.ID = ulid.MustNew(ulid.Timestamp(now), rand.Reader)
+		m.Status = pigeon.StatusPending
+		if err := tt.store.AddMessage(m); err != nil {
+			t.Fatal(err)
+		}
+		q.PushAt(m.ID, ulid.Timestamp(now), pigeon.PriorityNormal)
+		l, err := q.Pop(ulid.Timestamp(now))
+		if err != nil || l == nil {
+			t.Fatalf("%s: pop %v %v", tt.name, l, err)
+		}
+
+		s.dispatch(*l)
+
+		if stored, _ := tt.store.GetMessageByID(m.ID); stored.Status != tt.status {
+			t.Errorf("%s: message %s, want %s", tt.name, stored.Status, tt.status)
+		}
+		// a kept lease expires and the message is sent again.
+		n, err := q.Reclaim(ulid.Timestamp(now.Add(time.Minute)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if kept := n == 1; kept != tt.leaseKept {
+			t.Errorf("%s: lease kept %t, want %t", tt.name, kept, tt.leaseKept)
+		}
+	}
+}
+
+func TestRetryStoreFailure(t *testing.T) {
+	clock := newFakeClock(time.Unix(1500000000, 0))
+	q := newMemoryQueue(time.Minute)
+	s := &service{pq: q, ms: failingStore{newFakeMessageStore()}, clock: clock}
+
+	m := &pigeon.Message{ID: ulid.MustNew(ulid.Timestamp(clock.Now()), rand.Reader)}
+	if err := s.retry(m, time.Second); err == nil {
+		t.Error("retry without storing the attempts")
+	}
+	if id, _ := q.Peek(); id != nil {
+		t.Errorf("message %s queued again without its attempts", id)
+	}
+
+	expires := clock.Now()
+	m.ExpiresAt = &expires
+	if err := s.retry(m, time.Second); err == nil {
+		t.Error("expired without storing the status")
+	}
+}
+
+func TestDeliverTimeout(t *testing.T) {
+	for _, ttl := range []time.Duration{time.Second, DefaultLeaseTTL} {
+		s := &service{leaseTTL: ttl}
+		if d := s.deliverTimeout(); d <= 0 || d >= ttl {
+			t.Errorf("deliver timeout %s with a lease of %s", d, ttl)
+		}
+	}
+}
+
+func TestPutLimitNotQueued(t *testing.T) {
+	ts := newTestScheduler(t, nil)
+
+	limit := &pigeon.MessageLimit{
+		ThrottleKey: "user:1", ThrottleLimit: 1, ThrottlePeriod: time.Minute,
+		DedupKey: "alert:1", DedupWindow: time.Minute,
+	}
+
+	// a message failing before it is queued leaves its limit untouched.
+	failed := ts.message(t, time.Second)
+	failed.Endpoint = "nowhere"
+	failed.Limit = limit
+	if err := ts.Put(failed); err == nil {
+		t.Fatal("put a message without endpoint")
+	}
+
+	m := ts.message(t, time.Second)
+	m.Limit = limit
+	if err := ts.Put(m); err != nil {
+		t.Fatalf("put after a failed message: %v", err)
+	}
+
+	again := ts.message(t, time.Second)
+	again.Limit = limit
+	if err := ts.Put(again); err != pigeon.ErrDeduplicated {
+		t.Errorf("put of a queued duplicate: %v, want %v", err, pigeon.ErrDeduplicated)
+	}
+}
+
+func TestSchedulerOrder(t *testing.T) {
+	ts := newTestScheduler(t, nil)
+
+	third := ts.put(t, 3*time.Second)
+	first := ts.put(t, time.Second)
+	second := ts.put(t, 2*time.Second)
+
+	for _, m := range []pigeon.Message{first, second, third} {
+		if ids := ts.advance(time.Second - time.Millisecond); len(ids) > 0 {
+			t.Fatalf("delivered %v before %s is due", ids, m.ID)
+		}
+		if ids := ts.advance(time.Millisecond); len(ids) != 1 || ids[0] != m.ID.String() {
+			t.Fatalf("delivered %v, want %s", ids, m.ID)
+		}
+		if status := ts.status(t, m.ID); status != pigeon.StatusSent {
+			t.Errorf("delivered message %s", status)
+		}
+	}
+}
+
+func TestSchedulerEarlyWakeUp(t *testing.T) {
+	ts := newTestScheduler(t, nil)
+
+	// the timer of the head is armed, along with the reclaim timer.
+	head := ts.put(t, 10*time.Second)
+	ts.clock.waitTimers(2)
+
+	// a message due before the head re-arms the timer.
+	early := ts.put(t, 2*time.Second)
+	if ids := ts.advance(2 * time.Second); len(ids) != 1 || ids[0] != early.ID.String() {
+		t.Fatalf("delivered %v, want the early %s", ids, early.ID)
+	}
+
+	// so does a message pushed by another scheduler sharing the queue.
+	pushed := ts.message(t, 2*time.Second)
+	if err := ts.store.AddMessage(pushed); err != nil {
+		t.Fatal(err)
+	}
+	ts.pq.PushAt(pushed.ID, pushed.ID.Time(), pigeon.PriorityNormal)
+	if ids := ts.advance(2 * time.Second); len(ids) != 1 || ids[0] != pushed.ID.String() {
+		t.Fatalf("delivered %v, want the pushed %s", ids, pushed.ID)
+	}
+
+	if ids := ts.advance(6 * time.Second); len(ids) != 1 || ids[0] != head.ID.String() {
+		t.Fatalf("delivered %v, want %s", ids, head.ID)
+	}
+}
+
+func TestSchedulerCancel(t *testing.T) {
+	ts := newTestScheduler(t, nil)
+
+	cancelled := ts.put(t, time.Second)
+	next := ts.put(t, 2*time.Second)
+	if err := ts.Cancel(cancelled.ID); err != nil {
+		t.Fatal(err)
+	}
+	if status := ts.status(t, cancelled.ID); status != pigeon.StatusCancelled {
+		t.Fatalf("cancelled message %s", status)
+	}
+
+	if ids := ts.advance(2 * time.Second); len(ids) != 1 || ids[0] != next.ID.String() {
+		t.Fatalf("delivered %v, want %s", ids, next.ID)
+	}
+
+	// cancelling a sent message does nothing.
+	if err := ts.Cancel(next.ID); err != nil {
+		t.Fatal(err)
+	}
+	if status := ts.status(t, next.ID); status != pigeon.StatusSent {
+		t.Errorf("sent message %s", status)
+	}
+}
+
+func TestSchedulerBurst(t *testing.T) {
+	// the burst is larger than the in-flight budget, the messages over it
+	// are held and sent once the clock moves on.
+	ts := newTestScheduler(t, map[string]Limit{
+		priorityKey(pigeon.PriorityNormal): {MaxInFlight: 8},
+	})
+
+	const n = 100
+	ids := make(map[string]int)
+	for i := 0; i < n; i++ {
+		m := ts.put(t, time.Second)
+		ids[m.ID.String()] = 0
+	}
+
+	// each move of the clock sends at least a budget of held messages.
+	delivered := ts.advance(time.Second)
+	for sent := 0; sent < n; delivered = ts.advance(heldRetry) {
+		if len(delivered) == 0 {
+			t.Fatalf("delivered %d of %d messages", sent, n)
+		}
+		for _, id := range delivered {
+			count, ok := ids[id]
+			if !ok || count > 0 {
+				t.Fatalf("unexpected delivery of %s", id)
+			}
+			ids[id]++
+			sent++
+		}
+	}
+	if len(delivered) > 0 {
+		t.Errorf("delivered %v after the burst", delivered)
+	}
+}
+
+func TestSchedulerCriticalReserve(t *testing.T) {
+	// the bulk messages take every delivery to the endpoint but its
+	// reserve, which is left to the critical message.
+	ts := newTestScheduler(t, nil)
+	ts.limits.Set(map[string]Limit{string(ts.addr): {MaxInFlight: 4}})
+
+	const n = 10
+	bulk := make(map[string]bool)
+	var messages []pigeon.Message
+	for i := 0; i < n; i++ {
+		m := ts.message(t, time.Second)
+		m.Priority = pigeon.PriorityBulk
+		bulk[m.ID.String()] = true
+		messages = append(messages, m)
+	}
+
+	started := make(chan string, n)
+	gate := make(chan struct{})
+	defer close(gate)
+	ts.backend.Err = func(d backend.Delivery) error {
+		if bulk[d.MessageID] {
+			started <- d.MessageID
+			<-gate
+		}
+		return nil
+	}
+
+	for _, m := range messages {
+		if err := ts.Put(m); err != nil {
+			t.Fatal(err)
+		}
+		ts.queue.waitQueued(m.ID)
+	}
+	ts.clock.Advance(time.Second)
+	for i := 0; i < 3; i++ {
+		<-started
+	}
+
+	critical := ts.message(t, 0)
+	critical.Priority = pigeon.PriorityCritical
+	if err := ts.Put(critical); err != nil {
+		t.Fatal(err)
+	}
+	if d := <-ts.backend.Delivered; d.MessageID != critical.ID.String() {
+		t.Fatalf("delivered %s, want the critical %s", d.MessageID, critical.ID)
+	}
+	select {
+	case id := <-started:
+		t.Errorf("bulk delivery of %s over the reserve", id)
+	default:
+	}
+}
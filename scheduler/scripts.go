@@ -1,12 +1,18 @@
 package scheduler
 
 import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
 	"log"
 	"net/url"
+	"os"
+	"strconv"
+	"time"
 
 	"github.com/garyburd/redigo/redis"
+	"github.com/iampigeon/pigeon"
 	"github.com/oklog/ulid"
-	"github.com/pkg/errors"
 )
 
 // TODO: Add retry logic and only panic if connection is unrecoverable.
@@ -16,36 +22,164 @@ var (
 
 	scriptsSources = map[string]string{
 		"pop": `
-			local result_set = redis.call('ZRANGE', 'pq:ids', 0, 0)
-			if not result_set or #result_set == 0 then
-				return ''
+			local now = tonumber(ARGV[1])
+			local deadline = ARGV[2]
+			local token = ARGV[3]
+			local owner = ARGV[4]
+
+			-- the queues are in precedence order, the first due id wins.
+			-- it is leased in the processing set until its deadline.
+			for i = 5, #ARGV do
+				local result_set = redis.call('ZRANGE', ARGV[i], 0, 0, 'WITHSCORES')
+				if result_set and #result_set > 0 and tonumber(result_set[2]) <= now then
+					local id = result_set[1]
+					redis.call('ZREM', ARGV[i], id)
+					redis.call('ZADD', 'pq:processing', deadline, id)
+					redis.call('HSET', 'pq:leases', id, token)
+					redis.call('HSET', 'pq:lease_queues', id, ARGV[i])
+					redis.call('HSET', 'pq:lease_owners', id, owner)
+					return id
+				end
 			end
 
-			redis.call('ZREMRANGEBYRANK', 'pq:ids', 0, 0)
-
-			return result_set[1]
+			return ''
 		`,
 		"push": `
 			local timestamp = ARGV[1]
 			local id = ARGV[2]
+			local queue = ARGV[3]
+
+			redis.call('ZADD', queue, timestamp, id)
+
+			-- a message queued again is no longer leased.
+			redis.call('ZREM', 'pq:processing', id)
+			redis.call('HDEL', 'pq:leases', id)
+			redis.call('HDEL', 'pq:lease_queues', id)
+			redis.call('HDEL', 'pq:lease_owners', id)
 
-			redis.call('ZADD', 'pq:ids', timestamp, id)
+			redis.call('PUBLISH', 'pq:pushed', timestamp)
 
 			return true
 		`,
+		"done": `
+			local id = ARGV[1]
+			local token = ARGV[2]
+
+			-- only the holder of the lease releases it.
+			if redis.call('HGET', 'pq:leases', id) ~= token then
+				return 0
+			end
+
+			redis.call('ZREM', 'pq:processing', id)
+			redis.call('HDEL', 'pq:leases', id)
+			redis.call('HDEL', 'pq:lease_queues', id)
+			redis.call('HDEL', 'pq:lease_owners', id)
+
+			return 1
+		`,
+		"reclaim": `
+			local now = ARGV[1]
+
+			-- expired leases, and the live leases of the dead owners given.
+			local ids = redis.call('ZRANGEBYSCORE', 'pq:processing', '-inf', now)
+			if #ARGV > 1 then
+				local dead = {}
+				for i = 2, #ARGV do
+					dead[ARGV[i]] = true
+				end
+
+				local owned = redis.call('HGETALL', 'pq:lease_owners')
+				for i = 1, #owned, 2 do
+					local score = redis.call('ZSCORE', 'pq:processing', owned[i])
+					if dead[owned[i + 1]] and score and tonumber(score) > tonumber(now) then
+						table.insert(ids, owned[i])
+					end
+				end
+			end
+
+			for _, id in ipairs(ids) do
+				local queue = redis.call('HGET', 'pq:lease_queues', id)
+				if not queue then
+					queue = 'pq:ids'
+				end
+
+				redis.call('ZADD', queue, now, id)
+				redis.call('ZREM', 'pq:processing', id)
+				redis.call('HDEL', 'pq:leases', id)
+				redis.call('HDEL', 'pq:lease_queues', id)
+				redis.call('HDEL', 'pq:lease_owners', id)
+			end
+
+			if #ids > 0 then
+				redis.call('PUBLISH', 'pq:pushed', now)
+			end
+
+			return #ids
+		`,
 		"peek": `
-			local result_set = redis.call('ZRANGE', 'pq:ids', 0, 0)
-			if not result_set or #result_set == 0 then
-				return false
+			local first = false
+
+			for i = 1, #ARGV do
+				local result_set = redis.call('ZRANGE', ARGV[i], 0, 0, 'WITHSCORES')
+				if result_set and #result_set > 0 then
+					if not first or tonumber(result_set[2]) < tonumber(first[2]) then
+						first = result_set
+					end
+				end
+			end
+
+			return first
+		`,
+		"limit": `
+			local dedup_key = ARGV[1]
+			local dedup_window = tonumber(ARGV[2])
+			local throttle_key = ARGV[3]
+			local throttle_limit = tonumber(ARGV[4])
+			local throttle_period = tonumber(ARGV[5])
+
+			if dedup_key ~= '' and redis.call('EXISTS', dedup_key) == 1 then
+				return 'deduplicated'
+			end
+
+			if throttle_key ~= '' then
+				local count = redis.call('INCR', throttle_key)
+				if count == 1 then
+					redis.call('EXPIRE', throttle_key, throttle_period)
+				end
+				if count > throttle_limit then
+					return 'throttled'
+				end
+			end
+
+			if dedup_key ~= '' then
+				redis.call('SET', dedup_key, 1, 'EX', dedup_window)
+			end
+
+			return ''
+		`,
+		"release": `
+			local dedup_key = ARGV[1]
+			local throttle_key = ARGV[2]
+
+			if dedup_key ~= '' then
+				redis.call('DEL', dedup_key)
 			end
-			return result_set[1]
+
+			if throttle_key ~= '' and redis.call('DECR', throttle_key) <= 0 then
+				redis.call('DEL', throttle_key)
+			end
+
+			return ''
 		`,
 		"delete": `
 			local id = ARGV[1]
 
-			local result_set = redis.call('DEL', 'pq:ids', id)
+			local removed = 0
+			for i = 2, #ARGV do
+				removed = removed + redis.call('ZREM', ARGV[i], id)
+			end
 
-			return result_set
+			return removed
 		`,
 	}
 )
@@ -58,10 +192,64 @@ func init() {
 	}
 }
 
+// queues are the sorted sets of the ids of each priority, in precedence
+// order. Normal messages use the original pq:ids set.
+var queues = []struct {
+	priority string
+	key      string
+}{
+	{pigeon.PriorityCritical, "pq:ids:critical"},
+	{pigeon.PriorityHigh, "pq:ids:high"},
+	{pigeon.PriorityNormal, "pq:ids"},
+	{pigeon.PriorityBulk, "pq:ids:bulk"},
+}
+
+// queueKey returns the sorted set of the ids of priority, normal when
+// empty or unknown.
+func queueKey(priority string) string {
+	for _, q := range queues {
+		if q.priority == priority {
+			return q.key
+		}
+	}
+	return "pq:ids"
+}
+
+// queueKeys returns the arguments of the scripts iterating the queues.
+func queueKeys(args ...interface{}) []interface{} {
+	for _, q := range queues {
+		args = append(args, q.key)
+	}
+	return args
+}
+
+// pushedChannel is the pub/sub channel announcing pushes to every
+// scheduler sharing the queue.
+const pushedChannel = "pq:pushed"
+
+// DefaultLeaseTTL is how long a popped message is leased to the scheduler
+// sending it when StorageConfig.LeaseTTL is zero.
+const DefaultLeaseTTL = 2 * time.Minute
+
 type priorityQueue struct {
 	pool interface {
 		Get() redis.Conn
 	}
+
+	// leaseTTL is how long a popped id stays in the processing set before
+	// it is reclaimed.
+	leaseTTL time.Duration
+
+	// owner identifies the leases of this scheduler.
+	owner string
+}
+
+// lease is an id popped from the queue. It stays in the processing set until
+// it is released with Done, queued again or reclaimed after its lease
+// expires.
+type lease struct {
+	id    ulid.ULID
+	token string
 }
 
 func newPriorityQueue(config StorageConfig) *priorityQueue {
@@ -78,58 +266,181 @@ func newPriorityQueue(config StorageConfig) *priorityQueue {
 	}
 	conn.Close()
 
-	return &priorityQueue{pool}
+	leaseTTL := config.LeaseTTL
+	if leaseTTL == 0 {
+		leaseTTL = DefaultLeaseTTL
+	}
+
+	owner := config.InstanceID
+	if owner == "" {
+		var err error
+		if owner, err = newInstanceID(); err != nil {
+			panic(err)
+		}
+	}
+	log.Printf("leasing messages as instance %s", owner)
+
+	return &priorityQueue{pool, leaseTTL, owner}
+}
+
+// newInstanceID returns an id unique to this process, its hostname and pid
+// with a random suffix, so schedulers restarted on the same host or sharing
+// a hostname never take each other's leases.
+func newInstanceID() (string, error) {
+	hostname, err := os.Hostname()
+	if err != nil {
+		return "", err
+	}
+
+	b := make([]byte, 4)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%s-%d-%s", hostname, os.Getpid(), hex.EncodeToString(b)), nil
 }
 
 func (pq *priorityQueue) Push(id ulid.ULID) {
+	pq.PushAt(id, id.Time(), pigeon.PriorityNormal)
+}
+
+// PushAt queues id with priority to be popped at the ulid timestamp at
+// instead of the time of the id, used to retry messages.
+func (pq *priorityQueue) PushAt(id ulid.ULID, at uint64, priority string) {
 	conn := pq.pool.Get()
 	defer conn.Close()
 
-	_, err := scripts["push"].Do(conn, id.Time(), id.String())
+	_, err := scripts["push"].Do(conn, at, id.String(), queueKey(priority))
 	if err != nil {
 		panic(err)
 	}
 }
 
-func (pq *priorityQueue) Peek() *ulid.ULID {
+// Peek returns the first id to be due among the queues of every priority and
+// the time it is due.
+func (pq *priorityQueue) Peek() (*ulid.ULID, uint64) {
 	conn := pq.pool.Get()
 	defer conn.Close()
 
-	idStr, err := redis.String(scripts["peek"].Do(conn))
+	values, err := redis.Strings(scripts["peek"].Do(conn, queueKeys()...))
 	if err != nil {
 		if err == redis.ErrNil {
-			return nil
+			return nil, 0
 		}
 		panic(err)
 	}
 
-	id, err := ulid.Parse(idStr)
+	id, err := ulid.Parse(values[0])
 	if err != nil {
 		panic(err)
 	}
-	return &id
+
+	at, err := strconv.ParseUint(values[1], 10, 64)
+	if err != nil {
+		panic(err)
+	}
+	return &id, at
 }
 
-func (pq *priorityQueue) Pop() (*ulid.ULID, error) {
+// Pop leases the id due at the ulid timestamp now with the highest priority,
+// it returns nil when no id is due, such as when another scheduler popped
+// it first.
+func (pq *priorityQueue) Pop(now uint64) (*lease, error) {
 	conn := pq.pool.Get()
 	defer conn.Close()
 
-	idStr, err := redis.String(scripts["pop"].Do(conn))
+	token, err := newLeaseToken()
+	if err != nil {
+		return nil, err
+	}
+	deadline := now + uint64(pq.leaseTTL/time.Millisecond)
+
+	idStr, err := redis.String(scripts["pop"].Do(conn, queueKeys(now, deadline, token, pq.owner)...))
 	if err != nil {
 		return nil, err
 	}
 
 	if idStr == "" {
-		return nil, errors.New("not found message at pop on priority queue")
+		return nil, nil
 	}
 
 	id, err := ulid.Parse(idStr)
 	if err != nil {
 		return nil, err
-		panic(err)
 	}
 
-	return &id, nil
+	return &lease{id, token}, nil
+}
+
+// Done releases a lease once its message was sent, failed or queued again.
+func (pq *priorityQueue) Done(l lease) error {
+	conn := pq.pool.Get()
+	defer conn.Close()
+
+	_, err := scripts["done"].Do(conn, l.id.String(), l.token)
+	return err
+}
+
+// Reclaim queues again the ids whose lease expired at the ulid timestamp
+// now, the scheduler that popped them stopped before releasing them.
+func (pq *priorityQueue) Reclaim(now uint64) (int, error) {
+	conn := pq.pool.Get()
+	defer conn.Close()
+
+	return redis.Int(scripts["reclaim"].Do(conn, now))
+}
+
+// Recover queues again the ids leased by the dead schedulers, along with the
+// expired leases, so the messages in flight when they stopped are sent again
+// without waiting for their leases to expire. The leases of this scheduler
+// are never taken.
+func (pq *priorityQueue) Recover(now uint64, dead []string) (int, error) {
+	conn := pq.pool.Get()
+	defer conn.Close()
+
+	args := []interface{}{now}
+	for _, owner := range dead {
+		if owner != "" && owner != pq.owner {
+			args = append(args, owner)
+		}
+	}
+	return redis.Int(scripts["reclaim"].Do(conn, args...))
+}
+
+// Subscribe signals wake on every push to the queue, from any scheduler,
+// until the process exits.
+func (pq *priorityQueue) Subscribe(wake chan<- struct{}) {
+	for {
+		psc := redis.PubSubConn{Conn: pq.pool.Get()}
+		if err := psc.Subscribe(pushedChannel); err != nil {
+			log.Printf("Error: could not subscribe to %s, %v", pushedChannel, err)
+		} else {
+		receive:
+			for {
+				switch v := psc.Receive().(type) {
+				case redis.Message:
+					select {
+					case wake <- struct{}{}:
+					default:
+					}
+				case error:
+					log.Printf("Error: subscription to %s failed, %v", pushedChannel, v)
+					break receive
+				}
+			}
+		}
+		psc.Close()
+
+		time.Sleep(time.Second)
+	}
+}
+
+// newLeaseToken returns a random token identifying a lease.
+func newLeaseToken() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
 }
 
 // DeleteByID
@@ -138,7 +449,7 @@ func (pq *priorityQueue) DeleteByID(id ulid.ULID) (bool, error) {
 	defer conn.Close()
 
 	// TODO: check for casting
-	res, err := redis.Int(scripts["delete"].Do(conn, id.String()))
+	res, err := redis.Int(scripts["delete"].Do(conn, queueKeys(id.String())...))
 	if err != nil {
 		return false, err
 	}
@@ -0,0 +1,107 @@
+package scheduler
+
+import (
+	"os"
+	"testing"
+	"time"
+
+	"github.com/iampigeon/pigeon"
+	"github.com/oklog/ulid"
+)
+
+// redisQueue returns a queue of the redis server at PIGEON_TEST_REDIS_URL
+// leased as owner, the test is skipped when it is not set. The database 15
+// of the server is flushed.
+func redisQueue(t *testing.T, owner string) *priorityQueue {
+	rawURL := os.Getenv("PIGEON_TEST_REDIS_URL")
+	if rawURL == "" {
+		t.Skip("PIGEON_TEST_REDIS_URL not set")
+	}
+
+	pq := newPriorityQueue(StorageConfig{
+		RedisURL:      rawURL,
+		RedisDatabase: 15,
+		LeaseTTL:      time.Minute,
+		InstanceID:    owner,
+	})
+	conn := pq.pool.Get()
+	defer conn.Close()
+	if _, err := conn.Do("FLUSHDB"); err != nil {
+		t.Fatal(err)
+	}
+	return pq
+}
+
+func TestNewInstanceID(t *testing.T) {
+	a, err := newInstanceID()
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := newInstanceID()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if a == b {
+		t.Errorf("instance ids of the same process are equal: %s", a)
+	}
+}
+
+func TestRecoverDeadOwners(t *testing.T) {
+	live := redisQueue(t, "live")
+	dead := &priorityQueue{live.pool, live.leaseTTL, "dead"}
+	restarted := &priorityQueue{live.pool, live.leaseTTL, "restarted"}
+
+	now := ulid.Timestamp(time.Now())
+	ids := []ulid.ULID{
+		ulid.MustNew(now-2, nil),
+		ulid.MustNew(now-1, nil),
+	}
+	for _, id := range ids {
+		live.PushAt(id, now-1, pigeon.PriorityNormal)
+	}
+	if l, err := live.Pop(now); err != nil || l == nil {
+		t.Fatalf("live pop: %v %v", l, err)
+	}
+	if l, err := dead.Pop(now); err != nil || l == nil {
+		t.Fatalf("dead pop: %v %v", l, err)
+	}
+
+	// the live leases of unknown or running owners are never taken.
+	if n, err := restarted.Recover(now, nil); err != nil || n != 0 {
+		t.Fatalf("recovered %d without dead owners: %v", n, err)
+	}
+	if n, err := restarted.Recover(now, []string{"dead"}); err != nil || n != 1 {
+		t.Fatalf("recovered %d leases of the dead owner, want 1: %v", n, err)
+	}
+	if n, err := live.Reclaim(now + uint64(time.Hour/time.Millisecond)); err != nil || n != 1 {
+		t.Fatalf("reclaimed %d expired leases, want 1: %v", n, err)
+	}
+}
+
+func TestRedisRegistry(t *testing.T) {
+	pq := redisQueue(t, "a")
+	now := time.Now()
+
+	// two schedulers share the registrations.
+	r1 := newRegistry(time.Minute, &redisRegistry{pq.pool})
+	r2 := newRegistry(time.Minute, &redisRegistry{pq.pool})
+
+	if err := r1.register("sms", "a:9000", now); err != nil {
+		t.Fatal(err)
+	}
+	if err := r2.register("sms", "b:9000", now.Add(30*time.Second)); err != nil {
+		t.Fatal(err)
+	}
+
+	live, err := r1.store.live("sms", now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(live) != 2 || live[0] != "a:9000" || live[1] != "b:9000" {
+		t.Errorf("live %v", live)
+	}
+
+	if addr, ok := r2.pick("sms", now.Add(time.Minute), nil); !ok || addr != "b:9000" {
+		t.Errorf("picked %s, want the live b:9000", addr)
+	}
+}
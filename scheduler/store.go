@@ -0,0 +1,26 @@
+package scheduler
+
+import (
+	"github.com/iampigeon/pigeon"
+	"github.com/iampigeon/pigeon/db"
+	"github.com/oklog/ulid"
+)
+
+// MessageStore stores the messages of the scheduler and their status, see
+// db.MessageStore.
+type MessageStore interface {
+	AddMessage(m pigeon.Message) error
+	GetMessage(id ulid.ULID, u *pigeon.User) (*pigeon.Message, error)
+	GetMessageByID(id ulid.ULID) (*pigeon.Message, error)
+	UpdateContent(id ulid.ULID, content []byte) error
+	UpdateStatus(id ulid.ULID, status pigeon.MessageStatus) error
+	AddReceipt(id ulid.ULID, status pigeon.MessageStatus, source, detail string) error
+	UpdateInvalidRecipients(id ulid.ULID, recipients []string) error
+	UpdateAttempts(id ulid.ULID, attempts int) error
+	GetChain(chainID string) ([]*pigeon.Message, error)
+	AddDigest(m pigeon.Message) (pigeon.MessageStatus, error)
+	GetDigestMessages(digestID ulid.ULID) ([]*pigeon.Message, error)
+	MergeDigest(digestID ulid.ULID, ids []ulid.ULID) error
+}
+
+var _ MessageStore = (*db.MessageStore)(nil)
@@ -0,0 +1,190 @@
+package scheduler
+
+import (
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/iampigeon/pigeon"
+	"github.com/iampigeon/pigeon/db"
+	"github.com/oklog/ulid"
+)
+
+var _ MessageStore = (*fakeMessageStore)(nil)
+
+// fakeMessageStore is a MessageStore kept in memory, used to run a scheduler
+// without a database. It is safe for concurrent use.
+type fakeMessageStore struct {
+	mu       sync.Mutex
+	messages map[ulid.ULID]*pigeon.Message
+}
+
+func newFakeMessageStore() *fakeMessageStore {
+	return &fakeMessageStore{messages: make(map[ulid.ULID]*pigeon.Message)}
+}
+
+// AddMessage stores m with an event of its status.
+func (fs *fakeMessageStore) AddMessage(m pigeon.Message) error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	m.Events = []*pigeon.Event{newFakeEvent(m.Status, pigeon.SourceScheduler, "")}
+	fs.messages[m.ID] = &m
+	return nil
+}
+
+// GetMessage returns the message id of the user u.
+func (fs *fakeMessageStore) GetMessage(id ulid.ULID, u *pigeon.User) (*pigeon.Message, error) {
+	m, err := fs.GetMessageByID(id)
+	if err != nil {
+		return nil, err
+	}
+	if m.UserID != u.ID {
+		return nil, db.ErrMessageNotFound
+	}
+	return m, nil
+}
+
+// GetMessageByID returns a copy of the message id.
+func (fs *fakeMessageStore) GetMessageByID(id ulid.ULID) (*pigeon.Message, error) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	m, ok := fs.messages[id]
+	if !ok {
+		return nil, db.ErrMessageNotFound
+	}
+	c := *m
+	return &c, nil
+}
+
+// UpdateContent sets the content of the message id.
+func (fs *fakeMessageStore) UpdateContent(id ulid.ULID, content []byte) error {
+	return fs.update(id, func(m *pigeon.Message) {
+		m.Content = content
+	})
+}
+
+// UpdateStatus sets the status of the message id, a receipt reported while
+// the message was being sent is kept like in db.MessageStore.
+func (fs *fakeMessageStore) UpdateStatus(id ulid.ULID, status pigeon.MessageStatus) error {
+	return fs.update(id, func(m *pigeon.Message) {
+		keep := m.Status == pigeon.StatusDelivered || m.Status == pigeon.StatusRead || m.Status == pigeon.StatusAcknowledged
+		if status != pigeon.StatusSent || !keep {
+			m.Status = status
+		}
+		m.Events = append(m.Events, newFakeEvent(status, pigeon.SourceScheduler, ""))
+	})
+}
+
+// AddReceipt adds a receipt to the history of the message id, and sets its
+// status when the receipt moves the message forward.
+func (fs *fakeMessageStore) AddReceipt(id ulid.ULID, status pigeon.MessageStatus, source, detail string) error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	m, ok := fs.messages[id]
+	if !ok {
+		return db.ErrMessageNotFound
+	}
+	for _, s := range status.Replaces() {
+		if m.Status == s {
+			m.Status = status
+			break
+		}
+	}
+	m.Events = append(m.Events, newFakeEvent(status, source, detail))
+	return nil
+}
+
+// UpdateInvalidRecipients sets the invalid recipients of the message id.
+func (fs *fakeMessageStore) UpdateInvalidRecipients(id ulid.ULID, recipients []string) error {
+	return fs.update(id, func(m *pigeon.Message) {
+		m.InvalidRecipients = recipients
+	})
+}
+
+// UpdateAttempts sets the delivery attempts of the message id.
+func (fs *fakeMessageStore) UpdateAttempts(id ulid.ULID, attempts int) error {
+	return fs.update(id, func(m *pigeon.Message) {
+		m.Attempts = attempts
+	})
+}
+
+// GetChain returns the messages of an escalation chain sorted by step.
+func (fs *fakeMessageStore) GetChain(chainID string) ([]*pigeon.Message, error) {
+	chain := fs.filter(func(m *pigeon.Message) bool { return m.ChainID == chainID })
+	sort.SliceStable(chain, func(i, j int) bool { return chain[i].ChainStep < chain[j].ChainStep })
+	return chain, nil
+}
+
+// AddDigest stores the digest message m unless it exists, and returns the
+// status of the stored digest.
+func (fs *fakeMessageStore) AddDigest(m pigeon.Message) (pigeon.MessageStatus, error) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	if d, ok := fs.messages[m.ID]; ok {
+		return d.Status, nil
+	}
+	m.Events = []*pigeon.Event{newFakeEvent(m.Status, pigeon.SourceScheduler, "")}
+	fs.messages[m.ID] = &m
+	return m.Status, nil
+}
+
+// GetDigestMessages returns the pending messages accumulated in a digest.
+func (fs *fakeMessageStore) GetDigestMessages(digestID ulid.ULID) ([]*pigeon.Message, error) {
+	return fs.filter(func(m *pigeon.Message) bool {
+		return m.DigestID == digestID.String() && m.Status == pigeon.StatusPending
+	}), nil
+}
+
+// MergeDigest sets the status of the messages accumulated in a digest to
+// merged.
+func (fs *fakeMessageStore) MergeDigest(digestID ulid.ULID, ids []ulid.ULID) error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	for _, id := range ids {
+		m, ok := fs.messages[id]
+		if !ok || m.DigestID != digestID.String() {
+			continue
+		}
+		m.Status = pigeon.StatusMerged
+		m.Events = append(m.Events, newFakeEvent(pigeon.StatusMerged, pigeon.SourceScheduler, digestID.String()))
+	}
+	return nil
+}
+
+// update applies f to the message id, the message is not added when
+// missing like in db.MessageStore.
+func (fs *fakeMessageStore) update(id ulid.ULID, f func(m *pigeon.Message)) error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	if m, ok := fs.messages[id]; ok {
+		f(m)
+	}
+	return nil
+}
+
+// filter returns copies of the messages for which keep reports true, sorted
+// by id.
+func (fs *fakeMessageStore) filter(keep func(m *pigeon.Message) bool) []*pigeon.Message {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	messages := make([]*pigeon.Message, 0)
+	for _, m := range fs.messages {
+		if keep(m) {
+			c := *m
+			messages = append(messages, &c)
+		}
+	}
+	sort.Slice(messages, func(i, j int) bool { return messages[i].ID.Compare(messages[j].ID) < 0 })
+	return messages
+}
+
+func newFakeEvent(status pigeon.MessageStatus, source, detail string) *pigeon.Event {
+	return &pigeon.Event{Status: status, Time: time.Now(), Source: source, Detail: detail}
+}
@@ -0,0 +1,160 @@
+package scheduler
+
+import (
+	"log"
+	"sync"
+	"time"
+
+	"github.com/garyburd/redigo/redis"
+	"github.com/iampigeon/pigeon"
+)
+
+// limiter throttles and deduplicates messages with expiring counters in
+// redis, shared by every scheduler using the same database. Without a pool
+// the counters are kept in memory for a single scheduler.
+type limiter struct {
+	pool interface {
+		Get() redis.Conn
+	}
+
+	clock   Clock
+	mu      sync.Mutex
+	counts  map[string]int
+	expires map[string]time.Time
+}
+
+func newMemoryLimiter(clock Clock) *limiter {
+	return &limiter{
+		clock:   clock,
+		counts:  make(map[string]int),
+		expires: make(map[string]time.Time),
+	}
+}
+
+// Allow counts a message against its limit, it returns pigeon.ErrThrottled or
+// pigeon.ErrDeduplicated when the message must be dropped. Throttled
+// messages do not start a deduplication window.
+func (l *limiter) Allow(limit *pigeon.MessageLimit) error {
+	if limit == nil {
+		return nil
+	}
+
+	dedupKey, throttleKey := limitKeys(limit)
+	if dedupKey == "" && throttleKey == "" {
+		return nil
+	}
+
+	if l.pool == nil {
+		return l.allowMemory(limit, dedupKey, throttleKey)
+	}
+
+	conn := l.pool.Get()
+	defer conn.Close()
+
+	result, err := redis.String(scripts["limit"].Do(conn,
+		dedupKey, int64(limit.DedupWindow/time.Second),
+		throttleKey, limit.ThrottleLimit, int64(limit.ThrottlePeriod/time.Second),
+	))
+	if err != nil {
+		return err
+	}
+
+	switch result {
+	case pigeon.ErrThrottled.Error():
+		return pigeon.ErrThrottled
+	case pigeon.ErrDeduplicated.Error():
+		return pigeon.ErrDeduplicated
+	}
+
+	return nil
+}
+
+// Release gives back what Allow counted for a message that was not queued
+// after all, its throttle count and its deduplication window.
+func (l *limiter) Release(limit *pigeon.MessageLimit) {
+	if limit == nil {
+		return
+	}
+
+	dedupKey, throttleKey := limitKeys(limit)
+	if dedupKey == "" && throttleKey == "" {
+		return
+	}
+
+	if l.pool == nil {
+		l.releaseMemory(dedupKey, throttleKey)
+		return
+	}
+
+	conn := l.pool.Get()
+	defer conn.Close()
+
+	if _, err := scripts["release"].Do(conn, dedupKey, throttleKey); err != nil {
+		log.Printf("Error: could not release the limit of a message, %v", err)
+	}
+}
+
+// limitKeys returns the keys of the counters of limit, empty for the parts
+// of the limit that are not set.
+func limitKeys(limit *pigeon.MessageLimit) (dedupKey, throttleKey string) {
+	if limit.DedupKey != "" && limit.DedupWindow >= time.Second {
+		dedupKey = "dedup:" + limit.DedupKey
+	}
+	if limit.ThrottleKey != "" && limit.ThrottleLimit > 0 && limit.ThrottlePeriod >= time.Second {
+		throttleKey = "throttle:" + limit.ThrottleKey
+	}
+	return dedupKey, throttleKey
+}
+
+// allowMemory is Allow with the counters in memory, it follows the limit
+// script.
+func (l *limiter) allowMemory(limit *pigeon.MessageLimit, dedupKey, throttleKey string) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := l.clock.Now()
+	for key, expires := range l.expires {
+		if !expires.After(now) {
+			delete(l.expires, key)
+			delete(l.counts, key)
+		}
+	}
+
+	if _, ok := l.expires[dedupKey]; dedupKey != "" && ok {
+		return pigeon.ErrDeduplicated
+	}
+
+	if throttleKey != "" {
+		l.counts[throttleKey]++
+		if l.counts[throttleKey] == 1 {
+			l.expires[throttleKey] = now.Add(limit.ThrottlePeriod.Truncate(time.Second))
+		}
+		if l.counts[throttleKey] > limit.ThrottleLimit {
+			return pigeon.ErrThrottled
+		}
+	}
+
+	if dedupKey != "" {
+		l.expires[dedupKey] = now.Add(limit.DedupWindow.Truncate(time.Second))
+	}
+
+	return nil
+}
+
+// releaseMemory is Release with the counters in memory, it follows the
+// release script.
+func (l *limiter) releaseMemory(dedupKey, throttleKey string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if dedupKey != "" {
+		delete(l.expires, dedupKey)
+	}
+	if throttleKey != "" {
+		l.counts[throttleKey]--
+		if l.counts[throttleKey] <= 0 {
+			delete(l.counts, throttleKey)
+			delete(l.expires, throttleKey)
+		}
+	}
+}
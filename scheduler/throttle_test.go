@@ -0,0 +1,59 @@
+package scheduler
+
+import (
+	"testing"
+	"time"
+
+	"github.com/iampigeon/pigeon"
+)
+
+func TestMemoryLimiter(t *testing.T) {
+	clock := newFakeClock(time.Unix(1500000000, 0))
+	l := newMemoryLimiter(clock)
+
+	throttle := &pigeon.MessageLimit{ThrottleKey: "user:1", ThrottleLimit: 2, ThrottlePeriod: time.Minute}
+	for i, want := range []error{nil, nil, pigeon.ErrThrottled} {
+		if err := l.Allow(throttle); err != want {
+			t.Fatalf("message %d: %v, want %v", i, err, want)
+		}
+	}
+	clock.Advance(time.Minute)
+	if err := l.Allow(throttle); err != nil {
+		t.Errorf("throttled after the period: %v", err)
+	}
+
+	dedup := &pigeon.MessageLimit{DedupKey: "alert:1", DedupWindow: 10 * time.Second}
+	if err := l.Allow(dedup); err != nil {
+		t.Fatal(err)
+	}
+	if err := l.Allow(dedup); err != pigeon.ErrDeduplicated {
+		t.Errorf("duplicate: %v, want %v", err, pigeon.ErrDeduplicated)
+	}
+	clock.Advance(10 * time.Second)
+	if err := l.Allow(dedup); err != nil {
+		t.Errorf("deduplicated after the window: %v", err)
+	}
+}
+
+func TestMemoryLimiterRelease(t *testing.T) {
+	clock := newFakeClock(time.Unix(1500000000, 0))
+	l := newMemoryLimiter(clock)
+
+	limit := &pigeon.MessageLimit{
+		ThrottleKey: "user:1", ThrottleLimit: 1, ThrottlePeriod: time.Minute,
+		DedupKey: "alert:1", DedupWindow: 10 * time.Second,
+	}
+	for i := 0; i < 3; i++ {
+		if err := l.Allow(limit); err != nil {
+			t.Fatalf("message %d after a release: %v", i, err)
+		}
+		l.Release(limit)
+	}
+
+	if err := l.Allow(limit); err != nil {
+		t.Fatal(err)
+	}
+	if err := l.Allow(limit); err != pigeon.ErrDeduplicated {
+		t.Errorf("duplicate: %v, want %v", err, pigeon.ErrDeduplicated)
+	}
+}
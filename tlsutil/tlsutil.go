@@ -0,0 +1,252 @@
+/*
+Package tlsutil builds the TLS credentials used by the grpc connections
+between the scheduler, the HTTP service and the backends.
+
+A nil *Credentials means plain text connections, so callers can thread an
+optional value without checking it.
+*/
+package tlsutil
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"io/ioutil"
+	"net"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/iampigeon/pigeon"
+	"github.com/pkg/errors"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+)
+
+// DefaultReloadInterval is how often certificate files are checked for
+// changes when Config.ReloadInterval is zero.
+const DefaultReloadInterval = 30 * time.Second
+
+// Config describes the certificates used by one side of a connection.
+type Config struct {
+	CertFile string // PEM certificate presented to the peer
+	KeyFile  string // PEM private key of CertFile
+	CAFile   string // PEM bundle used to verify the peer, system roots if empty
+
+	// ClientAuth requires client certificates signed by CAFile (mutual
+	// TLS). It is only used on the server side.
+	ClientAuth bool
+
+	// ReloadInterval is how often the files are checked for changes.
+	ReloadInterval time.Duration
+}
+
+// Credentials holds the certificates described by a Config and reloads them
+// when the files change on disk.
+type Credentials struct {
+	config Config
+
+	mu      sync.RWMutex
+	cert    *tls.Certificate
+	pool    *x509.CertPool
+	modTime time.Time
+	checked time.Time
+}
+
+// Load reads the files of config and returns the resulting credentials.
+func Load(config Config) (*Credentials, error) {
+	if (config.CertFile == "") != (config.KeyFile == "") {
+		return nil, errors.New("tls: both cert and key files must be set")
+	}
+	if config.ClientAuth && config.CAFile == "" {
+		return nil, errors.New("tls: client auth requires a ca file")
+	}
+	if config.ReloadInterval == 0 {
+		config.ReloadInterval = DefaultReloadInterval
+	}
+
+	c := &Credentials{config: config}
+	if err := c.load(); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// ServerOptions returns the grpc options to serve with these credentials.
+func (c *Credentials) ServerOptions() []grpc.ServerOption {
+	if c == nil {
+		return nil
+	}
+
+	clientAuth := tls.NoClientCert
+	if c.config.ClientAuth {
+		clientAuth = tls.RequireAndVerifyClientCert
+	}
+
+	config := &tls.Config{
+		GetConfigForClient: func(*tls.ClientHelloInfo) (*tls.Config, error) {
+			cert, pool := c.current()
+			if cert == nil {
+				return nil, errors.New("tls: server certificate not configured")
+			}
+			return &tls.Config{
+				Certificates: []tls.Certificate{*cert},
+				ClientCAs:    pool,
+				ClientAuth:   clientAuth,
+				MinVersion:   tls.VersionTLS12,
+				NextProtos:   []string{"h2"},
+			}, nil
+		},
+	}
+
+	return []grpc.ServerOption{grpc.Creds(credentials.NewTLS(config))}
+}
+
+// DialOption returns the grpc option to connect to addr. The peer
+// certificate must be valid for the host part of addr.
+func (c *Credentials) DialOption(addr pigeon.NetAddr) (grpc.DialOption, error) {
+	if c == nil {
+		return grpc.WithInsecure(), nil
+	}
+
+	host, _, err := net.SplitHostPort(string(addr))
+	if err != nil {
+		return nil, err
+	}
+
+	// the peer is verified on each handshake with the current pool, so
+	// pooled connections see a reloaded ca file.
+	config := &tls.Config{
+		ServerName:            host,
+		InsecureSkipVerify:    true,
+		VerifyPeerCertificate: c.verifyPeer(host),
+		MinVersion:            tls.VersionTLS12,
+		GetClientCertificate: func(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+			cert, _ := c.current()
+			if cert == nil {
+				return &tls.Certificate{}, nil
+			}
+			return cert, nil
+		},
+	}
+
+	return grpc.WithTransportCredentials(credentials.NewTLS(config)), nil
+}
+
+// verifyPeer returns a function verifying the certificate chain of a peer
+// against the current ca pool, or the system roots when there is none, and
+// host.
+func (c *Credentials) verifyPeer(host string) func([][]byte, [][]*x509.Certificate) error {
+	return func(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+		if len(rawCerts) == 0 {
+			return errors.New("tls: no peer certificate")
+		}
+
+		certs := make([]*x509.Certificate, 0, len(rawCerts))
+		for _, raw := range rawCerts {
+			cert, err := x509.ParseCertificate(raw)
+			if err != nil {
+				return errors.Wrap(err, "tls: invalid peer certificate")
+			}
+			certs = append(certs, cert)
+		}
+
+		_, pool := c.current()
+		opts := x509.VerifyOptions{
+			DNSName:       host,
+			Roots:         pool,
+			Intermediates: x509.NewCertPool(),
+		}
+		for _, cert := range certs[1:] {
+			opts.Intermediates.AddCert(cert)
+		}
+
+		_, err := certs[0].Verify(opts)
+		return err
+	}
+}
+
+// current returns the loaded certificate and pool, reloading them first if
+// the reload interval has elapsed and the files changed.
+func (c *Credentials) current() (*tls.Certificate, *x509.CertPool) {
+	c.mu.RLock()
+	stale := time.Since(c.checked) >= c.config.ReloadInterval
+	c.mu.RUnlock()
+
+	if stale {
+		if err := c.load(); err != nil {
+			// keep serving with the previous certificates.
+			c.mu.Lock()
+			c.checked = time.Now()
+			c.mu.Unlock()
+		}
+	}
+
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.cert, c.pool
+}
+
+func (c *Credentials) load() error {
+	modTime, err := latestModTime(c.config.CertFile, c.config.KeyFile, c.config.CAFile)
+	if err != nil {
+		return err
+	}
+
+	c.mu.RLock()
+	unchanged := !c.modTime.IsZero() && !modTime.After(c.modTime)
+	c.mu.RUnlock()
+
+	if unchanged {
+		c.mu.Lock()
+		c.checked = time.Now()
+		c.mu.Unlock()
+		return nil
+	}
+
+	var cert *tls.Certificate
+	if c.config.CertFile != "" {
+		kp, err := tls.LoadX509KeyPair(c.config.CertFile, c.config.KeyFile)
+		if err != nil {
+			return errors.Wrap(err, "tls: could not load key pair")
+		}
+		cert = &kp
+	}
+
+	var pool *x509.CertPool
+	if c.config.CAFile != "" {
+		pem, err := ioutil.ReadFile(c.config.CAFile)
+		if err != nil {
+			return errors.Wrap(err, "tls: could not read ca file")
+		}
+		pool = x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return errors.Errorf("tls: no certificates found in %s", c.config.CAFile)
+		}
+	}
+
+	c.mu.Lock()
+	c.cert = cert
+	c.pool = pool
+	c.modTime = modTime
+	c.checked = time.Now()
+	c.mu.Unlock()
+
+	return nil
+}
+
+func latestModTime(files ...string) (time.Time, error) {
+	var latest time.Time
+	for _, f := range files {
+		if f == "" {
+			continue
+		}
+		fi, err := os.Stat(f)
+		if err != nil {
+			return time.Time{}, err
+		}
+		if fi.ModTime().After(latest) {
+			latest = fi.ModTime()
+		}
+	}
+	return latest, nil
+}
@@ -0,0 +1,125 @@
+package tlsutil
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// testCA is a self-signed certificate authority issuing leaf certificates.
+type testCA struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+	pem  []byte
+}
+
+func newTestCA(t *testing.T, name string) *testCA {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: name},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return &testCA{
+		cert: cert,
+		key:  key,
+		pem:  pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+	}
+}
+
+// issue returns the der certificate of host signed by ca.
+func (ca *testCA) issue(t *testing.T, host string) []byte {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(2),
+		Subject:      pkix.Name{CommonName: host},
+		DNSNames:     []string{host},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, ca.cert, &key.PublicKey, ca.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return der
+}
+
+func TestVerifyPeerReloadsCA(t *testing.T) {
+	dir, err := ioutil.TempDir("", "tlsutil")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	first := newTestCA(t, "first")
+	second := newTestCA(t, "second")
+
+	caFile := filepath.Join(dir, "ca.pem")
+	if err := ioutil.WriteFile(caFile, first.pem, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	c, err := Load(Config{CAFile: caFile, ReloadInterval: time.Nanosecond})
+	if err != nil {
+		t.Fatal(err)
+	}
+	verify := c.verifyPeer("scheduler")
+
+	if err := verify([][]byte{first.issue(t, "scheduler")}, nil); err != nil {
+		t.Fatalf("certificate of the loaded ca rejected, %v", err)
+	}
+	if err := verify([][]byte{first.issue(t, "other")}, nil); err == nil {
+		t.Fatal("certificate of another host accepted")
+	}
+	if err := verify([][]byte{second.issue(t, "scheduler")}, nil); err == nil {
+		t.Fatal("certificate of an unknown ca accepted")
+	}
+
+	// the same verify function sees the rotated ca file.
+	if err := ioutil.WriteFile(caFile, second.pem, 0600); err != nil {
+		t.Fatal(err)
+	}
+	later := time.Now().Add(time.Minute)
+	if err := os.Chtimes(caFile, later, later); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := verify([][]byte{second.issue(t, "scheduler")}, nil); err != nil {
+		t.Fatalf("certificate of the reloaded ca rejected, %v", err)
+	}
+	if err := verify([][]byte{first.issue(t, "scheduler")}, nil); err == nil {
+		t.Fatal("certificate of the replaced ca accepted")
+	}
+}
@@ -0,0 +1,127 @@
+package pigeon
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// weekdays by the names used in DeliveryWindow.Days.
+var weekdays = map[string]time.Weekday{
+	"sun": time.Sunday,
+	"mon": time.Monday,
+	"tue": time.Tuesday,
+	"wed": time.Wednesday,
+	"thu": time.Thursday,
+	"fri": time.Friday,
+	"sat": time.Saturday,
+}
+
+// DeliveryWindow restricts the delivery of the messages of a subject channel
+// to some hours of some days, in the timezone of the recipient. Messages due
+// outside the window are deferred to its next opening.
+type DeliveryWindow struct {
+	// Days are the days of the window, "mon" to "sun". All days when
+	// empty.
+	Days []string `json:"days,omitempty"`
+
+	// Start and End are the hours of the window, such as "08:00" and
+	// "20:00". A window ending before it starts spans midnight.
+	Start string `json:"start"`
+	End   string `json:"end"`
+
+	// Timezone is the IANA timezone of the window when the recipient has
+	// none, UTC when empty.
+	Timezone string `json:"timezone,omitempty"`
+
+	// CriticalOverride lets the messages of critical subjects bypass the
+	// window.
+	CriticalOverride bool `json:"critical_override,omitempty"`
+}
+
+// Validate checks the days, hours and timezone of w.
+func (w *DeliveryWindow) Validate() error {
+	for _, d := range w.Days {
+		if _, ok := weekdays[strings.ToLower(d)]; !ok {
+			return fmt.Errorf("invalid window day %s", d)
+		}
+	}
+	if _, err := parseClock(w.Start); err != nil {
+		return fmt.Errorf("invalid window start %s", w.Start)
+	}
+	if _, err := parseClock(w.End); err != nil {
+		return fmt.Errorf("invalid window end %s", w.End)
+	}
+	if w.Start == w.End {
+		return fmt.Errorf("empty window")
+	}
+	if _, err := time.LoadLocation(w.Timezone); err != nil {
+		return fmt.Errorf("invalid window timezone %s", w.Timezone)
+	}
+	return nil
+}
+
+// Next returns t when it is inside the window, otherwise the next opening of
+// the window after t.
+func (w *DeliveryWindow) Next(t time.Time) (time.Time, error) {
+	loc, err := time.LoadLocation(w.Timezone)
+	if err != nil {
+		return t, err
+	}
+	start, err := parseClock(w.Start)
+	if err != nil {
+		return t, err
+	}
+	end, err := parseClock(w.End)
+	if err != nil {
+		return t, err
+	}
+	if end <= start {
+		end += 24 * 60
+	}
+
+	lt := t.In(loc)
+	y, m, d := lt.Date()
+
+	// the window of the day before may still be open after midnight.
+	for i := -1; i <= 7; i++ {
+		if !w.hasDay(time.Date(y, m, d+i, 12, 0, 0, 0, loc).Weekday()) {
+			continue
+		}
+
+		// the hours are read on the clock of the day, which on a DST
+		// change is not as many hours after midnight.
+		open := time.Date(y, m, d+i, 0, start, 0, 0, loc)
+		close := time.Date(y, m, d+i, 0, end, 0, 0, loc)
+		if !lt.Before(open) && lt.Before(close) {
+			return t, nil
+		}
+		if open.After(lt) {
+			return open, nil
+		}
+	}
+
+	return t, fmt.Errorf("window without days")
+}
+
+func (w *DeliveryWindow) hasDay(d time.Weekday) bool {
+	if len(w.Days) == 0 {
+		return true
+	}
+	for _, name := range w.Days {
+		if weekdays[strings.ToLower(name)] == d {
+			return true
+		}
+	}
+	return false
+}
+
+// parseClock parses a time of day such as "08:00" as the minutes since
+// midnight.
+func parseClock(s string) (int, error) {
+	t, err := time.Parse("15:04", s)
+	if err != nil {
+		return 0, err
+	}
+	return t.Hour()*60 + t.Minute(), nil
+}
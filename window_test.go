@@ -0,0 +1,85 @@
+package pigeon
+
+import (
+	"testing"
+	"time"
+)
+
+func TestDeliveryWindowNext(t *testing.T) {
+	madrid, err := time.LoadLocation("Europe/Madrid")
+	if err != nil {
+		t.Fatal(err)
+	}
+	santiago, err := time.LoadLocation("America/Santiago")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name   string
+		window DeliveryWindow
+		t      time.Time
+		want   time.Time
+	}{
+		{
+			name:   "inside",
+			window: DeliveryWindow{Start: "08:00", End: "20:00", Timezone: "Europe/Madrid"},
+			t:      time.Date(2018, 3, 20, 12, 0, 0, 0, madrid),
+			want:   time.Date(2018, 3, 20, 12, 0, 0, 0, madrid),
+		},
+		{
+			name:   "before",
+			window: DeliveryWindow{Start: "08:00", End: "20:00", Timezone: "Europe/Madrid"},
+			t:      time.Date(2018, 3, 20, 6, 0, 0, 0, madrid),
+			want:   time.Date(2018, 3, 20, 8, 0, 0, 0, madrid),
+		},
+		{
+			name:   "after midnight",
+			window: DeliveryWindow{Start: "22:00", End: "02:00", Timezone: "Europe/Madrid"},
+			t:      time.Date(2018, 3, 20, 1, 0, 0, 0, madrid),
+			want:   time.Date(2018, 3, 20, 1, 0, 0, 0, madrid),
+		},
+		{
+			name:   "next day",
+			window: DeliveryWindow{Days: []string{"mon"}, Start: "08:00", End: "20:00", Timezone: "Europe/Madrid"},
+			t:      time.Date(2018, 3, 20, 12, 0, 0, 0, madrid),
+			want:   time.Date(2018, 3, 26, 8, 0, 0, 0, madrid),
+		},
+		{
+			name:   "DST start",
+			window: DeliveryWindow{Start: "08:00", End: "20:00", Timezone: "Europe/Madrid"},
+			t:      time.Date(2018, 3, 25, 7, 30, 0, 0, madrid),
+			want:   time.Date(2018, 3, 25, 8, 0, 0, 0, madrid),
+		},
+		{
+			name:   "DST start open",
+			window: DeliveryWindow{Start: "08:00", End: "20:00", Timezone: "Europe/Madrid"},
+			t:      time.Date(2018, 3, 25, 8, 30, 0, 0, madrid),
+			want:   time.Date(2018, 3, 25, 8, 30, 0, 0, madrid),
+		},
+		{
+			name:   "DST end",
+			window: DeliveryWindow{Start: "08:00", End: "20:00", Timezone: "Europe/Madrid"},
+			t:      time.Date(2018, 10, 28, 7, 30, 0, 0, madrid),
+			want:   time.Date(2018, 10, 28, 8, 0, 0, 0, madrid),
+		},
+		{
+			// the clocks of Santiago skip midnight on the day.
+			name:   "DST start at midnight",
+			window: DeliveryWindow{Days: []string{"sun"}, Start: "08:00", End: "10:00", Timezone: "America/Santiago"},
+			t:      time.Date(2018, 8, 11, 12, 0, 0, 0, santiago),
+			want:   time.Date(2018, 8, 12, 8, 0, 0, 0, santiago),
+		},
+	}
+
+	for _, tt := range tests {
+		got, err := tt.window.Next(tt.t)
+		if err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+			continue
+		}
+		if !got.Equal(tt.want) {
+			t.Errorf("%s: next of %s is %s, want %s", tt.name, tt.t, got, tt.want)
+		}
+	}
+}